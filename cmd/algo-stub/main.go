@@ -0,0 +1,29 @@
+// Command algo-stub serves the algo service protocol with algo.Local behind
+// it, for running the backend and its end-to-end tests without the real
+// service. Faults set by flags apply to every request; more can be scripted
+// at runtime through POST /__stub/fault.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"permit-backend/internal/algo/algostub"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
+	path := flag.String("fail-path", "", "endpoint the fault flags apply to (empty: all)")
+	latency := flag.Int("latency-ms", 0, "delay every answer by this many milliseconds")
+	status := flag.Int("fail-status", 0, "answer with this HTTP status instead of processing")
+	badBase64 := flag.Bool("bad-base64", false, "answer with undecodable image_base64 fields")
+	flag.Parse()
+
+	stub := algostub.New()
+	if *latency > 0 || *status != 0 || *badBase64 {
+		stub.Inject(algostub.Fault{Path: *path, LatencyMs: *latency, Status: *status, BadBase64: *badBase64})
+	}
+	log.Printf("algo-stub listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, stub))
+}
@@ -1,24 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"permit-backend/internal/config"
 	"permit-backend/internal/env"
 	"permit-backend/internal/server"
+	"syscall"
 )
 
 func main() {
 	env.Load(".env", ".env.local")
 	envDefaults := config.EnvDefaults()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:], envDefaults))
+	}
+
 	env := flag.String("env", envDefaults.Env, "")
 	port := flag.Int("port", envDefaults.Port, "")
 	assets := flag.String("assets", envDefaults.AssetsDir, "")
 	uploads := flag.String("uploads", envDefaults.UploadsDir, "")
+	private := flag.String("private", envDefaults.PrivateDir, "")
 	jwtSecret := flag.String("jwt-secret", envDefaults.JWTSecret, "")
 	logJSON := flag.Bool("log-json", envDefaults.LogJSON, "")
 
@@ -29,27 +37,122 @@ func main() {
 		Port:       *port,
 		AssetsDir:  *assets,
 		UploadsDir: *uploads,
+		PrivateDir: *private,
 		JWTSecret:  *jwtSecret,
 		LogJSON:    *logJSON,
 		AlgoURL:    envDefaults.AlgoURL,
+		AlgoMode: envDefaults.AlgoMode,
+		AlgoFaceDetect: envDefaults.AlgoFaceDetect,
+		AlgoTimeout: envDefaults.AlgoTimeout,
+		AlgoRetries: envDefaults.AlgoRetries,
+		AlgoRetryBackoff: envDefaults.AlgoRetryBackoff,
+		AlgoMaxConcurrent: envDefaults.AlgoMaxConcurrent,
+		AlgoAcquireTimeout: envDefaults.AlgoAcquireTimeout,
+		AlgoBreakerThreshold: envDefaults.AlgoBreakerThreshold,
+		AlgoBreakerCooldown: envDefaults.AlgoBreakerCooldown,
 		PayMock:    envDefaults.PayMock,
 		WechatAppID: envDefaults.WechatAppID,
 		WechatSecret: envDefaults.WechatSecret,
 		WechatMchID: envDefaults.WechatMchID,
 		WechatNotifyURL: envDefaults.WechatNotifyURL,
+		WechatRefundNotifyURL: envDefaults.WechatRefundNotifyURL,
+		WechatMchSerialNo: envDefaults.WechatMchSerialNo,
+		WechatMchKeyPath: envDefaults.WechatMchKeyPath,
+		WechatPayBaseURL: envDefaults.WechatPayBaseURL,
+		WechatAPIv3Key: envDefaults.WechatAPIv3Key,
+		WechatPlatformCertPath: envDefaults.WechatPlatformCertPath,
+		Storage: envDefaults.Storage,
 		PostgresDSN: envDefaults.PostgresDSN,
+		DBPingRetries: envDefaults.DBPingRetries,
+		DBPingInterval: envDefaults.DBPingInterval,
+		DBAutoMigrate: envDefaults.DBAutoMigrate,
+		TaskWorkers: envDefaults.TaskWorkers,
+		TaskQueueSize: envDefaults.TaskQueueSize,
+		PricingFile: envDefaults.PricingFile,
+		DownloadTTL: envDefaults.DownloadTTL,
+		PreviewTTL: envDefaults.PreviewTTL,
+		AssetSignKey: envDefaults.AssetSignKey,
+		AdminToken: envDefaults.AdminToken,
+		ObjectStore: envDefaults.ObjectStore,
+		S3Endpoint: envDefaults.S3Endpoint,
+		S3Region: envDefaults.S3Region,
+		S3Bucket: envDefaults.S3Bucket,
+		S3AccessKey: envDefaults.S3AccessKey,
+		S3SecretKey: envDefaults.S3SecretKey,
+		S3PathStyle: envDefaults.S3PathStyle,
+		S3PresignRedirect: envDefaults.S3PresignRedirect,
+		HTTPReadTimeout: envDefaults.HTTPReadTimeout,
+		HTTPReadHeaderTimeout: envDefaults.HTTPReadHeaderTimeout,
+		HTTPWriteTimeout: envDefaults.HTTPWriteTimeout,
+		HTTPIdleTimeout: envDefaults.HTTPIdleTimeout,
+		ShutdownTimeout: envDefaults.ShutdownTimeout,
+		UploadMaxDimension: envDefaults.UploadMaxDimension,
+		UploadMaxPixels: envDefaults.UploadMaxPixels,
+		UploadMinDimension: envDefaults.UploadMinDimension,
+		ImageConvertCmd: envDefaults.ImageConvertCmd,
+		ImageConvertTimeout: envDefaults.ImageConvertTimeout,
+		ImageConvertMaxBytes: envDefaults.ImageConvertMaxBytes,
+		UploadMaxBytes: envDefaults.UploadMaxBytes,
+		UploadChunkBytes: envDefaults.UploadChunkBytes,
+		UploadSessionTTL: envDefaults.UploadSessionTTL,
 	}
 
 	ensureDir(cfg.AssetsDir)
 	ensureDir(cfg.UploadsDir)
+	ensureDir(cfg.PrivateDir)
 
 	b, _ := json.MarshalIndent(cfg, "", "  ")
 	fmt.Println(string(b))
 
-	srv := server.New(cfg)
-	addr := fmt.Sprintf(":%d", cfg.Port)
+	srv, err := server.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "startup failed: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(serve(cfg, srv))
+}
+
+// serve runs the HTTP listener until it fails or SIGINT/SIGTERM arrives.
+// On a signal it stops accepting connections, waits for in-flight requests,
+// drains queued tasks and closes the database, all within ShutdownTimeout.
+// The return value is the process exit code.
+func serve(cfg config.Config, srv *server.Server) int {
+	hs := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           srv.Handler(),
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- hs.ListenAndServe() }()
 	fmt.Printf("Listening on http://127.0.0.1:%d\n", cfg.Port)
-	_ = http.ListenAndServe(addr, srv.Handler())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	code := 0
+	select {
+	case err := <-errCh:
+		fmt.Fprintf(os.Stderr, "listen failed: %v\n", err)
+		code = 1
+	case sig := <-sigCh:
+		fmt.Printf("received %s, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "http shutdown: %v\n", err)
+		code = 1
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "server shutdown: %v\n", err)
+		code = 1
+	}
+	return code
 }
 
 func ensureDir(p string) {
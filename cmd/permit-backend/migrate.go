@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"permit-backend/internal/config"
+	"permit-backend/internal/infrastructure/repo"
+)
+
+const migrateUsage = `usage: permit-backend migrate [-dsn DSN] <command>
+
+commands:
+  up          apply all pending migrations
+  down [N]    roll back the latest N applied migrations (default 1)
+  status      list migrations and when they were applied
+`
+
+// runMigrate implements `permit-backend migrate`. The DSN defaults to
+// POSTGRES_DSN from the environment.
+func runMigrate(args []string, envDefaults config.Config) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dsn := fs.String("dsn", envDefaults.PostgresDSN, "")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, migrateUsage) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *dsn == "" {
+		fmt.Fprintln(os.Stderr, "migrate: POSTGRES_DSN or -dsn is required")
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	pg, err := repo.NewPostgresRepo(*dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	defer pg.Close()
+	m, err := pg.Migrator()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mg := range applied {
+			fmt.Printf("up   %04d_%s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			n, err := strconv.Atoi(fs.Arg(1))
+			if err != nil || n <= 0 {
+				fmt.Fprintf(os.Stderr, "migrate: invalid step count %q\n", fs.Arg(1))
+				return 2
+			}
+			steps = n
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, mg := range reverted {
+			fmt.Printf("down %04d_%s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+	case "status":
+		st, err := m.Status(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		for _, s := range st {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05Z07:00")
+			}
+			fmt.Printf("%04d_%-24s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,293 @@
+// Package algostub is a stand-in for the algo service that speaks its
+// multipart protocol: /idphoto, /add_background and /generate_layout_photos
+// take the same form fields and answer with the same "status" and
+// "image_base64*" JSON, with images produced by algo.Local. /detect_faces
+// answers with scripted faces. Faults can be scripted per endpoint to
+// exercise timeouts, retries and bad payloads.
+package algostub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"permit-backend/internal/algo"
+)
+
+// FaultPath is the control endpoint: POST a Fault as JSON to script it,
+// DELETE to clear faults and call records.
+const FaultPath = "/__stub/fault"
+
+// Fault is a scripted misbehaviour for requests to Path ("" matches every
+// endpoint). Latency delays the answer; Status, when set, answers with that
+// HTTP status instead of processing; Reject answers 200 with status false
+// and that message, as the service does for input it cannot use; BadBase64
+// answers 200 with an image that does not decode. Times limits how many
+// requests it applies to; 0 keeps it until cleared.
+type Fault struct {
+	Path      string `json:"path"`
+	LatencyMs int    `json:"latencyMs"`
+	Status    int    `json:"status"`
+	Reject    string `json:"reject"`
+	BadBase64 bool   `json:"badBase64"`
+	Times     int    `json:"times"`
+}
+
+// Stub is an http.Handler serving the algo endpoints.
+type Stub struct {
+	local *algo.Local
+	mux   *http.ServeMux
+
+	mu       sync.Mutex
+	faults   []*Fault
+	calls    map[string]int
+	forms    map[string]url.Values
+	faces    []algo.Face
+	scripted bool
+}
+
+func New() *Stub {
+	s := &Stub{local: algo.NewLocal(), mux: http.NewServeMux(), calls: map[string]int{}, forms: map[string]url.Values{}}
+	s.mux.HandleFunc("/idphoto", s.endpoint(s.idphoto))
+	s.mux.HandleFunc("/add_background", s.endpoint(s.addBackground))
+	s.mux.HandleFunc("/generate_layout_photos", s.endpoint(s.layout))
+	s.mux.HandleFunc("/detect_faces", s.endpoint(s.detectFaces))
+	s.mux.HandleFunc(FaultPath, s.handleFault)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"status": true, "service": "algo-stub"})
+	})
+	return s
+}
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.mux.ServeHTTP(w, r) }
+
+// Inject adds f; faults are matched in the order they were added.
+func (s *Stub) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// SetFaces makes /detect_faces answer with faces, in pixels of the image
+// it receives. Until it is called, one upright face is reported in the
+// upper middle of the image.
+func (s *Stub) SetFaces(faces []algo.Face) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faces, s.scripted = faces, true
+}
+
+// Reset clears faults, scripted faces and call records.
+func (s *Stub) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+	s.faces, s.scripted = nil, false
+	s.calls = map[string]int{}
+	s.forms = map[string]url.Values{}
+}
+
+// Calls returns how many requests reached path.
+func (s *Stub) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+// LastForm returns the non-file form fields of the latest request to path.
+func (s *Stub) LastForm(path string) url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forms[path]
+}
+
+// take records a request to path and returns the fault that applies to it,
+// if any, using up one of its Times.
+func (s *Stub) take(path string, form url.Values) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[path]++
+	s.forms[path] = form
+	for i, f := range s.faults {
+		if f.Path != "" && f.Path != path {
+			continue
+		}
+		cp := *f
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &cp
+	}
+	return nil
+}
+
+// request is a parsed algo call: the uploaded input_image, or the decoded
+// input_image_base64, plus the other form fields.
+type request struct {
+	image []byte
+	form  url.Values
+}
+
+func (q request) int(key string) int {
+	n, _ := strconv.Atoi(q.form.Get(key))
+	return n
+}
+
+// handler computes the JSON fields of a successful answer. Image fields are
+// named image_base64*; BadBase64 corrupts them.
+type handler func(ctx context.Context, q request) (map[string]any, error)
+
+func (s *Stub) endpoint(h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"detail": "Method Not Allowed"})
+			return
+		}
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"detail": "invalid multipart form"})
+			return
+		}
+		q := request{form: url.Values(r.MultipartForm.Value)}
+		f := s.take(r.URL.Path, q.form)
+		if f != nil && f.LatencyMs > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(f.LatencyMs) * time.Millisecond):
+			}
+		}
+		if f != nil && f.Status != 0 {
+			writeJSON(w, f.Status, map[string]any{"status": false, "message": "stub fault " + strconv.Itoa(f.Status)})
+			return
+		}
+		if f != nil && f.Reject != "" {
+			writeJSON(w, http.StatusOK, map[string]any{"status": false, "message": f.Reject})
+			return
+		}
+
+		if file, _, err := r.FormFile("input_image"); err == nil {
+			q.image, err = io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"status": false, "message": "read input_image"})
+				return
+			}
+		} else if b64 := q.form.Get("input_image_base64"); b64 != "" {
+			if q.image, err = algo.DecodeBase64(b64); err != nil {
+				writeJSON(w, http.StatusOK, map[string]any{"status": false, "message": "invalid input_image_base64"})
+				return
+			}
+		} else {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"detail": "input_image or input_image_base64 required"})
+			return
+		}
+
+		out, err := h(r.Context(), q)
+		if err != nil {
+			// The real service reports bad input as 200 with status false.
+			msg := err.Error()
+			var ae *algo.Error
+			if errors.As(err, &ae) && ae.Message != "" {
+				msg = ae.Message
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"status": false, "message": msg})
+			return
+		}
+		for k, v := range out {
+			if str, ok := v.(string); ok && strings.HasPrefix(k, "image_base64") {
+				if f != nil && f.BadBase64 {
+					str = "%%not-base64%%"
+				}
+				out[k] = "data:image/png;base64," + str
+			}
+		}
+		out["status"] = true
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+func (s *Stub) idphoto(ctx context.Context, q request) (map[string]any, error) {
+	var opts algo.IDPhotoOptions
+	opts.HeadMeasureRatio, _ = strconv.ParseFloat(q.form.Get("head_measure_ratio"), 64)
+	opts.TopDistanceMin, _ = strconv.ParseFloat(q.form.Get("top_distance_min"), 64)
+	opts.TopDistanceMax, _ = strconv.ParseFloat(q.form.Get("top_distance_max"), 64)
+	resp, err := s.local.IDPhotoFile(ctx, q.image, "input", q.int("height"), q.int("width"), q.int("dpi"), opts)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{"image_base64_standard": resp.ImageBase64Standard}
+	if q.form.Get("hd") == "true" {
+		out["image_base64_hd"] = resp.ImageBase64HD
+	}
+	return out, nil
+}
+
+func (s *Stub) addBackground(ctx context.Context, q request) (map[string]any, error) {
+	resp, err := s.local.AddBackgroundFile(ctx, q.image, q.form.Get("color"), q.int("render"), q.int("dpi"), q.int("kb"))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"image_base64": resp.ImageBase64}, nil
+}
+
+func (s *Stub) layout(ctx context.Context, q request) (map[string]any, error) {
+	resp, err := s.local.GenerateLayoutPhotosFile(ctx, q.image, q.int("height"), q.int("width"), q.int("dpi"), q.int("kb"))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"image_base64": resp.ImageBase64}, nil
+}
+
+func (s *Stub) detectFaces(ctx context.Context, q request) (map[string]any, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(q.image))
+	if err != nil {
+		return nil, errors.New("decode image: " + err.Error())
+	}
+	s.mu.Lock()
+	faces, scripted := s.faces, s.scripted
+	s.mu.Unlock()
+	if !scripted {
+		w := cfg.Width * 3 / 10
+		faces = []algo.Face{{X: (cfg.Width - w) / 2, Y: cfg.Height / 5, Width: w, Height: w * 13 / 10, Score: 0.99}}
+	}
+	list := make([]map[string]any, 0, len(faces))
+	for _, f := range faces {
+		list = append(list, map[string]any{"x": f.X, "y": f.Y, "width": f.Width, "height": f.Height, "roll": f.Roll, "score": f.Score})
+	}
+	return map[string]any{"faces": list}, nil
+}
+
+func (s *Stub) handleFault(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var f Fault
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"detail": "invalid json"})
+			return
+		}
+		s.Inject(f)
+		writeJSON(w, http.StatusOK, f)
+	case http.MethodDelete:
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"detail": "Method Not Allowed"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,54 @@
+package algostub
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"permit-backend/internal/algo"
+)
+
+func TestStub_FaultEndpoint(t *testing.T) {
+	stub := New()
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	c := algo.NewClient(srv.URL, 5*time.Second, 0, 0)
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+	if _, err := c.AddBackgroundFile(context.Background(), buf.Bytes(), "ffffff", 0, 300, 0); err != nil {
+		t.Fatalf("healthy call: %v", err)
+	}
+
+	resp, err := http.Post(srv.URL+FaultPath, "application/json", strings.NewReader(`{"path":"/add_background","status":503,"times":1}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("script fault: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if _, err := c.AddBackgroundFile(context.Background(), buf.Bytes(), "ffffff", 0, 300, 0); !algo.IsUnavailable(err) {
+		t.Fatalf("scripted 503: %v", err)
+	}
+	if _, err := c.AddBackgroundFile(context.Background(), buf.Bytes(), "ffffff", 0, 300, 0); err != nil {
+		t.Fatalf("fault should be used up: %v", err)
+	}
+	if n := stub.Calls("/add_background"); n != 3 {
+		t.Fatalf("calls = %d", n)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+FaultPath, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reset: %v %v", resp, err)
+	}
+	if n := stub.Calls("/add_background"); n != 0 {
+		t.Fatalf("calls after reset = %d", n)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
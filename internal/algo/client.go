@@ -2,16 +2,17 @@ package algo
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type IDPhotoResp struct {
@@ -30,156 +31,313 @@ type LayoutResp struct {
 	ImageBase64 string
 }
 
-func AddBackgroundFile(baseURL string, rgbaPNG []byte, colorHex string, dpi int) (AddBackgroundResp, error) {
-	var out AddBackgroundResp
-	body := &bytes.Buffer{}
-	w := multipart.NewWriter(body)
-	fw, err := w.CreateFormFile("input_image", "rgba.png")
-	if err != nil {
-		return out, err
+// Face is a detected face box in pixels of the image that was sent, with
+// its in-plane rotation (roll) in degrees, positive clockwise.
+type Face struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+	Roll   float64
+	Score  float64
+}
+
+type FacesResp struct {
+	OK    bool
+	Faces []Face
+}
+
+// ErrNoFaceDetection is returned by processors that cannot detect faces.
+var ErrNoFaceDetection = errors.New("face detection not available")
+
+// IDPhotoOptions carries spec rules forwarded to /idphoto under the
+// service's own names: HeadMeasureRatio is face area ÷ photo area and
+// TopDistanceMin/Max bound the gap above the head as a fraction of the photo
+// height. Zero values leave the algorithm defaults in place.
+type IDPhotoOptions struct {
+	HeadMeasureRatio float64
+	TopDistanceMin   float64
+	TopDistanceMax   float64
+}
+
+// Error is returned when a call to the algo service fails: the service was
+// unreachable (StatusCode 0, Err set), answered with a non-2xx status, or
+// answered 200 with a falsy "status". Message is what the service said.
+type Error struct {
+	Op         string
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.StatusCode == 0:
+		return fmt.Sprintf("algo %s: %v", e.Op, e.Err)
+	case e.Message != "":
+		return fmt.Sprintf("algo %s: status %d: %s", e.Op, e.StatusCode, e.Message)
+	default:
+		return fmt.Sprintf("algo %s: status %d", e.Op, e.StatusCode)
 	}
-	if _, err = fw.Write(rgbaPNG); err != nil {
-		return out, err
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Unavailable reports whether the service could not be reached or failed
+// on its side (5xx), as opposed to rejecting the input.
+func (e *Error) Unavailable() bool {
+	return e.StatusCode == 0 || e.StatusCode >= 500
+}
+
+// IsUnavailable reports whether err is an *Error with Unavailable true.
+func IsUnavailable(err error) bool {
+	var ae *Error
+	return errors.As(err, &ae) && ae.Unavailable()
+}
+
+// Client talks to the algo service. Requests that fail to connect or get a
+// 5xx are retried up to Retries times with exponential backoff starting at
+// Backoff; the request context bounds the whole sequence.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+func NewClient(baseURL string, timeout time.Duration, retries int, backoff time.Duration) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    &http.Client{Timeout: timeout},
+		Retries: retries,
+		Backoff: backoff,
 	}
-	_ = w.WriteField("color", colorHex)
-	_ = w.WriteField("dpi", itoa(dpi))
-	if err := w.Close(); err != nil {
-		return out, err
+}
+
+func (c *Client) IDPhotoFile(ctx context.Context, image []byte, filename string, height, width, dpi int, opts IDPhotoOptions) (IDPhotoResp, error) {
+	var out IDPhotoResp
+	fields := []string{
+		"height", itoa(height),
+		"width", itoa(width),
+		"hd", "true",
+		"dpi", itoa(dpi),
+		"face_alignment", "true",
 	}
-	req, err := http.NewRequest("POST", baseURL+"/add_background", body)
-	if err != nil {
-		return out, err
+	if opts.HeadMeasureRatio > 0 {
+		fields = append(fields, "head_measure_ratio", strconv.FormatFloat(opts.HeadMeasureRatio, 'f', -1, 64))
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return out, err
+	if opts.TopDistanceMin > 0 {
+		fields = append(fields, "top_distance_min", strconv.FormatFloat(opts.TopDistanceMin, 'f', -1, 64))
 	}
-	defer resp.Body.Close()
-	var m map[string]any
-	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+	if opts.TopDistanceMax > 0 {
+		fields = append(fields, "top_distance_max", strconv.FormatFloat(opts.TopDistanceMax, 'f', -1, 64))
+	}
+	m, err := c.post(ctx, "/idphoto", &formFile{field: "input_image", name: filename, data: image}, fields...)
+	if err != nil {
 		return out, err
 	}
-	out.ImageBase64, _ = mString(m["image_base64"])
-	out.OK = parseStatus(m["status"])
+	out.ImageBase64Standard, _ = mString(m["image_base64_standard"])
+	out.ImageBase64HD, _ = mString(m["image_base64_hd"])
+	out.OK = true
 	return out, nil
 }
 
-func IDPhoto(baseURL, imagePath string, height, width, dpi int) (IDPhotoResp, error) {
-	var out IDPhotoResp
-	body := &bytes.Buffer{}
-	w := multipart.NewWriter(body)
-	f, err := os.Open(imagePath)
+// AddBackgroundFile puts rgbaPNG on a colorHex background. kb > 0 asks the
+// service to compress the result to at most kb KB.
+func (c *Client) AddBackgroundFile(ctx context.Context, rgbaPNG []byte, colorHex string, render, dpi, kb int) (AddBackgroundResp, error) {
+	var out AddBackgroundResp
+	m, err := c.post(ctx, "/add_background", &formFile{field: "input_image", name: "rgba.png", data: rgbaPNG},
+		backgroundFields(colorHex, render, dpi, kb)...)
 	if err != nil {
 		return out, err
 	}
-	defer f.Close()
-	fw, err := w.CreateFormFile("input_image", filepath.Base(imagePath))
+	out.ImageBase64, _ = mString(m["image_base64"])
+	out.OK = true
+	return out, nil
+}
+
+func (c *Client) AddBackgroundBase64(ctx context.Context, rgbaBase64, colorHex string, render, dpi, kb int) (AddBackgroundResp, error) {
+	var out AddBackgroundResp
+	m, err := c.post(ctx, "/add_background", nil,
+		append([]string{"input_image_base64", rgbaBase64}, backgroundFields(colorHex, render, dpi, kb)...)...)
 	if err != nil {
 		return out, err
 	}
-	if _, err = io.Copy(fw, f); err != nil {
-		return out, err
+	out.ImageBase64, _ = mString(m["image_base64"])
+	out.OK = true
+	return out, nil
+}
+
+func backgroundFields(colorHex string, render, dpi, kb int) []string {
+	fields := []string{"color", colorHex, "render", itoa(render), "dpi", itoa(dpi)}
+	if kb > 0 {
+		fields = append(fields, "kb", itoa(kb))
 	}
-	_ = w.WriteField("height", itoa(height))
-	_ = w.WriteField("width", itoa(width))
-	_ = w.WriteField("hd", "true")
-	_ = w.WriteField("dpi", itoa(dpi))
-	_ = w.WriteField("face_alignment", "true")
-	if err = w.Close(); err != nil {
-		return out, err
+	return fields
+}
+
+func (c *Client) GenerateLayoutPhotosFile(ctx context.Context, rgbImage []byte, height, width, dpi, kb int) (LayoutResp, error) {
+	var out LayoutResp
+	fields := []string{"height", itoa(height), "width", itoa(width)}
+	if kb > 0 {
+		fields = append(fields, "kb", itoa(kb))
 	}
-	req, err := http.NewRequest("POST", baseURL+"/idphoto", body)
+	fields = append(fields, "dpi", itoa(dpi))
+	m, err := c.post(ctx, "/generate_layout_photos", &formFile{field: "input_image", name: "input.jpg", data: rgbImage}, fields...)
 	if err != nil {
 		return out, err
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	resp, err := http.DefaultClient.Do(req)
+	out.ImageBase64, _ = mString(m["image_base64"])
+	out.OK = true
+	return out, nil
+}
+
+// DetectFaces asks /detect_faces for the faces in image.
+func (c *Client) DetectFaces(ctx context.Context, image []byte) (FacesResp, error) {
+	var out FacesResp
+	m, err := c.post(ctx, "/detect_faces", &formFile{field: "input_image", name: "input.jpg", data: image})
 	if err != nil {
 		return out, err
 	}
-	defer resp.Body.Close()
-	var m map[string]any
-	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return out, err
+	list, _ := m["faces"].([]any)
+	for _, v := range list {
+		f, _ := v.(map[string]any)
+		num := func(k string) float64 { n, _ := f[k].(float64); return n }
+		out.Faces = append(out.Faces, Face{
+			X: int(num("x")), Y: int(num("y")), Width: int(num("width")), Height: int(num("height")),
+			Roll: num("roll"), Score: num("score"),
+		})
 	}
-	out.ImageBase64Standard, _ = mString(m["image_base64_standard"])
-	out.ImageBase64HD, _ = mString(m["image_base64_hd"])
-	out.OK = parseStatus(m["status"])
+	out.OK = true
 	return out, nil
 }
 
-func AddBackgroundBase64(baseURL, rgbaBase64, colorHex string, dpi int) (AddBackgroundResp, error) {
-	var out AddBackgroundResp
-	body := &bytes.Buffer{}
-	w := multipart.NewWriter(body)
-	_ = w.WriteField("input_image_base64", rgbaBase64)
-	_ = w.WriteField("color", colorHex)
-	_ = w.WriteField("dpi", itoa(dpi))
-	if err := w.Close(); err != nil {
-		return out, err
-	}
-	req, err := http.NewRequest("POST", baseURL+"/add_background", body)
+// Ping reports whether the algo service answers at BaseURL. Any HTTP
+// response counts as up; only transport errors are failures. Ping is not
+// retried.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL, nil)
 	if err != nil {
-		return out, err
+		return err
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.HTTP.Do(req)
 	if err != nil {
-		return out, err
-	}
-	defer resp.Body.Close()
-	var m map[string]any
-	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return out, err
+		return &Error{Op: "ping", Err: err}
 	}
-	out.ImageBase64, _ = mString(m["image_base64"])
-	out.OK = parseStatus(m["status"])
-	return out, nil
+	resp.Body.Close()
+	return nil
 }
 
-func GenerateLayoutPhotosFile(baseURL string, rgbImage []byte, height, width, dpi, kb int) (LayoutResp, error) {
-	var out LayoutResp
+type formFile struct {
+	field, name string
+	data        []byte
+}
+
+// post sends a multipart form built from file and name/value pairs in
+// fields, retrying transient failures, and returns the decoded JSON body of
+// a successful answer.
+func (c *Client) post(ctx context.Context, op string, file *formFile, fields ...string) (map[string]any, error) {
 	body := &bytes.Buffer{}
 	w := multipart.NewWriter(body)
-	_, _ = io.WriteString(body, "")
-	fmt.Printf("GenerateLayoutPhotos request: len=%d height=%d width=%d dpi=%d kb=%d\n", len(rgbImage), height, width, dpi, kb)
-	fw, err := w.CreateFormFile("input_image", "input.jpg")
-	if err != nil {
-		return out, err
-	}
-	if _, err = fw.Write(rgbImage); err != nil {
-		return out, err
+	if file != nil {
+		fw, err := w.CreateFormFile(file.field, file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(file.data); err != nil {
+			return nil, err
+		}
 	}
-	_ = w.WriteField("height", itoa(height))
-	_ = w.WriteField("width", itoa(width))
-	if kb > 0 {
-		_ = w.WriteField("kb", itoa(kb))
+	for i := 0; i+1 < len(fields); i += 2 {
+		_ = w.WriteField(fields[i], fields[i+1])
 	}
-	_ = w.WriteField("dpi", itoa(dpi))
 	if err := w.Close(); err != nil {
-		return out, err
+		return nil, err
 	}
-	req, err := http.NewRequest("POST", baseURL+"/generate_layout_photos", body)
+	payload := body.Bytes()
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var m map[string]any
+		m, err = c.do(ctx, op, w.FormDataContentType(), payload)
+		if err == nil {
+			return m, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= c.Retries || !IsUnavailable(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.Backoff << attempt):
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, op, contentType string, payload []byte) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+op, bytes.NewReader(payload))
 	if err != nil {
-		return out, err
+		return nil, err
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.HTTP.Do(req)
 	if err != nil {
-		return out, err
+		return nil, &Error{Op: op, Err: err}
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return out, io.ErrUnexpectedEOF
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &Error{Op: op, Err: err}
 	}
 	var m map[string]any
-	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return out, err
+	jsonErr := json.Unmarshal(raw, &m)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := serviceMessage(m)
+		if msg == "" {
+			msg = truncate(strings.TrimSpace(string(raw)), 200)
+		}
+		return nil, &Error{Op: op, StatusCode: resp.StatusCode, Message: msg}
 	}
-	out.ImageBase64, _ = mString(m["image_base64"])
-	out.OK = parseStatus(m["status"])
-	return out, nil
+	if jsonErr != nil {
+		return nil, &Error{Op: op, StatusCode: resp.StatusCode, Message: "invalid json response"}
+	}
+	if !parseStatus(m["status"]) {
+		msg := serviceMessage(m)
+		if msg == "" {
+			msg = "status false"
+		}
+		return nil, &Error{Op: op, StatusCode: resp.StatusCode, Message: msg}
+	}
+	return m, nil
+}
+
+// serviceMessage extracts the error text the algo service (FastAPI) puts in
+// "message", "msg", "error" or "detail".
+func serviceMessage(m map[string]any) string {
+	for _, k := range []string{"message", "msg", "error", "detail"} {
+		switch v := m[k].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case nil:
+		default:
+			if b, err := json.Marshal(v); err == nil {
+				return string(b)
+			}
+		}
+	}
+	return ""
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
 }
 
 func DecodeBase64(s string) ([]byte, error) {
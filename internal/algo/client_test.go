@@ -0,0 +1,139 @@
+package algo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		if r.URL.Path != "/idphoto" || r.FormValue("height") != "413" || r.FormValue("head_measure_ratio") != "0.35" ||
+			r.FormValue("top_distance_min") != "0.09" || r.FormValue("head_height_ratio") != "" || r.FormValue("kb") != "" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+		}
+		if _, _, err := r.FormFile("input_image"); err != nil {
+			t.Errorf("input_image missing: %v", err)
+		}
+		w.Write([]byte(`{"status":true,"image_base64_standard":"c3Rk","image_base64_hd":"aGQ="}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL+"/", time.Second, 2, time.Millisecond)
+	resp, err := c.IDPhotoFile(context.Background(), []byte("img"), "a.jpg", 413, 295, 300, IDPhotoOptions{HeadMeasureRatio: 0.35, TopDistanceMin: 0.09})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OK || resp.ImageBase64Standard != "c3Rk" || resp.ImageBase64HD != "aGQ=" {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if calls != 3 {
+		t.Fatalf("calls = %d, want 3", calls)
+	}
+}
+
+func TestClient_TypedErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/add_background":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"detail":"color is invalid"}`))
+		case "/generate_layout_photos":
+			w.Write([]byte(`{"status":false,"message":"no face detected"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, time.Second, 3, time.Millisecond)
+	ctx := context.Background()
+
+	_, err := c.AddBackgroundBase64(ctx, "eA==", "zzz", 0, 300, 0)
+	var ae *Error
+	if !errors.As(err, &ae) || ae.StatusCode != http.StatusUnprocessableEntity || ae.Message != "color is invalid" || ae.Unavailable() {
+		t.Fatalf("4xx error = %#v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("4xx retried: calls = %d", calls)
+	}
+
+	calls = 0
+	_, err = c.GenerateLayoutPhotosFile(ctx, []byte("x"), 413, 295, 300, 0)
+	if !errors.As(err, &ae) || ae.StatusCode != http.StatusOK || ae.Message != "no face detected" {
+		t.Fatalf("status false error = %#v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("status false retried: calls = %d", calls)
+	}
+
+	calls = 0
+	_, err = c.AddBackgroundFile(ctx, []byte("x"), "ffffff", 0, 300, 0)
+	if err == nil || calls != 1 {
+		t.Fatalf("wrong route: err=%v calls=%d", err, calls)
+	}
+}
+
+func TestClient_AddBackgroundKB(t *testing.T) {
+	var kb []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseMultipartForm(1 << 20)
+		kb = append(kb, r.FormValue("kb"))
+		w.Write([]byte(`{"status":true,"image_base64":"eA=="}`))
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, time.Second, 0, time.Millisecond)
+	ctx := context.Background()
+	_, _ = c.AddBackgroundFile(ctx, []byte("x"), "ffffff", 0, 300, 40)
+	_, _ = c.AddBackgroundBase64(ctx, "eA==", "ffffff", 0, 300, 40)
+	_, _ = c.AddBackgroundFile(ctx, []byte("x"), "ffffff", 0, 300, 0)
+	if len(kb) != 3 || kb[0] != "40" || kb[1] != "40" || kb[2] != "" {
+		t.Fatalf("kb sent = %q", kb)
+	}
+}
+
+func TestClient_Unreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+	c := NewClient(url, time.Second, 1, time.Millisecond)
+	_, err := c.AddBackgroundFile(context.Background(), []byte("x"), "ffffff", 0, 300, 0)
+	if !IsUnavailable(err) {
+		t.Fatalf("err = %v, want unavailable", err)
+	}
+	if c.Ping(context.Background()) == nil {
+		t.Fatal("ping succeeded against closed server")
+	}
+}
+
+func TestClient_ContextCancelStopsRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, time.Second, 10, 50*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+	_, err := c.AddBackgroundFile(ctx, []byte("x"), "ffffff", 0, 300, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if n := atomic.LoadInt32(&calls); n > 3 {
+		t.Fatalf("kept retrying after deadline: %d calls", n)
+	}
+}
@@ -0,0 +1,152 @@
+package algo
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+)
+
+var ErrPhotoTooLarge = errors.New("photo does not fit on paper")
+
+// TileLayout scales photo to widthPx x heightPx and places copies of it on a
+// white paperW x paperH sheet, turning the sheet if that fits more. copies
+// <= 0 fills the sheet. The result is JPEG, re-encoded at lower quality
+// until it is within kb when kb > 0. It returns the image and the number of
+// copies placed.
+func TileLayout(photo []byte, widthPx, heightPx, paperW, paperH, copies, kb int) ([]byte, int, error) {
+	src, _, err := image.Decode(bytes.NewReader(photo))
+	if err != nil {
+		return nil, 0, err
+	}
+	if widthPx <= 0 || heightPx <= 0 {
+		widthPx, heightPx = src.Bounds().Dx(), src.Bounds().Dy()
+	}
+	gap := min(paperW, paperH) / 60
+	cols, rows := fit(paperW, paperH, widthPx, heightPx, gap)
+	if c2, r2 := fit(paperH, paperW, widthPx, heightPx, gap); c2*r2 > cols*rows {
+		paperW, paperH, cols, rows = paperH, paperW, c2, r2
+	}
+	capacity := cols * rows
+	if capacity == 0 {
+		return nil, 0, ErrPhotoTooLarge
+	}
+	n := capacity
+	if copies > 0 && copies < capacity {
+		n = copies
+	}
+	if n < cols {
+		cols = n
+	}
+	rows = (n + cols - 1) / cols
+
+	sheet := image.NewRGBA(image.Rect(0, 0, paperW, paperH))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	tile := Resize(src, widthPx, heightPx)
+	x0 := (paperW - cols*widthPx - (cols-1)*gap) / 2
+	y0 := (paperH - rows*heightPx - (rows-1)*gap) / 2
+	for i := 0; i < n; i++ {
+		x := x0 + (i%cols)*(widthPx+gap)
+		y := y0 + (i/cols)*(heightPx+gap)
+		draw.Draw(sheet, image.Rect(x, y, x+widthPx, y+heightPx), tile, image.Point{}, draw.Src)
+	}
+	out, err := EncodeJPEG(sheet, kb)
+	return out, n, err
+}
+
+func fit(paperW, paperH, w, h, gap int) (int, int) {
+	cols := (paperW - gap) / (w + gap)
+	rows := (paperH - gap) / (h + gap)
+	if cols < 0 || rows < 0 {
+		return 0, 0
+	}
+	return cols, rows
+}
+
+// Resize scales img to w x h with bilinear sampling.
+func Resize(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if b.Dx() == w && b.Dy() == h {
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+		return dst
+	}
+	sx := float64(b.Dx()) / float64(w)
+	sy := float64(b.Dy()) / float64(h)
+	for y := 0; y < h; y++ {
+		fy := (float64(y)+0.5)*sy - 0.5
+		y1 := int(fy)
+		if fy < 0 {
+			fy, y1 = 0, 0
+		}
+		y2 := min(y1+1, b.Dy()-1)
+		wy := fy - float64(y1)
+		for x := 0; x < w; x++ {
+			fx := (float64(x)+0.5)*sx - 0.5
+			x1 := int(fx)
+			if fx < 0 {
+				fx, x1 = 0, 0
+			}
+			x2 := min(x1+1, b.Dx()-1)
+			wx := fx - float64(x1)
+			var px [4]float64
+			for _, s := range []struct {
+				x, y int
+				w    float64
+			}{
+				{x1, y1, (1 - wx) * (1 - wy)},
+				{x2, y1, wx * (1 - wy)},
+				{x1, y2, (1 - wx) * wy},
+				{x2, y2, wx * wy},
+			} {
+				r, g, bb, a := img.At(b.Min.X+s.x, b.Min.Y+s.y).RGBA()
+				px[0] += float64(r) * s.w
+				px[1] += float64(g) * s.w
+				px[2] += float64(bb) * s.w
+				px[3] += float64(a) * s.w
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(px[0] / 257), uint8(px[1] / 257), uint8(px[2] / 257), uint8(px[3] / 257)})
+		}
+	}
+	return dst
+}
+
+// EncodeJPEG encodes img, stepping quality down from 95 until the result is
+// within kb kilobytes (kb <= 0 means no limit). The smallest attempt is
+// returned if the limit cannot be met.
+func EncodeJPEG(img image.Image, kb int) ([]byte, error) {
+	var buf bytes.Buffer
+	for q := 95; ; q -= 5 {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		if kb <= 0 || buf.Len() <= kb*1024 || q <= 30 {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// PadJPEG grows a JPEG to at least minBytes by inserting comment segments
+// after the SOI marker. Decoders skip comments, so the image is unchanged;
+// it is for specs with a minimum file size that a well-compressed photo
+// would not reach. Anything that is not a JPEG is returned as is.
+func PadJPEG(data []byte, minBytes int) []byte {
+	need := minBytes - len(data)
+	if need <= 0 || len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+	out := make([]byte, 0, minBytes+4)
+	out = append(out, data[:2]...)
+	for need > 0 {
+		// A segment is 4 bytes of marker and length plus up to 65533 bytes.
+		n := max(min(need-4, 65533), 0)
+		out = append(out, 0xFF, 0xFE, byte((n+2)>>8), byte(n+2))
+		out = append(out, make([]byte, n)...)
+		need -= n + 4
+	}
+	return append(out, data[2:]...)
+}
@@ -0,0 +1,66 @@
+package algo
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestTileLayout(t *testing.T) {
+	photo := image.NewRGBA(image.Rect(0, 0, 60, 80))
+	for i := range photo.Pix {
+		photo.Pix[i] = 0x40
+	}
+	var src bytes.Buffer
+	_ = jpeg.Encode(&src, photo, nil)
+
+	// 6-inch at 300dpi is 1205x1795: 3x4 one-inch photos upright, 5x2 turned.
+	out, n, err := TileLayout(src.Bytes(), 295, 413, 1205, 1795, 0, 0)
+	if err != nil || n != 12 {
+		t.Fatalf("fill sheet: n=%d err=%v", n, err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 1205 || b.Dy() != 1795 {
+		t.Fatalf("upright sheet fits more, got %v", b)
+	}
+	if _, n, _ := TileLayout(src.Bytes(), 413, 295, 1205, 1795, 0, 0); n != 12 {
+		t.Fatalf("landscape photos should turn the sheet: %d", n)
+	}
+	if _, n, _ := TileLayout(src.Bytes(), 295, 413, 1205, 1795, 3, 0); n != 3 {
+		t.Fatalf("copies not honoured: %d", n)
+	}
+	if _, _, err := TileLayout(src.Bytes(), 2000, 3000, 1205, 1795, 0, 0); err != ErrPhotoTooLarge {
+		t.Fatalf("oversized photo: want ErrPhotoTooLarge, got %v", err)
+	}
+
+	r, g, b, _ := img.At(img.Bounds().Dx()/2, 2).RGBA()
+	if c := (color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff}); c.R < 0xf000 || c.G < 0xf000 || c.B < 0xf000 {
+		t.Fatalf("sheet margin should be white, got %v", c)
+	}
+}
+
+func TestPadJPEG(t *testing.T) {
+	var src bytes.Buffer
+	_ = jpeg.Encode(&src, image.NewGray(image.Rect(0, 0, 40, 30)), nil)
+	if got := PadJPEG(src.Bytes(), 100); !bytes.Equal(got, src.Bytes()) {
+		t.Fatal("a file already large enough was changed")
+	}
+	for _, min := range []int{src.Len() + 1, src.Len() + 3, 200 << 10} {
+		out := PadJPEG(src.Bytes(), min)
+		if len(out) < min || len(out) > min+4 {
+			t.Fatalf("padded to %d bytes, want %d", len(out), min)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil || img.Bounds().Dx() != 40 || img.Bounds().Dy() != 30 {
+			t.Fatalf("padded file does not decode: %v", err)
+		}
+	}
+	if got := PadJPEG([]byte("not a jpeg"), 100); string(got) != "not a jpeg" {
+		t.Fatal("non-JPEG input was padded")
+	}
+}
@@ -0,0 +1,198 @@
+package algo
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sixInchW x sixInchH (mm) is the sheet /generate_layout_photos fills.
+const sixInchW, sixInchH = 102.0, 152.0
+
+// Local implements the algo calls in process, without face detection or
+// matting, so the pipeline runs offline and in tests. /idphoto centre-crops
+// the upload to the spec aspect ratio and scales it, /add_background fills
+// the transparent parts of an RGBA image with the colour, and
+// /generate_layout_photos tiles a 6-inch sheet. Output depends only on the
+// input. Bad input is reported as an *Error with status 400.
+type Local struct{}
+
+func NewLocal() *Local { return &Local{} }
+
+func (l *Local) IDPhotoFile(ctx context.Context, image []byte, filename string, height, width, dpi int, opts IDPhotoOptions) (IDPhotoResp, error) {
+	var out IDPhotoResp
+	if err := ctx.Err(); err != nil {
+		return out, err
+	}
+	src, err := decodeInput("/idphoto", image)
+	if err != nil {
+		return out, err
+	}
+	crop := cropToAspect(src.Bounds(), width, height)
+	if width <= 0 || height <= 0 {
+		width, height = crop.Dx(), crop.Dy()
+	}
+	std, err := encodePNG(Resize(subImage(src, crop), width, height))
+	if err != nil {
+		return out, err
+	}
+	out.ImageBase64Standard = std
+	out.ImageBase64HD = std
+	if crop.Dx() > width {
+		if out.ImageBase64HD, err = encodePNG(subImage(src, crop)); err != nil {
+			return out, err
+		}
+	}
+	out.OK = true
+	return out, nil
+}
+
+func (l *Local) AddBackgroundFile(ctx context.Context, rgbaPNG []byte, colorHex string, render, dpi, kb int) (AddBackgroundResp, error) {
+	var out AddBackgroundResp
+	if err := ctx.Err(); err != nil {
+		return out, err
+	}
+	src, err := decodeInput("/add_background", rgbaPNG)
+	if err != nil {
+		return out, err
+	}
+	c, ok := parseRGB(colorHex)
+	if !ok {
+		return out, &Error{Op: "/add_background", StatusCode: http.StatusBadRequest, Message: "invalid color " + colorHex}
+	}
+	b := src.Bounds()
+	dst := background(b.Dx(), b.Dy(), c, render)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Over)
+	jpg, err := EncodeJPEG(dst, kb)
+	if err != nil {
+		return out, err
+	}
+	out.ImageBase64 = base64.StdEncoding.EncodeToString(jpg)
+	out.OK = true
+	return out, nil
+}
+
+func (l *Local) AddBackgroundBase64(ctx context.Context, rgbaBase64, colorHex string, render, dpi, kb int) (AddBackgroundResp, error) {
+	data, err := DecodeBase64(rgbaBase64)
+	if err != nil {
+		return AddBackgroundResp{}, &Error{Op: "/add_background", StatusCode: http.StatusBadRequest, Message: "invalid base64 image"}
+	}
+	return l.AddBackgroundFile(ctx, data, colorHex, render, dpi, kb)
+}
+
+func (l *Local) GenerateLayoutPhotosFile(ctx context.Context, rgbImage []byte, height, width, dpi, kb int) (LayoutResp, error) {
+	var out LayoutResp
+	if err := ctx.Err(); err != nil {
+		return out, err
+	}
+	if dpi <= 0 {
+		dpi = 300
+	}
+	px := func(mm float64) int { return int(math.Round(mm / 25.4 * float64(dpi))) }
+	jpg, _, err := TileLayout(rgbImage, width, height, px(sixInchW), px(sixInchH), 0, kb)
+	if err != nil {
+		return out, &Error{Op: "/generate_layout_photos", StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	out.ImageBase64 = base64.StdEncoding.EncodeToString(jpg)
+	out.OK = true
+	return out, nil
+}
+
+// DetectFaces is not implemented locally; it returns ErrNoFaceDetection.
+func (l *Local) DetectFaces(ctx context.Context, image []byte) (FacesResp, error) {
+	return FacesResp{}, ErrNoFaceDetection
+}
+
+// Ping always succeeds; there is nothing to reach.
+func (l *Local) Ping(ctx context.Context) error { return nil }
+
+func decodeInput(op string, data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &Error{Op: op, StatusCode: http.StatusBadRequest, Message: "decode image: " + err.Error()}
+	}
+	return img, nil
+}
+
+// cropToAspect returns the largest centred rectangle in b with the aspect
+// ratio w:h, or b itself when either is unset.
+func cropToAspect(b image.Rectangle, w, h int) image.Rectangle {
+	if w <= 0 || h <= 0 {
+		return b
+	}
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-cw)/2
+	y0 := b.Min.Y + (b.Dy()-ch)/2
+	return image.Rect(x0, y0, x0+cw, y0+ch)
+}
+
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+func encodePNG(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func parseRGB(hex string) (color.RGBA, bool) {
+	hex = strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, false
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, true
+}
+
+// background paints a w x h canvas in c. render follows /add_background:
+// 0 solid, 1 c at the top fading to white at the bottom, 2 white at the
+// centre fading to c at the corners.
+func background(w, h int, c color.RGBA, render int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if render != 1 && render != 2 {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		return dst
+	}
+	mix := func(t float64) color.RGBA {
+		lerp := func(a uint8) uint8 { return uint8(float64(a) + (255-float64(a))*t + 0.5) }
+		return color.RGBA{lerp(c.R), lerp(c.G), lerp(c.B), 0xff}
+	}
+	cx, cy := float64(w)/2, float64(h)/2
+	maxD := math.Hypot(cx, cy)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var t float64
+			if render == 1 {
+				t = float64(y) / float64(max(h-1, 1))
+			} else {
+				t = 1 - math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy)/maxD
+			}
+			dst.SetRGBA(x, y, mix(t))
+		}
+	}
+	return dst
+}
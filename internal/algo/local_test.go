@@ -0,0 +1,129 @@
+package algo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func decodeB64(t *testing.T, s string) image.Image {
+	t.Helper()
+	b, err := DecodeBase64(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestLocal_IDPhotoCropsToSpec(t *testing.T) {
+	// A landscape source with a red middle third: the centre crop to a
+	// portrait spec must keep only red.
+	src := image.NewRGBA(image.Rect(0, 0, 1800, 800))
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 1800; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x >= 600 && x < 1200 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95})
+
+	l := NewLocal()
+	resp, err := l.IDPhotoFile(context.Background(), buf.Bytes(), "a.jpg", 413, 295, 300, IDPhotoOptions{})
+	if err != nil || !resp.OK {
+		t.Fatalf("idphoto: %v", err)
+	}
+	std := decodeB64(t, resp.ImageBase64Standard)
+	if b := std.Bounds(); b.Dx() != 295 || b.Dy() != 413 {
+		t.Fatalf("standard size = %v", b)
+	}
+	for _, x := range []int{2, 147, 292} {
+		if r, _, bl, _ := std.At(x, 200).RGBA(); r < 0xc000 || bl > 0x4000 {
+			t.Fatalf("pixel %d outside centre crop: r=%x b=%x", x, r, bl)
+		}
+	}
+	if hd := decodeB64(t, resp.ImageBase64HD); hd.Bounds().Dy() != 800 {
+		t.Fatalf("hd should keep source resolution, got %v", hd.Bounds())
+	}
+
+	again, _ := l.IDPhotoFile(context.Background(), buf.Bytes(), "a.jpg", 413, 295, 300, IDPhotoOptions{})
+	if again.ImageBase64Standard != resp.ImageBase64Standard {
+		t.Fatal("output is not deterministic")
+	}
+}
+
+func TestLocal_AddBackgroundFillsTransparency(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for y := 10; y < 30; y++ {
+		for x := 10; x < 30; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, src)
+
+	l := NewLocal()
+	resp, err := l.AddBackgroundFile(context.Background(), buf.Bytes(), "438edb", 0, 300, 0)
+	if err != nil || !resp.OK {
+		t.Fatalf("add_background: %v", err)
+	}
+	img := decodeB64(t, resp.ImageBase64)
+	if r, g, b, _ := img.At(2, 2).RGBA(); r>>8 > 0x50 || g>>8 < 0x80 || b>>8 < 0xc8 {
+		t.Fatalf("background = %x %x %x, want ~438edb", r>>8, g>>8, b>>8)
+	}
+	if r, g, b, _ := img.At(20, 20).RGBA(); r>>8 > 0x20 || g>>8 > 0x20 || b>>8 > 0x20 {
+		t.Fatalf("opaque subject changed: %x %x %x", r>>8, g>>8, b>>8)
+	}
+
+	grad, err := l.AddBackgroundFile(context.Background(), buf.Bytes(), "438edb", 1, 300, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img = decodeB64(t, grad.ImageBase64)
+	if top, _, _, _ := img.At(20, 1).RGBA(); top > 0x8000 {
+		t.Fatalf("gradient top should be the colour, r=%x", top)
+	}
+	if bottom, _, _, _ := img.At(20, 38).RGBA(); bottom < 0xe000 {
+		t.Fatalf("gradient bottom should be near white, r=%x", bottom)
+	}
+}
+
+func TestLocal_LayoutAndErrors(t *testing.T) {
+	photo := image.NewRGBA(image.Rect(0, 0, 295, 413))
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, photo, nil)
+
+	l := NewLocal()
+	resp, err := l.GenerateLayoutPhotosFile(context.Background(), buf.Bytes(), 413, 295, 300, 0)
+	if err != nil || !resp.OK {
+		t.Fatalf("layout: %v", err)
+	}
+	if b := decodeB64(t, resp.ImageBase64).Bounds(); b.Dx() != 1205 || b.Dy() != 1795 {
+		t.Fatalf("6-inch sheet at 300dpi = %v", b)
+	}
+
+	var ae *Error
+	if _, err := l.IDPhotoFile(context.Background(), []byte("not an image"), "a.jpg", 413, 295, 300, IDPhotoOptions{}); !errors.As(err, &ae) || ae.StatusCode != 400 || IsUnavailable(err) {
+		t.Fatalf("bad image: %v", err)
+	}
+	if _, err := l.AddBackgroundFile(context.Background(), buf.Bytes(), "blue", 0, 300, 0); !errors.As(err, &ae) || ae.StatusCode != 400 {
+		t.Fatalf("bad colour: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.GenerateLayoutPhotosFile(ctx, buf.Bytes(), 413, 295, 300, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled context: %v", err)
+	}
+}
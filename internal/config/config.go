@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"time"
 )
 
 type Config struct {
@@ -10,15 +11,67 @@ type Config struct {
 	Port       int
 	AssetsDir  string
 	UploadsDir string
+	PrivateDir string
 	JWTSecret  string
 	LogJSON    bool
 	AlgoURL    string
+	AlgoMode string
+	// AlgoFaceDetect says the algo service offers /detect_faces, which the
+	// upstream service does not; without it the upload pre-check skips
+	// its face rules.
+	AlgoFaceDetect bool
+	AlgoTimeout time.Duration
+	AlgoRetries int
+	AlgoRetryBackoff time.Duration
+	AlgoMaxConcurrent int
+	AlgoAcquireTimeout time.Duration
+	AlgoBreakerThreshold int
+	AlgoBreakerCooldown time.Duration
 	PayMock    bool
 	WechatAppID string
 	WechatSecret string
 	WechatMchID string
 	WechatNotifyURL string
+	WechatRefundNotifyURL string
+	WechatMchSerialNo string
+	WechatMchKeyPath string
+	WechatPayBaseURL string
+	WechatAPIv3Key string `json:"-"`
+	WechatPlatformCertPath string
+	Storage string
 	PostgresDSN string
+	DBPingRetries int
+	DBPingInterval time.Duration
+	DBAutoMigrate bool
+	TaskWorkers int
+	TaskQueueSize int
+	PricingFile string
+	DownloadTTL time.Duration
+	PreviewTTL time.Duration
+	AssetSignKey string `json:"-"`
+	AdminToken string `json:"-"`
+	ObjectStore string
+	S3Endpoint string
+	S3Region string
+	S3Bucket string
+	S3AccessKey string
+	S3SecretKey string `json:"-"`
+	S3PathStyle bool
+	S3PresignRedirect bool
+	HTTPReadTimeout time.Duration
+	HTTPReadHeaderTimeout time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout time.Duration
+	ShutdownTimeout time.Duration
+	UploadMaxDimension int
+	UploadMaxPixels int
+	UploadMinDimension int
+	ImageConvertCmd string
+	ImageConvertTimeout time.Duration
+	ImageConvertMaxBytes int64
+	UploadMaxBytes int64
+	UploadChunkBytes int64
+	UploadSessionTTL time.Duration
 }
 
 func Default() Config {
@@ -27,15 +80,59 @@ func Default() Config {
 		Port:       5000,
 		AssetsDir:  "./assets",
 		UploadsDir: "./uploads",
+		PrivateDir: "./private",
 		JWTSecret:  "",
 		LogJSON:    true,
 		AlgoURL:    "http://127.0.0.1:8080",
+		AlgoMode: "http",
+		AlgoFaceDetect: false,
+		AlgoTimeout: 60 * time.Second,
+		AlgoRetries: 2,
+		AlgoRetryBackoff: 200 * time.Millisecond,
+		AlgoMaxConcurrent: 8,
+		AlgoAcquireTimeout: 5 * time.Second,
+		AlgoBreakerThreshold: 5,
+		AlgoBreakerCooldown: 30 * time.Second,
 		PayMock:    true,
 		WechatAppID: "",
 		WechatSecret: "",
 		WechatMchID: "",
 		WechatNotifyURL: "",
+		WechatRefundNotifyURL: "",
+		WechatMchSerialNo: "",
+		WechatMchKeyPath: "",
+		WechatPayBaseURL: "https://api.mch.weixin.qq.com",
+		WechatAPIv3Key: "",
+		WechatPlatformCertPath: "",
+		Storage: "memory",
 		PostgresDSN: "",
+		DBPingRetries: 5,
+		DBPingInterval: 2 * time.Second,
+		DBAutoMigrate: true,
+		TaskWorkers: 4,
+		TaskQueueSize: 64,
+		PricingFile: "",
+		DownloadTTL: 600 * time.Second,
+		PreviewTTL: time.Hour,
+		AssetSignKey: "",
+		ObjectStore: "fs",
+		S3Region: "us-east-1",
+		S3PathStyle: true,
+		HTTPReadTimeout: 30 * time.Second,
+		HTTPReadHeaderTimeout: 5 * time.Second,
+		// Above AlgoAcquireTimeout + AlgoTimeout x (AlgoRetries+1) plus
+		// backoff, so a synchronous algorithm call can still be answered.
+		HTTPWriteTimeout: 200 * time.Second,
+		HTTPIdleTimeout: 120 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		UploadMaxDimension: 4096,
+		UploadMaxPixels: 50000000,
+		UploadMinDimension: 200,
+		ImageConvertTimeout: 30 * time.Second,
+		ImageConvertMaxBytes: 100 << 20,
+		UploadMaxBytes: 30 << 20,
+		UploadChunkBytes: 1 << 20,
+		UploadSessionTTL: 24 * time.Hour,
 	}
 }
 
@@ -58,6 +155,9 @@ func fromEnv(c Config) Config {
 	if v := os.Getenv("PERMIT_UPLOADS_DIR"); v != "" {
 		c.UploadsDir = v
 	}
+	if v := os.Getenv("PERMIT_PRIVATE_DIR"); v != "" {
+		c.PrivateDir = v
+	}
 	if v := os.Getenv("PERMIT_JWT_SECRET"); v != "" {
 		c.JWTSecret = v
 	}
@@ -72,6 +172,52 @@ func fromEnv(c Config) Config {
 	if v := os.Getenv("PERMIT_ALGO_URL"); v != "" {
 		c.AlgoURL = v
 	}
+	if v := os.Getenv("PERMIT_ALGO_MODE"); v != "" {
+		c.AlgoMode = v
+	}
+	if v := os.Getenv("PERMIT_ALGO_FACE_DETECT"); v != "" {
+		switch v {
+		case "1", "true", "TRUE":
+			c.AlgoFaceDetect = true
+		case "0", "false", "FALSE":
+			c.AlgoFaceDetect = false
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.AlgoTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.AlgoRetries = n
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_RETRY_BACKOFF_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.AlgoRetryBackoff = time.Duration(n) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_MAX_CONCURRENT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.AlgoMaxConcurrent = n
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_ACQUIRE_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.AlgoAcquireTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_BREAKER_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.AlgoBreakerThreshold = n
+		}
+	}
+	if v := os.Getenv("PERMIT_ALGO_BREAKER_COOLDOWN"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.AlgoBreakerCooldown = time.Duration(n) * time.Second
+		}
+	}
 	if v := os.Getenv("PERMIT_PAY_MOCK"); v != "" {
 		switch v {
 		case "1", "true", "TRUE":
@@ -92,8 +238,181 @@ func fromEnv(c Config) Config {
 	if v := os.Getenv("PERMIT_WECHAT_NOTIFY_URL"); v != "" {
 		c.WechatNotifyURL = v
 	}
+	if v := os.Getenv("PERMIT_WECHAT_REFUND_NOTIFY_URL"); v != "" {
+		c.WechatRefundNotifyURL = v
+	}
+	if v := os.Getenv("PERMIT_WECHAT_MCH_SERIAL_NO"); v != "" {
+		c.WechatMchSerialNo = v
+	}
+	if v := os.Getenv("PERMIT_WECHAT_MCH_KEY_PATH"); v != "" {
+		c.WechatMchKeyPath = v
+	}
+	if v := os.Getenv("PERMIT_WECHAT_PAY_BASE_URL"); v != "" {
+		c.WechatPayBaseURL = v
+	}
+	if v := os.Getenv("PERMIT_WECHAT_APIV3_KEY"); v != "" {
+		c.WechatAPIv3Key = v
+	}
+	if v := os.Getenv("PERMIT_WECHAT_PLATFORM_CERT_PATH"); v != "" {
+		c.WechatPlatformCertPath = v
+	}
 	if v := os.Getenv("POSTGRES_DSN"); v != "" {
 		c.PostgresDSN = v
 	}
+	// Without an explicit mode a configured DSN selects postgres.
+	if v := os.Getenv("PERMIT_STORAGE"); v != "" {
+		c.Storage = v
+	} else if c.PostgresDSN != "" {
+		c.Storage = "postgres"
+	}
+	if v := os.Getenv("PERMIT_DB_PING_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.DBPingRetries = n
+		}
+	}
+	if v := os.Getenv("PERMIT_DB_PING_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.DBPingInterval = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_DB_AUTO_MIGRATE"); v != "" {
+		switch v {
+		case "1", "true", "TRUE":
+			c.DBAutoMigrate = true
+		case "0", "false", "FALSE":
+			c.DBAutoMigrate = false
+		}
+	}
+	if v := os.Getenv("PERMIT_TASK_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.TaskWorkers = n
+		}
+	}
+	if v := os.Getenv("PERMIT_TASK_QUEUE_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.TaskQueueSize = n
+		}
+	}
+	if v := os.Getenv("PERMIT_PRICING_FILE"); v != "" {
+		c.PricingFile = v
+	}
+	if v := os.Getenv("PERMIT_DOWNLOAD_TTL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.DownloadTTL = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_PREVIEW_TTL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.PreviewTTL = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_ASSET_SIGN_KEY"); v != "" {
+		c.AssetSignKey = v
+	}
+	if v := os.Getenv("PERMIT_ADMIN_TOKEN"); v != "" {
+		c.AdminToken = v
+	}
+	if v := os.Getenv("PERMIT_OBJECT_STORE"); v != "" {
+		c.ObjectStore = v
+	}
+	if v := os.Getenv("PERMIT_S3_ENDPOINT"); v != "" {
+		c.S3Endpoint = v
+	}
+	if v := os.Getenv("PERMIT_S3_REGION"); v != "" {
+		c.S3Region = v
+	}
+	if v := os.Getenv("PERMIT_S3_BUCKET"); v != "" {
+		c.S3Bucket = v
+	}
+	if v := os.Getenv("PERMIT_S3_ACCESS_KEY"); v != "" {
+		c.S3AccessKey = v
+	}
+	if v := os.Getenv("PERMIT_S3_SECRET_KEY"); v != "" {
+		c.S3SecretKey = v
+	}
+	if v := os.Getenv("PERMIT_S3_PATH_STYLE"); v != "" {
+		switch v {
+		case "1", "true", "TRUE":
+			c.S3PathStyle = true
+		case "0", "false", "FALSE":
+			c.S3PathStyle = false
+		}
+	}
+	if v := os.Getenv("PERMIT_S3_PRESIGN_REDIRECT"); v != "" {
+		switch v {
+		case "1", "true", "TRUE":
+			c.S3PresignRedirect = true
+		case "0", "false", "FALSE":
+			c.S3PresignRedirect = false
+		}
+	}
+	if v := os.Getenv("PERMIT_HTTP_READ_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.HTTPReadTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_HTTP_READ_HEADER_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.HTTPReadHeaderTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_HTTP_WRITE_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.HTTPWriteTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_HTTP_IDLE_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.HTTPIdleTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_SHUTDOWN_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.ShutdownTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_UPLOAD_MAX_DIMENSION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.UploadMaxDimension = n
+		}
+	}
+	if v := os.Getenv("PERMIT_UPLOAD_MAX_PIXELS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.UploadMaxPixels = n
+		}
+	}
+	if v := os.Getenv("PERMIT_UPLOAD_MIN_DIMENSION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.UploadMinDimension = n
+		}
+	}
+	if v := os.Getenv("PERMIT_IMAGE_CONVERT_CMD"); v != "" {
+		c.ImageConvertCmd = v
+	}
+	if v := os.Getenv("PERMIT_IMAGE_CONVERT_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.ImageConvertTimeout = time.Duration(n) * time.Second
+		}
+	}
+	if v := os.Getenv("PERMIT_IMAGE_CONVERT_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			c.ImageConvertMaxBytes = n
+		}
+	}
+	if v := os.Getenv("PERMIT_UPLOAD_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			c.UploadMaxBytes = n
+		}
+	}
+	if v := os.Getenv("PERMIT_UPLOAD_CHUNK_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			c.UploadChunkBytes = n
+		}
+	}
+	if v := os.Getenv("PERMIT_UPLOAD_SESSION_TTL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.UploadSessionTTL = time.Duration(n) * time.Second
+		}
+	}
 	return c
 }
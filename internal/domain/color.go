@@ -0,0 +1,58 @@
+package domain
+
+import "strings"
+
+const (
+	GradientLinear = "linear" // top to bottom
+	GradientRadial = "radial" // centre outwards
+)
+
+type Gradient struct {
+	Mode  string   `json:"mode"`
+	Stops []string `json:"stops"`
+}
+
+// Color is a named background. Hex is the solid colour, or the first stop
+// when Gradient is set. Custom colours requested as "#rrggbb" have Name
+// equal to the normalised hex.
+type Color struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+	Hex         string    `json:"hex"`
+	Gradient    *Gradient `json:"gradient,omitempty"`
+}
+
+// Render is the /add_background render mode: 0 solid, 1 top-down
+// gradient, 2 centre gradient. Gradients always run from Hex to white.
+func (c Color) Render() int {
+	if c.Gradient == nil {
+		return 0
+	}
+	if c.Gradient.Mode == GradientRadial {
+		return 2
+	}
+	return 1
+}
+
+// FileKey is a URL- and filesystem-safe stem for files rendered in c.
+func (c Color) FileKey() string {
+	if strings.HasPrefix(c.Name, "#") {
+		return "hex_" + c.Name[1:]
+	}
+	return strings.ToLower(c.Name)
+}
+
+// ParseHex accepts "#rrggbb" or "rrggbb" and returns lower-case "rrggbb".
+func ParseHex(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "#"))
+	if len(s) != 6 {
+		return "", false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return "", false
+		}
+	}
+	return s, true
+}
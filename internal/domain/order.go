@@ -12,6 +12,36 @@ const (
 	OrderRefunded OrderStatus = "refunded"
 )
 
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderCreated:  {OrderPending, OrderPaid, OrderCanceled},
+	OrderPending:  {OrderPaid, OrderCanceled},
+	OrderPaid:     {OrderRefunded},
+	OrderCanceled: {},
+	OrderRefunded: {},
+}
+
+func (s OrderStatus) Valid() bool {
+	_, ok := orderTransitions[s]
+	return ok
+}
+
+func (s OrderStatus) CanTransitionTo(to OrderStatus) bool {
+	for _, t := range orderTransitions[s] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+type OrderTransition struct {
+	OrderID string      `json:"orderId"`
+	From    OrderStatus `json:"from"`
+	To      OrderStatus `json:"to"`
+	Actor   string      `json:"actor"`
+	At      time.Time   `json:"at"`
+}
+
 type OrderItem struct {
 	Type string `json:"type"`
 	Qty  int    `json:"qty"`
@@ -19,13 +49,16 @@ type OrderItem struct {
 
 type Order struct {
 	OrderID           string      `json:"orderId"`
+	UserID            string      `json:"userId"`
 	TaskID            string      `json:"taskId"`
 	Items             []OrderItem `json:"items"`
 	City              string      `json:"city"`
 	Remark            string      `json:"remark"`
 	AmountCents       int         `json:"amountCents"`
+	RefundedCents     int         `json:"refundedCents"`
 	Channel           string      `json:"channel"`
 	Status            OrderStatus `json:"status"`
+	TransactionID     string      `json:"transactionId,omitempty"`
 	PayIdempotencyKey string      `json:"-"`
 	PayParams         string      `json:"-"`
 	CreatedAt         time.Time   `json:"createdAt"`
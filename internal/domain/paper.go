@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	PaperCustom = "custom"
+
+	minPaperMM = 50
+	maxPaperMM = 420
+)
+
+// Paper is a print sheet for layout photos, in millimetres (portrait).
+type Paper struct {
+	Name     string  `json:"name"`
+	WidthMM  float64 `json:"widthMm"`
+	HeightMM float64 `json:"heightMm"`
+}
+
+var papers = map[string]Paper{
+	"5inch": {Name: "5inch", WidthMM: 89, HeightMM: 127},
+	"6inch": {Name: "6inch", WidthMM: 102, HeightMM: 152},
+	"a4":    {Name: "a4", WidthMM: 210, HeightMM: 297},
+}
+
+// LookupPaper resolves a named paper; "custom" takes its size from
+// widthMM/heightMM. An empty name means 6inch.
+func LookupPaper(name string, widthMM, heightMM float64) (Paper, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = "6inch"
+	}
+	if name != PaperCustom {
+		p, ok := papers[name]
+		return p, ok
+	}
+	if widthMM < minPaperMM || heightMM < minPaperMM || widthMM > maxPaperMM || heightMM > maxPaperMM {
+		return Paper{}, false
+	}
+	return Paper{Name: PaperCustom, WidthMM: widthMM, HeightMM: heightMM}, true
+}
+
+// Key identifies the paper in cache keys and file names.
+func (p Paper) Key() string {
+	if p.Name == PaperCustom {
+		return fmt.Sprintf("custom%gx%g", p.WidthMM, p.HeightMM)
+	}
+	return p.Name
+}
+
+// Pixels returns the sheet size at dpi.
+func (p Paper) Pixels(dpi int) (int, int) {
+	px := func(mm float64) int { return int(math.Round(mm / 25.4 * float64(dpi))) }
+	return px(p.WidthMM), px(p.HeightMM)
+}
@@ -0,0 +1,16 @@
+package domain
+
+type PriceItem struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	UnitCents int    `json:"unitCents"`
+	MinQty    int    `json:"minQty"`
+	MaxQty    int    `json:"maxQty"`
+	Shipping  bool   `json:"shipping"`
+}
+
+type PriceCatalog struct {
+	Items                []PriceItem    `json:"items"`
+	DefaultShippingCents int            `json:"defaultShippingCents"`
+	CityShippingCents    map[string]int `json:"cityShippingCents"`
+}
@@ -0,0 +1,23 @@
+package domain
+
+import "time"
+
+type RefundStatus string
+
+const (
+	RefundProcessing RefundStatus = "processing"
+	RefundSuccess    RefundStatus = "success"
+	RefundClosed     RefundStatus = "closed"
+	RefundAbnormal   RefundStatus = "abnormal"
+)
+
+type Refund struct {
+	RefundID         string       `json:"refundId"`
+	OrderID          string       `json:"orderId"`
+	AmountCents      int          `json:"amountCents"`
+	Reason           string       `json:"reason"`
+	Status           RefundStatus `json:"status"`
+	ProviderRefundID string       `json:"providerRefundId,omitempty"`
+	CreatedAt        time.Time    `json:"createdAt"`
+	UpdatedAt        time.Time    `json:"updatedAt"`
+}
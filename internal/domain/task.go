@@ -11,34 +11,74 @@ const (
 	StatusFailed     Status = "failed"
 )
 
+// TaskSpec is the spec captured on a task when it is created, so later
+// catalog edits do not change how an existing task is rendered.
 type TaskSpec struct {
-	Code     string `json:"code"`
-	WidthPx  int    `json:"widthPx"`
-	HeightPx int    `json:"heightPx"`
-	DPI      int    `json:"dpi"`
+	Code            string  `json:"code"`
+	WidthPx         int     `json:"widthPx"`
+	HeightPx        int     `json:"heightPx"`
+	DPI             int     `json:"dpi"`
+	WidthMM         int     `json:"widthMm,omitempty"`
+	HeightMM        int     `json:"heightMm,omitempty"`
+	MinKB           int     `json:"minKb,omitempty"`
+	MaxKB           int     `json:"maxKb,omitempty"`
+	HeadHeightRatio float64 `json:"headHeightRatio,omitempty"`
+	TopMarginRatio  float64 `json:"topMarginRatio,omitempty"`
+	// AllowCustomColor accepts "#rrggbb" backgrounds besides registry names.
+	AllowCustomColor bool `json:"allowCustomColor,omitempty"`
 }
 
+// SpecDef is a catalog entry. Physical size is in millimetres; KB limits,
+// head height (head / photo height) and top margin (gap above the head /
+// photo height) are zero when the document does not constrain them.
 type SpecDef struct {
-	Code     string   `json:"code"`
-	Name     string   `json:"name"`
-	WidthPx  int      `json:"widthPx"`
-	HeightPx int      `json:"heightPx"`
-	DPI      int      `json:"dpi"`
-	BgColors []string `json:"bgColors"`
+	Code             string   `json:"code"`
+	Name             string   `json:"name"`
+	WidthPx          int      `json:"widthPx"`
+	HeightPx         int      `json:"heightPx"`
+	DPI              int      `json:"dpi"`
+	WidthMM          int      `json:"widthMm,omitempty"`
+	HeightMM         int      `json:"heightMm,omitempty"`
+	MinKB            int      `json:"minKb,omitempty"`
+	MaxKB            int      `json:"maxKb,omitempty"`
+	HeadHeightRatio  float64  `json:"headHeightRatio,omitempty"`
+	TopMarginRatio   float64  `json:"topMarginRatio,omitempty"`
+	Formats          []string `json:"formats,omitempty"`
+	BgColors         []string `json:"bgColors"`
+	AllowCustomColor bool     `json:"allowCustomColor,omitempty"`
+	Disabled         bool     `json:"disabled,omitempty"`
+}
+
+// TaskSpec returns the parts of d that drive processing.
+func (d SpecDef) TaskSpec() TaskSpec {
+	return TaskSpec{
+		Code:             d.Code,
+		WidthPx:          d.WidthPx,
+		HeightPx:         d.HeightPx,
+		DPI:              d.DPI,
+		WidthMM:          d.WidthMM,
+		HeightMM:         d.HeightMM,
+		MinKB:            d.MinKB,
+		MaxKB:            d.MaxKB,
+		HeadHeightRatio:  d.HeadHeightRatio,
+		TopMarginRatio:   d.TopMarginRatio,
+		AllowCustomColor: d.AllowCustomColor,
+	}
 }
 
 type Task struct {
-	ID              string            `json:"id"`
-	UserID          string            `json:"userId,omitempty"`
-	SpecCode        string            `json:"specCode"`
-	Spec            TaskSpec          `json:"spec"`
-	SourceObjectKey string            `json:"sourceObjectKey"`
-	Status          Status            `json:"status"`
-	BaselineUrl     string            `json:"baselineUrl,omitempty"`
-	AvailableColors []string          `json:"availableColors,omitempty"`
-	ProcessedUrls   map[string]string `json:"processedUrls"`
-	LayoutUrls      map[string]string `json:"layoutUrls,omitempty"`
-	ErrorMsg        string            `json:"errorMsg,omitempty"`
-	CreatedAt       time.Time         `json:"createdAt"`
-	UpdatedAt       time.Time         `json:"updatedAt"`
+	ID                string            `json:"id"`
+	UserID            string            `json:"userId,omitempty"`
+	SpecCode          string            `json:"specCode"`
+	Spec              TaskSpec          `json:"spec"`
+	SourceObjectKey   string            `json:"sourceObjectKey"`
+	Status            Status            `json:"status"`
+	DefaultBackground string            `json:"defaultBackground,omitempty"`
+	BaselineUrl       string            `json:"baselineUrl,omitempty"`
+	AvailableColors   []string          `json:"availableColors,omitempty"`
+	ProcessedUrls     map[string]string `json:"processedUrls"`
+	LayoutUrls        map[string]string `json:"layoutUrls,omitempty"`
+	ErrorMsg          string            `json:"errorMsg,omitempty"`
+	CreatedAt         time.Time         `json:"createdAt"`
+	UpdatedAt         time.Time         `json:"updatedAt"`
 }
@@ -0,0 +1,39 @@
+package domain
+
+import "time"
+
+type UploadStatus string
+
+const (
+	UploadOpen      UploadStatus = "open"
+	UploadCompleted UploadStatus = "completed"
+)
+
+// UploadPart is one received chunk, stored as its own object until the
+// session completes.
+type UploadPart struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Key    string `json:"key"`
+}
+
+// UploadSession is a resumable upload of one file in chunks. Received is
+// the number of bytes accepted so far, which is also the offset of the next
+// chunk. ObjectKey, Width and Height are set once the session completes.
+type UploadSession struct {
+	ID        string       `json:"id"`
+	UserID    string       `json:"userId"`
+	Filename  string       `json:"filename"`
+	Size      int64        `json:"size"`
+	SHA256    string       `json:"sha256"`
+	Received  int64        `json:"received"`
+	Parts     []UploadPart `json:"parts,omitempty"`
+	Status    UploadStatus `json:"status"`
+	ObjectKey string       `json:"objectKey,omitempty"`
+	Width     int          `json:"width,omitempty"`
+	Height    int          `json:"height,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
@@ -0,0 +1,40 @@
+package asset
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"permit-backend/internal/storage"
+)
+
+// ServeObject streams an object with an explicit Content-Type and ETag.
+// Range and conditional requests are handled by http.ServeContent; bodies
+// that cannot seek are buffered first.
+func ServeObject(w http.ResponseWriter, r *http.Request, rc io.ReadCloser, info storage.ObjectInfo) error {
+	defer rc.Close()
+	rs, ok := rc.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		rs = bytes.NewReader(b)
+	}
+	ct := info.ContentType
+	if ct == "" {
+		ct = mime.TypeByExtension(path.Ext(info.Key))
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.ServeContent(w, r, path.Base(info.Key), info.ModTime, rs)
+	return nil
+}
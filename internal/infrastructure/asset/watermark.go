@@ -0,0 +1,97 @@
+package asset
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+)
+
+var glyphs = map[rune][7]string{
+	'P': {"11110", "10001", "10001", "11110", "10000", "10000", "10000"},
+	'R': {"11110", "10001", "10001", "11110", "10100", "10010", "10001"},
+	'E': {"11111", "10000", "10000", "11110", "10000", "10000", "11111"},
+	'V': {"10001", "10001", "10001", "10001", "10001", "01010", "00100"},
+	'I': {"01110", "00100", "00100", "00100", "00100", "00100", "01110"},
+	'W': {"10001", "10001", "10001", "10101", "10101", "10101", "01010"},
+}
+
+const watermarkText = "PREVIEW"
+
+func Watermark(data []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	step := max(w, h) / 6
+	if step < 24 {
+		step = 24
+	}
+	band := step / 8
+	if band < 2 {
+		band = 2
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x+y)%step < band {
+				blend(dst, b.Min.X+x, b.Min.Y+y, color.RGBA{255, 255, 255, 255}, 96)
+			}
+		}
+	}
+
+	scale := w / 80
+	if scale < 1 {
+		scale = 1
+	}
+	textW := len(watermarkText) * 6 * scale
+	textH := 7 * scale
+	for ty := textH; ty < h; ty += textH * 5 {
+		offset := (ty / (textH * 5) % 2) * textW / 2
+		for tx := -offset; tx < w; tx += textW + 4*scale {
+			drawText(dst, b.Min.X+tx, b.Min.Y+ty, scale)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func drawText(dst *image.RGBA, x0, y0, scale int) {
+	for i, r := range watermarkText {
+		g := glyphs[r]
+		gx := x0 + i*6*scale
+		for row, line := range g {
+			for col, c := range line {
+				if c != '1' {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						blend(dst, gx+col*scale+dx, y0+row*scale+dy, color.RGBA{128, 128, 128, 255}, 140)
+					}
+				}
+			}
+		}
+	}
+}
+
+func blend(dst *image.RGBA, x, y int, c color.RGBA, alpha uint32) {
+	if !(image.Point{X: x, Y: y}).In(dst.Rect) {
+		return
+	}
+	i := dst.PixOffset(x, y)
+	p := dst.Pix[i : i+3 : i+3]
+	p[0] = uint8((uint32(p[0])*(255-alpha) + uint32(c.R)*alpha) / 255)
+	p[1] = uint8((uint32(p[1])*(255-alpha) + uint32(c.G)*alpha) / 255)
+	p[2] = uint8((uint32(p[2])*(255-alpha) + uint32(c.B)*alpha) / 255)
+}
@@ -1,38 +1,55 @@
 package asset
 
 import (
-	"os"
-	"path/filepath"
+	"bytes"
+	"context"
+	"mime"
+	"path"
+
+	"permit-backend/internal/storage"
 )
 
-type FSWriter struct {
-	AssetsDir string
+// Store keeps full-quality originals private and publishes watermarked
+// previews. Both sides are keyed "<taskID>/<filename>".
+type Store struct {
+	Previews  storage.Storage
+	Originals storage.Storage
+}
+
+func NewStore(previews, originals storage.Storage) *Store {
+	return &Store{Previews: previews, Originals: originals}
 }
 
-func NewFSWriter(assetsDir string) *FSWriter {
-	return &FSWriter{AssetsDir: assetsDir}
+func (s *Store) Write(taskID, color string, data []byte) (string, error) {
+	return s.WriteFile(taskID, color+".jpg", data)
 }
 
-func (w *FSWriter) Write(taskID, color string, data []byte) (string, error) {
-	dir := filepath.Join(w.AssetsDir, taskID)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+func (s *Store) WriteFile(taskID, filename string, data []byte) (string, error) {
+	if _, err := s.WritePrivate(taskID, filename, data); err != nil {
 		return "", err
 	}
-	out := filepath.Join(dir, color+".jpg")
-	if err := os.WriteFile(out, data, 0o644); err != nil {
+	preview, err := Watermark(data)
+	if err != nil {
 		return "", err
 	}
-	return "/assets/" + taskID + "/" + color + ".jpg", nil
-}
-
-func (w *FSWriter) WriteFile(taskID, filename string, data []byte) (string, error) {
-	dir := filepath.Join(w.AssetsDir, taskID)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+	if err := put(s.Previews, taskID+"/"+filename, preview); err != nil {
 		return "", err
 	}
-	out := filepath.Join(dir, filename)
-	if err := os.WriteFile(out, data, 0o644); err != nil {
+	return "/assets/" + taskID + "/" + filename, nil
+}
+
+func (s *Store) WritePrivate(taskID, filename string, data []byte) (string, error) {
+	key := taskID + "/" + filename
+	if err := put(s.Originals, key, data); err != nil {
 		return "", err
 	}
-	return "/assets/" + taskID + "/" + filename, nil
+	return key, nil
+}
+
+func (s *Store) Read(taskID, filename string) ([]byte, error) {
+	return storage.ReadAll(context.Background(), s.Originals, taskID+"/"+filename)
+}
+
+func put(st storage.Storage, key string, data []byte) error {
+	return st.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), mime.TypeByExtension(path.Ext(key)))
 }
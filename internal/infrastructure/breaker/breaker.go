@@ -0,0 +1,208 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOpen = errors.New("circuit open")
+	ErrBusy = errors.New("concurrency limit reached")
+)
+
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case HalfOpen:
+		return "half_open"
+	case Open:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// Stats is a snapshot for metrics.
+type Stats struct {
+	State               State
+	ConsecutiveFailures int
+	Opened              uint64
+	Succeeded           uint64
+	Failed              uint64
+	Rejected            uint64
+	InFlight            int
+	MaxConcurrent       int
+}
+
+// Breaker opens after Threshold consecutive failures and rejects calls for
+// Cooldown. It then lets a single probe through (half-open): success closes
+// it, failure opens it again. A semaphore bounds concurrent calls; callers
+// wait for a slot at most AcquireTimeout.
+type Breaker struct {
+	threshold      int
+	cooldown       time.Duration
+	acquireTimeout time.Duration
+	slots          chan struct{}
+	now            func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+	opened   uint64
+	ok       uint64
+	failed   uint64
+	rejected uint64
+}
+
+func New(threshold int, cooldown time.Duration, maxConcurrent int, acquireTimeout time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Breaker{
+		threshold:      threshold,
+		cooldown:       cooldown,
+		acquireTimeout: acquireTimeout,
+		slots:          make(chan struct{}, maxConcurrent),
+		now:            time.Now,
+	}
+}
+
+// Do runs fn if the breaker and the concurrency limit allow it. isFailure
+// decides which errors count against the service; others (bad input, the
+// caller going away) leave the breaker alone. Rejections return ErrOpen or
+// ErrBusy without calling fn.
+func (b *Breaker) Do(ctx context.Context, fn func() error, isFailure func(error) bool) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	if err := b.acquire(ctx); err != nil {
+		b.release(probe)
+		return err
+	}
+	err = fn()
+	<-b.slots
+	b.record(probe, err != nil && isFailure(err))
+	return err
+}
+
+// Allow reports whether a call would currently be let through, without
+// reserving anything. Callers use it to fail fast before queueing work.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		return b.now().Sub(b.openedAt) >= b.cooldown
+	case HalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+func (b *Breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = HalfOpen
+		b.probing = false
+	}
+	switch b.state {
+	case Open:
+		b.rejected++
+		return false, ErrOpen
+	case HalfOpen:
+		if b.probing {
+			b.rejected++
+			return false, ErrOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+func (b *Breaker) acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	t := time.NewTimer(b.acquireTimeout)
+	defer t.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		b.mu.Lock()
+		b.rejected++
+		b.mu.Unlock()
+		return ErrBusy
+	}
+}
+
+// release gives back a probe reservation that never ran.
+func (b *Breaker) release(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *Breaker) record(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if !failed {
+		b.ok++
+		b.failures = 0
+		b.state = Closed
+		return
+	}
+	b.failed++
+	b.failures++
+	if probe || (b.state == Closed && b.failures >= b.threshold) {
+		b.state = Open
+		b.openedAt = b.now()
+		b.opened++
+	}
+}
+
+func (b *Breaker) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.state
+	if st == Open && b.now().Sub(b.openedAt) >= b.cooldown {
+		st = HalfOpen
+	}
+	return Stats{
+		State:               st,
+		ConsecutiveFailures: b.failures,
+		Opened:              b.opened,
+		Succeeded:           b.ok,
+		Failed:              b.failed,
+		Rejected:            b.rejected,
+		InFlight:            len(b.slots),
+		MaxConcurrent:       cap(b.slots),
+	}
+}
@@ -0,0 +1,116 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("down")
+
+func always(error) bool { return true }
+
+func TestBreaker_OpensAndRecovers(t *testing.T) {
+	b := New(3, time.Minute, 4, time.Second)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+	fail := func() error { return errDown }
+	ok := func() error { return nil }
+
+	for i := 0; i < 3; i++ {
+		if err := b.Do(ctx, fail, always); err != errDown {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if st := b.Stats(); st.State != Open || st.Opened != 1 {
+		t.Fatalf("after threshold: %+v", st)
+	}
+	called := false
+	if err := b.Do(ctx, func() error { called = true; return nil }, always); err != ErrOpen || called {
+		t.Fatalf("open breaker let call through: %v", err)
+	}
+
+	// Cooldown over: one probe is allowed; a failing probe reopens.
+	now = now.Add(time.Minute)
+	if !b.Allow() || b.Stats().State != HalfOpen {
+		t.Fatalf("expected half-open, got %+v", b.Stats())
+	}
+	if err := b.Do(ctx, fail, always); err != errDown {
+		t.Fatal(err)
+	}
+	if st := b.Stats(); st.State != Open || st.Opened != 2 {
+		t.Fatalf("failed probe: %+v", st)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Do(ctx, ok, always); err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Stats(); st.State != Closed || st.ConsecutiveFailures != 0 || st.Rejected != 1 {
+		t.Fatalf("after successful probe: %+v", st)
+	}
+}
+
+func TestBreaker_HalfOpenAllowsSingleProbe(t *testing.T) {
+	b := New(1, time.Second, 4, time.Second)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+	_ = b.Do(ctx, func() error { return errDown }, always)
+	now = now.Add(time.Second)
+
+	inProbe := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Do(ctx, func() error { close(inProbe); <-release; return nil }, always)
+	}()
+	<-inProbe
+	if err := b.Do(ctx, func() error { return nil }, always); err != ErrOpen {
+		t.Fatalf("second call during probe: %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if b.Stats().State != Closed {
+		t.Fatalf("state = %v", b.Stats().State)
+	}
+}
+
+func TestBreaker_IgnoresNonFailures(t *testing.T) {
+	b := New(1, time.Minute, 1, time.Second)
+	bad := errors.New("bad input")
+	for i := 0; i < 3; i++ {
+		_ = b.Do(context.Background(), func() error { return bad }, func(err error) bool { return err != bad })
+	}
+	if st := b.Stats(); st.State != Closed || st.Succeeded != 3 {
+		t.Fatalf("client errors tripped breaker: %+v", st)
+	}
+}
+
+func TestBreaker_ConcurrencyLimit(t *testing.T) {
+	b := New(5, time.Minute, 1, 20*time.Millisecond)
+	ctx := context.Background()
+	hold := make(chan struct{})
+	started := make(chan struct{})
+	go b.Do(ctx, func() error { close(started); <-hold; return nil }, always)
+	<-started
+	if st := b.Stats(); st.InFlight != 1 || st.MaxConcurrent != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+	if err := b.Do(ctx, func() error { return nil }, always); err != ErrBusy {
+		t.Fatalf("err = %v, want ErrBusy", err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Do(cctx, func() error { return nil }, always); err != context.Canceled {
+		t.Fatalf("err = %v, want canceled", err)
+	}
+	close(hold)
+	if st := b.Stats(); st.Rejected != 1 || st.State != Closed {
+		t.Fatalf("stats = %+v", st)
+	}
+}
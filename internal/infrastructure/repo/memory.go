@@ -1,7 +1,9 @@
 package repo
 
 import (
+	"sort"
 	"sync"
+	"time"
 	"permit-backend/internal/domain"
 )
 
@@ -17,7 +19,7 @@ func NewMemoryTaskRepo() *MemoryTaskRepo {
 func (r *MemoryTaskRepo) Put(t *domain.Task) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.m[t.ID] = t
+	r.m[t.ID] = cloneTask(t)
 	return nil
 }
 
@@ -25,22 +27,51 @@ func (r *MemoryTaskRepo) Get(id string) (*domain.Task, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	t, ok := r.m[id]
-	return t, ok
+	if !ok {
+		return nil, false
+	}
+	return cloneTask(t), true
+}
+
+func cloneTask(t *domain.Task) *domain.Task {
+	cp := *t
+	cp.AvailableColors = append([]string(nil), t.AvailableColors...)
+	cp.ProcessedUrls = cloneMap(t.ProcessedUrls)
+	cp.LayoutUrls = cloneMap(t.LayoutUrls)
+	return &cp
+}
+
+func cloneMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
 }
 
 type MemoryOrderRepo struct {
-	mu sync.RWMutex
-	m  map[string]*domain.Order
+	mu          sync.RWMutex
+	m           map[string]*domain.Order
+	transitions map[string][]domain.OrderTransition
+	refunds     map[string]*domain.Refund
 }
 
 func NewMemoryOrderRepo() *MemoryOrderRepo {
-	return &MemoryOrderRepo{m: make(map[string]*domain.Order)}
+	return &MemoryOrderRepo{
+		m:           make(map[string]*domain.Order),
+		transitions: make(map[string][]domain.OrderTransition),
+		refunds:     make(map[string]*domain.Refund),
+	}
 }
 
 func (r *MemoryOrderRepo) Put(o *domain.Order) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.m[o.OrderID] = o
+	cp := *o
+	r.m[o.OrderID] = &cp
 	return nil
 }
 
@@ -48,16 +79,23 @@ func (r *MemoryOrderRepo) Get(id string) (*domain.Order, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	o, ok := r.m[id]
-	return o, ok
+	if !ok {
+		return nil, false
+	}
+	cp := *o
+	return &cp, true
 }
 
-func (r *MemoryOrderRepo) List(page, pageSize int) ([]domain.Order, int) {
+func (r *MemoryOrderRepo) List(userID string, page, pageSize int) ([]domain.Order, int) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	all := make([]domain.Order, 0, len(r.m))
 	for _, o := range r.m {
-		all = append(all, *o)
+		if o.UserID == userID {
+			all = append(all, *o)
+		}
 	}
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.After(all[j].CreatedAt) })
 	total := len(all)
 	start := (page - 1) * pageSize
 	if start > total {
@@ -70,6 +108,132 @@ func (r *MemoryOrderRepo) List(page, pageSize int) ([]domain.Order, int) {
 	return all[start:end], total
 }
 
+func (r *MemoryOrderRepo) ListByTask(taskID string) ([]domain.Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []domain.Order
+	for _, o := range r.m {
+		if o.TaskID == taskID {
+			out = append(out, *o)
+		}
+	}
+	return out, nil
+}
+
+func (r *MemoryOrderRepo) PutWithTransition(o *domain.Order, t *domain.OrderTransition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cp := *o
+	r.m[o.OrderID] = &cp
+	if t != nil {
+		r.transitions[t.OrderID] = append(r.transitions[t.OrderID], *t)
+	}
+	return nil
+}
+
+func (r *MemoryOrderRepo) UpdateOrder(o *domain.Order, from domain.OrderStatus, t *domain.OrderTransition) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, ok := r.m[o.OrderID]
+	if !ok || cur.Status != from {
+		return false, nil
+	}
+	cp := *o
+	cp.RefundedCents = cur.RefundedCents
+	r.m[o.OrderID] = &cp
+	if t != nil {
+		r.transitions[t.OrderID] = append(r.transitions[t.OrderID], *t)
+	}
+	return true, nil
+}
+
+func (r *MemoryOrderRepo) ListTransitions(orderID string) ([]domain.OrderTransition, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]domain.OrderTransition(nil), r.transitions[orderID]...), nil
+}
+
+func (r *MemoryOrderRepo) PutRefund(rf *domain.Refund) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cp := *rf
+	r.refunds[rf.RefundID] = &cp
+	return nil
+}
+
+func (r *MemoryOrderRepo) GetRefund(id string) (*domain.Refund, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rf, ok := r.refunds[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *rf
+	return &cp, true
+}
+
+func (r *MemoryOrderRepo) ListRefunds(orderID string) ([]domain.Refund, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []domain.Refund
+	for _, rf := range r.refunds {
+		if rf.OrderID == orderID {
+			out = append(out, *rf)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (r *MemoryOrderRepo) ReserveRefund(rf *domain.Refund) (int, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o, ok := r.m[rf.OrderID]
+	if !ok || o.Status != domain.OrderPaid {
+		return 0, false, nil
+	}
+	refundable := o.AmountCents - o.RefundedCents
+	for _, x := range r.refunds {
+		if x.OrderID == rf.OrderID && x.Status == domain.RefundProcessing {
+			refundable -= x.AmountCents
+		}
+	}
+	if rf.AmountCents == 0 {
+		rf.AmountCents = refundable
+	}
+	if rf.AmountCents <= 0 || rf.AmountCents > refundable {
+		return refundable, false, nil
+	}
+	cp := *rf
+	cp.Status = domain.RefundProcessing
+	r.refunds[rf.RefundID] = &cp
+	return refundable, true, nil
+}
+
+func (r *MemoryOrderRepo) FinishRefund(refundID string, st domain.RefundStatus, providerRefundID string, at time.Time) (*domain.Order, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rf, ok := r.refunds[refundID]
+	if !ok || rf.Status != domain.RefundProcessing {
+		return nil, false, nil
+	}
+	o, ok := r.m[rf.OrderID]
+	if !ok {
+		return nil, false, nil
+	}
+	rf.Status = st
+	if providerRefundID != "" {
+		rf.ProviderRefundID = providerRefundID
+	}
+	rf.UpdatedAt = at
+	if st == domain.RefundSuccess {
+		o.RefundedCents += rf.AmountCents
+		o.UpdatedAt = at
+	}
+	cp := *o
+	return &cp, true, nil
+}
+
 type MemoryUserRepo struct {
 	mu sync.RWMutex
 	byOID map[string]*domain.User
@@ -93,3 +257,167 @@ func (r *MemoryUserRepo) GetUserByOpenID(openid string) (*domain.User, bool) {
 	u, ok := r.byOID[openid]
 	return u, ok
 }
+
+type MemorySpecRepo struct {
+	mu sync.RWMutex
+	m  map[string]domain.SpecDef
+}
+
+func NewMemorySpecRepo() *MemorySpecRepo {
+	return &MemorySpecRepo{m: make(map[string]domain.SpecDef)}
+}
+
+func (r *MemorySpecRepo) UpsertSpecs(specs []domain.SpecDef) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range specs {
+		s.BgColors = append([]string(nil), s.BgColors...)
+		s.Formats = append([]string(nil), s.Formats...)
+		r.m[s.Code] = s
+	}
+	return nil
+}
+
+func (r *MemorySpecRepo) ListSpecs() ([]domain.SpecDef, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]domain.SpecDef, 0, len(r.m))
+	for _, s := range r.m {
+		s.BgColors = append([]string(nil), s.BgColors...)
+		s.Formats = append([]string(nil), s.Formats...)
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (r *MemorySpecRepo) DeleteSpec(code string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, code)
+	return nil
+}
+
+type MemoryColorRepo struct {
+	mu sync.RWMutex
+	m  map[string]domain.Color
+}
+
+func NewMemoryColorRepo() *MemoryColorRepo {
+	return &MemoryColorRepo{m: make(map[string]domain.Color)}
+}
+
+func (r *MemoryColorRepo) UpsertColors(colors []domain.Color) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range colors {
+		r.m[c.Name] = cloneColor(c)
+	}
+	return nil
+}
+
+func (r *MemoryColorRepo) ListColors() ([]domain.Color, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]domain.Color, 0, len(r.m))
+	for _, c := range r.m {
+		out = append(out, cloneColor(c))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (r *MemoryColorRepo) DeleteColor(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, name)
+	return nil
+}
+
+func cloneColor(c domain.Color) domain.Color {
+	if c.Gradient != nil {
+		g := *c.Gradient
+		g.Stops = append([]string(nil), g.Stops...)
+		c.Gradient = &g
+	}
+	return c
+}
+
+type MemoryUploadRepo struct {
+	mu sync.RWMutex
+	m  map[string]*domain.UploadSession
+}
+
+func NewMemoryUploadRepo() *MemoryUploadRepo {
+	return &MemoryUploadRepo{m: make(map[string]*domain.UploadSession)}
+}
+
+func (r *MemoryUploadRepo) PutUploadSession(u *domain.UploadSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[u.ID] = cloneUpload(u)
+	return nil
+}
+
+func (r *MemoryUploadRepo) GetUploadSession(id string) (*domain.UploadSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.m[id]
+	if !ok {
+		return nil, false
+	}
+	return cloneUpload(u), true
+}
+
+func (r *MemoryUploadRepo) DeleteUploadSession(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, id)
+	return nil
+}
+
+func (r *MemoryUploadRepo) AppendUploadPart(id string, part domain.UploadPart, updatedAt, expiresAt time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.m[id]
+	if !ok || u.Status != domain.UploadOpen || u.Received != part.Offset {
+		return false, nil
+	}
+	u.Parts = append(u.Parts, part)
+	u.Received += part.Size
+	u.UpdatedAt, u.ExpiresAt = updatedAt, expiresAt
+	return true, nil
+}
+
+func (r *MemoryUploadRepo) CompleteUploadSession(u *domain.UploadSession) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, ok := r.m[u.ID]
+	if !ok || cur.Status != domain.UploadOpen {
+		return false, nil
+	}
+	r.m[u.ID] = cloneUpload(u)
+	return true, nil
+}
+
+func (r *MemoryUploadRepo) ListExpiredUploadSessions(now time.Time, limit int) ([]domain.UploadSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []domain.UploadSession
+	for _, u := range r.m {
+		if u.Status == domain.UploadOpen && u.ExpiresAt.Before(now) {
+			out = append(out, *cloneUpload(u))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(out[j].ExpiresAt) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func cloneUpload(u *domain.UploadSession) *domain.UploadSession {
+	cp := *u
+	cp.Parts = append([]domain.UploadPart(nil), u.Parts...)
+	return &cp
+}
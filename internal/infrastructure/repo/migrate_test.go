@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrations_Embedded(t *testing.T) {
+	ms, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i, m := range ms {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d has version %d; versions must be contiguous from 1", i, m.Version)
+		}
+	}
+}
+
+func TestLoadMigrations_Errors(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"bad prefix": {
+			"m/x_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/x_a.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"no direction": {
+			"m/0001_a.sql": {Data: []byte("SELECT 1;")},
+		},
+		"name mismatch": {
+			"m/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, fsys := range cases {
+		if _, err := loadMigrations(fsys, "m"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	ms, err := loadMigrations(fstest.MapFS{
+		"m/0002_b.up.sql":   {Data: []byte("B up")},
+		"m/0002_b.down.sql": {Data: []byte("B down")},
+		"m/0001_a.up.sql":   {Data: []byte("A up")},
+		"m/0001_a.down.sql": {Data: []byte("A down")},
+	}, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].Name != "a" || ms[1].Up != "B up" || ms[1].Down != "B down" {
+		t.Fatalf("migrations = %#v", ms)
+	}
+}
+
+func TestMigrator_UpDown(t *testing.T) {
+	r := openTestPostgres(t)
+	ctx := context.Background()
+	m, err := r.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := len(m.migrations)
+	if n, err := m.Pending(ctx); err != nil || n != total {
+		t.Fatalf("pending = %d, %v; want %d", n, err, total)
+	}
+	done, err := m.Up(ctx)
+	if err != nil || len(done) != total {
+		t.Fatalf("up applied %d, %v", len(done), err)
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != 0 {
+		t.Fatalf("second up applied %d, %v", len(done), err)
+	}
+	if done, err := m.Down(ctx, 1); err != nil || len(done) != 1 || done[0].Version != total {
+		t.Fatalf("down 1 = %v, %v", done, err)
+	}
+	if n, _ := m.Pending(ctx); n != 1 {
+		t.Fatalf("pending after down = %d", n)
+	}
+	if _, err := m.Down(ctx, total); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	if err := r.db.QueryRow(`SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("%d tables left after full rollback", tables)
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != total {
+		t.Fatalf("re-up applied %d, %v", len(done), err)
+	}
+}
+
+// A database created by the old boot-time init (TEXT JSON columns, no
+// schema_migrations) must adopt the history and keep its rows.
+func TestMigrator_AdoptsLegacySchema(t *testing.T) {
+	r := openTestPostgres(t)
+	ctx := context.Background()
+	_, err := r.db.Exec(`CREATE TABLE tasks (
+		id TEXT PRIMARY KEY, user_id TEXT, spec_code TEXT, source_object_key TEXT,
+		status TEXT, error_msg TEXT, processed_urls TEXT, created_at TIMESTAMPTZ, updated_at TIMESTAMPTZ,
+		default_background TEXT, spec TEXT
+	);
+	INSERT INTO tasks VALUES ('legacy','u1','passport','uploads/a.jpg','done','','{"white":"/assets/legacy/white.jpg"}',now(),now(),'white','');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := r.Get("legacy")
+	if !ok {
+		t.Fatal("legacy task lost")
+	}
+	if !strings.HasSuffix(got.ProcessedUrls["white"], "white.jpg") || got.DefaultBackground != "white" {
+		t.Fatalf("legacy task = %#v", got)
+	}
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS shipping_rates;
+DROP TABLE IF EXISTS price_items;
+DROP TABLE IF EXISTS order_transitions;
+DROP TABLE IF EXISTS refunds;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS tasks;
@@ -0,0 +1,82 @@
+-- Baseline schema. Every statement is idempotent so databases created by the
+-- old boot-time init can adopt the migration history without a rebuild.
+CREATE TABLE IF NOT EXISTS tasks (
+	id TEXT PRIMARY KEY,
+	user_id TEXT,
+	spec_code TEXT,
+	source_object_key TEXT,
+	status TEXT,
+	error_msg TEXT,
+	processed_urls TEXT,
+	created_at TIMESTAMPTZ,
+	updated_at TIMESTAMPTZ
+);
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS default_background TEXT;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS spec TEXT;
+
+CREATE TABLE IF NOT EXISTS users (
+	user_id TEXT PRIMARY KEY,
+	openid TEXT UNIQUE,
+	nickname TEXT,
+	avatar TEXT,
+	created_at TIMESTAMPTZ,
+	updated_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+	order_id TEXT PRIMARY KEY,
+	task_id TEXT,
+	items TEXT,
+	city TEXT,
+	remark TEXT,
+	amount_cents INT,
+	channel TEXT,
+	status TEXT,
+	pay_idempotency_key TEXT,
+	pay_params TEXT,
+	created_at TIMESTAMPTZ,
+	updated_at TIMESTAMPTZ
+);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pay_idempotency_key TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pay_params TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS transaction_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS refunded_cents INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS user_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS orders_task_id_idx ON orders (task_id);
+
+CREATE TABLE IF NOT EXISTS refunds (
+	refund_id TEXT PRIMARY KEY,
+	order_id TEXT NOT NULL,
+	amount_cents INT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	provider_refund_id TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS refunds_order_id_idx ON refunds (order_id);
+
+CREATE TABLE IF NOT EXISTS order_transitions (
+	id BIGSERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL,
+	from_status TEXT NOT NULL,
+	to_status TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS order_transitions_order_id_idx ON order_transitions (order_id);
+
+CREATE TABLE IF NOT EXISTS price_items (
+	type TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	unit_cents INT NOT NULL,
+	min_qty INT NOT NULL DEFAULT 0,
+	max_qty INT NOT NULL DEFAULT 0,
+	shipping BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS shipping_rates (
+	city TEXT PRIMARY KEY,
+	cents INT NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS colors;
+DROP TABLE IF EXISTS specs;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS specs (
+	code TEXT PRIMARY KEY,
+	name TEXT,
+	width_px INT,
+	height_px INT,
+	dpi INT,
+	bg_colors TEXT
+);
+ALTER TABLE specs
+	ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	ADD COLUMN IF NOT EXISTS width_mm INT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS height_mm INT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS min_kb INT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS max_kb INT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS head_height_ratio DOUBLE PRECISION NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS top_margin_ratio DOUBLE PRECISION NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS formats TEXT NOT NULL DEFAULT '[]',
+	ADD COLUMN IF NOT EXISTS allow_custom_color BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS colors (
+	name TEXT PRIMARY KEY,
+	display_name TEXT NOT NULL DEFAULT '',
+	hex TEXT NOT NULL,
+	gradient TEXT
+);
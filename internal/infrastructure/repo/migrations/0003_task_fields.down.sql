@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS tasks_user_id_idx;
+ALTER TABLE tasks
+	DROP COLUMN IF EXISTS layout_urls,
+	DROP COLUMN IF EXISTS available_colors,
+	DROP COLUMN IF EXISTS baseline_url;
+ALTER TABLE tasks ALTER COLUMN processed_urls TYPE TEXT USING processed_urls::text;
+ALTER TABLE tasks ALTER COLUMN spec TYPE TEXT USING spec::text;
@@ -0,0 +1,19 @@
+-- spec and processed_urls started out as TEXT; convert them in place so every
+-- JSON-valued task column is JSONB.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'tasks' AND column_name = 'spec') = 'text' THEN
+		ALTER TABLE tasks ALTER COLUMN spec TYPE JSONB USING NULLIF(spec, '')::jsonb;
+	END IF;
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'tasks' AND column_name = 'processed_urls') = 'text' THEN
+		ALTER TABLE tasks ALTER COLUMN processed_urls TYPE JSONB USING NULLIF(processed_urls, '')::jsonb;
+	END IF;
+END $$;
+
+ALTER TABLE tasks
+	ADD COLUMN IF NOT EXISTS baseline_url TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS available_colors JSONB,
+	ADD COLUMN IF NOT EXISTS layout_urls JSONB;
+CREATE INDEX IF NOT EXISTS tasks_user_id_idx ON tasks (user_id);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS upload_sessions (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	filename TEXT NOT NULL DEFAULT '',
+	size BIGINT NOT NULL,
+	sha256 TEXT NOT NULL,
+	received BIGINT NOT NULL DEFAULT 0,
+	parts JSONB,
+	status TEXT NOT NULL,
+	object_key TEXT NOT NULL DEFAULT '',
+	width INT NOT NULL DEFAULT 0,
+	height INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS upload_sessions_expires_at_idx ON upload_sessions (expires_at);
@@ -1,10 +1,12 @@
 package repo
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	_ "github.com/lib/pq"
 	"permit-backend/internal/domain"
+	"time"
 )
 
 type PostgresRepo struct {
@@ -16,73 +18,24 @@ func NewPostgresRepo(dsn string) (*PostgresRepo, error) {
 	if err != nil {
 		return nil, err
 	}
-	r := &PostgresRepo{db: db}
-	if err := r.init(); err != nil {
-		return nil, err
-	}
-	return r, nil
+	return &PostgresRepo{db: db}, nil
 }
 
-func (r *PostgresRepo) init() error {
-	_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS tasks (
-		id TEXT PRIMARY KEY,
-		user_id TEXT,
-		spec_code TEXT,
-		source_object_key TEXT,
-		status TEXT,
-		error_msg TEXT,
-		processed_urls TEXT,
-		created_at TIMESTAMPTZ,
-		updated_at TIMESTAMPTZ
-	);`)
-	if err != nil {
-		return err
-	}
-	_, err = r.db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		user_id TEXT PRIMARY KEY,
-		openid TEXT UNIQUE,
-		nickname TEXT,
-		avatar TEXT,
-		created_at TIMESTAMPTZ,
-		updated_at TIMESTAMPTZ
-	);`)
-	if err != nil {
-		return err
-	}
-	_, err = r.db.Exec(`CREATE TABLE IF NOT EXISTS orders (
-		order_id TEXT PRIMARY KEY,
-		task_id TEXT,
-		items TEXT,
-		city TEXT,
-		remark TEXT,
-		amount_cents INT,
-		channel TEXT,
-		status TEXT,
-		pay_idempotency_key TEXT,
-		pay_params TEXT,
-		created_at TIMESTAMPTZ,
-		updated_at TIMESTAMPTZ
-	);`)
-	if err != nil {
-		return err
-	}
-	_, err = r.db.Exec(`ALTER TABLE orders ADD COLUMN IF NOT EXISTS pay_idempotency_key TEXT;`)
-	if err != nil {
-		return err
-	}
-	_, err = r.db.Exec(`ALTER TABLE orders ADD COLUMN IF NOT EXISTS pay_params TEXT;`)
-	if err != nil {
-		return err
-	}
-	_, err = r.db.Exec(`CREATE TABLE IF NOT EXISTS specs (
-		code TEXT PRIMARY KEY,
-		name TEXT,
-		width_px INT,
-		height_px INT,
-		dpi INT,
-		bg_colors TEXT
-	);`)
-	return err
+// Ping checks that the database is reachable.
+func (r *PostgresRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+// Migrator returns a Migrator over the embedded migrations. NewPostgresRepo
+// does not create tables; apply them with Migrator().Up or
+// `permit-backend migrate up`.
+func (r *PostgresRepo) Migrator() (*Migrator, error) {
+	return NewMigrator(r.db)
+}
+
+// Close releases the underlying connection pool.
+func (r *PostgresRepo) Close() error {
+	return r.db.Close()
 }
 
 func (r *PostgresRepo) PutUser(u *domain.User) error {
@@ -102,43 +55,131 @@ func (r *PostgresRepo) GetUserByOpenID(openid string) (*domain.User, bool) {
 }
 
 func (r *PostgresRepo) Put(t *domain.Task) error {
+	spec, _ := json.Marshal(t.Spec)
 	pUrls, _ := json.Marshal(t.ProcessedUrls)
-	_, err := r.db.Exec(`INSERT INTO tasks (id,user_id,spec_code,source_object_key,status,error_msg,processed_urls,created_at,updated_at)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
-		ON CONFLICT (id) DO UPDATE SET user_id=$2,spec_code=$3,source_object_key=$4,status=$5,error_msg=$6,processed_urls=$7,updated_at=$9`,
-		t.ID, t.UserID, t.SpecCode, t.SourceObjectKey, string(t.Status), t.ErrorMsg, string(pUrls), t.CreatedAt, t.UpdatedAt)
+	colors, _ := json.Marshal(t.AvailableColors)
+	layouts, _ := json.Marshal(t.LayoutUrls)
+	_, err := r.db.Exec(`INSERT INTO tasks (id,user_id,spec_code,source_object_key,status,error_msg,processed_urls,created_at,updated_at,default_background,spec,baseline_url,available_colors,layout_urls)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)
+		ON CONFLICT (id) DO UPDATE SET user_id=$2,spec_code=$3,source_object_key=$4,status=$5,error_msg=$6,processed_urls=$7,updated_at=$9,default_background=$10,spec=$11,
+			baseline_url=$12,available_colors=$13,layout_urls=$14`,
+		t.ID, t.UserID, t.SpecCode, t.SourceObjectKey, string(t.Status), t.ErrorMsg, string(pUrls), t.CreatedAt, t.UpdatedAt, t.DefaultBackground, string(spec),
+		t.BaselineUrl, string(colors), string(layouts))
 	return err
 }
 
 func (r *PostgresRepo) Get(id string) (*domain.Task, bool) {
 	var t domain.Task
-	var pUrls string
-	err := r.db.QueryRow(`SELECT id,user_id,spec_code,source_object_key,status,error_msg,processed_urls,created_at,updated_at FROM tasks WHERE id=$1`, id).
-		Scan(&t.ID, &t.UserID, &t.SpecCode, &t.SourceObjectKey, (*string)(&t.Status), &t.ErrorMsg, &pUrls, &t.CreatedAt, &t.UpdatedAt)
+	var spec, pUrls, colors, layouts []byte
+	err := r.db.QueryRow(`SELECT id,COALESCE(user_id,''),COALESCE(spec_code,''),COALESCE(source_object_key,''),COALESCE(status,''),COALESCE(error_msg,''),
+		processed_urls,created_at,updated_at,COALESCE(default_background,''),spec,baseline_url,available_colors,layout_urls FROM tasks WHERE id=$1`, id).
+		Scan(&t.ID, &t.UserID, &t.SpecCode, &t.SourceObjectKey, (*string)(&t.Status), &t.ErrorMsg,
+			&pUrls, &t.CreatedAt, &t.UpdatedAt, &t.DefaultBackground, &spec, &t.BaselineUrl, &colors, &layouts)
 	if err != nil {
 		return nil, false
 	}
-	_ = json.Unmarshal([]byte(pUrls), &t.ProcessedUrls)
+	if len(spec) > 0 {
+		_ = json.Unmarshal(spec, &t.Spec)
+	}
+	if len(pUrls) > 0 {
+		_ = json.Unmarshal(pUrls, &t.ProcessedUrls)
+	}
 	if t.ProcessedUrls == nil {
 		t.ProcessedUrls = map[string]string{}
 	}
+	if len(colors) > 0 {
+		_ = json.Unmarshal(colors, &t.AvailableColors)
+	}
+	if len(layouts) > 0 {
+		_ = json.Unmarshal(layouts, &t.LayoutUrls)
+	}
 	return &t, true
 }
 
+// ListUnfinishedTasks returns the ids of queued and processing tasks,
+// oldest first.
+func (r *PostgresRepo) ListUnfinishedTasks() ([]string, error) {
+	rows, err := r.db.Query(`SELECT id FROM tasks WHERE status IN ($1,$2) ORDER BY created_at ASC`, string(domain.StatusQueued), string(domain.StatusProcessing))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
 func (r *PostgresRepo) PutOrder(o *domain.Order) error {
+	return putOrder(r.db, o)
+}
+
+// PutOrderWithTransition stores o and, when t is not nil, records t in the
+// same transaction, so the history never disagrees with the order.
+func (r *PostgresRepo) PutOrderWithTransition(o *domain.Order, t *domain.OrderTransition) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := putOrder(tx, o); err != nil {
+		return err
+	}
+	if t != nil {
+		if err := addOrderTransition(tx, *t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateOrder stores o only if the stored status is still from, recording t
+// in the same transaction. refunded_cents is left alone.
+func (r *PostgresRepo) UpdateOrder(o *domain.Order, from domain.OrderStatus, t *domain.OrderTransition) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
 	items, _ := json.Marshal(o.Items)
-	_, err := r.db.Exec(`INSERT INTO orders (order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
-		ON CONFLICT (order_id) DO UPDATE SET task_id=$2,items=$3,city=$4,remark=$5,amount_cents=$6,channel=$7,status=$8,pay_idempotency_key=$9,pay_params=$10,updated_at=$12`,
-		o.OrderID, o.TaskID, string(items), o.City, o.Remark, o.AmountCents, o.Channel, string(o.Status), o.PayIdempotencyKey, o.PayParams, o.CreatedAt, o.UpdatedAt)
+	res, err := tx.Exec(`UPDATE orders SET task_id=$2,items=$3,city=$4,remark=$5,amount_cents=$6,channel=$7,status=$8,pay_idempotency_key=$9,pay_params=$10,updated_at=$11,transaction_id=$12,user_id=$13
+		WHERE order_id=$1 AND status=$14`,
+		o.OrderID, o.TaskID, string(items), o.City, o.Remark, o.AmountCents, o.Channel, string(o.Status), o.PayIdempotencyKey, o.PayParams, o.UpdatedAt, o.TransactionID, o.UserID, string(from))
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+	if t != nil {
+		if err := addOrderTransition(tx, *t); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func putOrder(ex interface {
+	Exec(string, ...any) (sql.Result, error)
+}, o *domain.Order) error {
+	items, _ := json.Marshal(o.Items)
+	_, err := ex.Exec(`INSERT INTO orders (order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at,transaction_id,refunded_cents,user_id)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+		ON CONFLICT (order_id) DO UPDATE SET task_id=$2,items=$3,city=$4,remark=$5,amount_cents=$6,channel=$7,status=$8,pay_idempotency_key=$9,pay_params=$10,updated_at=$12,transaction_id=$13,refunded_cents=$14,user_id=$15`,
+		o.OrderID, o.TaskID, string(items), o.City, o.Remark, o.AmountCents, o.Channel, string(o.Status), o.PayIdempotencyKey, o.PayParams, o.CreatedAt, o.UpdatedAt, o.TransactionID, o.RefundedCents, o.UserID)
 	return err
 }
 
 func (r *PostgresRepo) GetOrder(id string) (*domain.Order, bool) {
 	var o domain.Order
 	var items string
-	err := r.db.QueryRow(`SELECT order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at FROM orders WHERE order_id=$1`, id).
-		Scan(&o.OrderID, &o.TaskID, &items, &o.City, &o.Remark, &o.AmountCents, &o.Channel, (*string)(&o.Status), &o.PayIdempotencyKey, &o.PayParams, &o.CreatedAt, &o.UpdatedAt)
+	err := r.db.QueryRow(`SELECT order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at,transaction_id,refunded_cents,user_id FROM orders WHERE order_id=$1`, id).
+		Scan(&o.OrderID, &o.TaskID, &items, &o.City, &o.Remark, &o.AmountCents, &o.Channel, (*string)(&o.Status), &o.PayIdempotencyKey, &o.PayParams, &o.CreatedAt, &o.UpdatedAt, &o.TransactionID, &o.RefundedCents, &o.UserID)
 	if err != nil {
 		return nil, false
 	}
@@ -146,8 +187,8 @@ func (r *PostgresRepo) GetOrder(id string) (*domain.Order, bool) {
 	return &o, true
 }
 
-func (r *PostgresRepo) ListOrders(page, pageSize int) ([]domain.Order, int) {
-	rows, err := r.db.Query(`SELECT order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at FROM orders ORDER BY created_at DESC LIMIT $1 OFFSET $2`, pageSize, (page-1)*pageSize)
+func (r *PostgresRepo) ListOrders(userID string, page, pageSize int) ([]domain.Order, int) {
+	rows, err := r.db.Query(`SELECT order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at,transaction_id,refunded_cents,user_id FROM orders WHERE user_id=$1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`, userID, pageSize, (page-1)*pageSize)
 	if err != nil {
 		return nil, 0
 	}
@@ -156,31 +197,232 @@ func (r *PostgresRepo) ListOrders(page, pageSize int) ([]domain.Order, int) {
 	for rows.Next() {
 		var o domain.Order
 		var items string
-		_ = rows.Scan(&o.OrderID, &o.TaskID, &items, &o.City, &o.Remark, &o.AmountCents, &o.Channel, (*string)(&o.Status), &o.PayIdempotencyKey, &o.PayParams, &o.CreatedAt, &o.UpdatedAt)
+		_ = rows.Scan(&o.OrderID, &o.TaskID, &items, &o.City, &o.Remark, &o.AmountCents, &o.Channel, (*string)(&o.Status), &o.PayIdempotencyKey, &o.PayParams, &o.CreatedAt, &o.UpdatedAt, &o.TransactionID, &o.RefundedCents, &o.UserID)
 		_ = json.Unmarshal([]byte(items), &o.Items)
 		out = append(out, o)
 	}
 	var total int
-	_ = r.db.QueryRow(`SELECT COUNT(1) FROM orders`).Scan(&total)
+	_ = r.db.QueryRow(`SELECT COUNT(1) FROM orders WHERE user_id=$1`, userID).Scan(&total)
 	return out, total
 }
 
+func addOrderTransition(ex interface {
+	Exec(string, ...any) (sql.Result, error)
+}, t domain.OrderTransition) error {
+	_, err := ex.Exec(`INSERT INTO order_transitions (order_id,from_status,to_status,actor,created_at) VALUES ($1,$2,$3,$4,$5)`,
+		t.OrderID, string(t.From), string(t.To), t.Actor, t.At)
+	return err
+}
+
+func (r *PostgresRepo) ListOrderTransitions(orderID string) ([]domain.OrderTransition, error) {
+	rows, err := r.db.Query(`SELECT order_id,from_status,to_status,actor,created_at FROM order_transitions WHERE order_id=$1 ORDER BY id ASC`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []domain.OrderTransition
+	for rows.Next() {
+		var t domain.OrderTransition
+		if err := rows.Scan(&t.OrderID, (*string)(&t.From), (*string)(&t.To), &t.Actor, &t.At); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) PutRefund(rf *domain.Refund) error {
+	_, err := r.db.Exec(`INSERT INTO refunds (refund_id,order_id,amount_cents,reason,status,provider_refund_id,created_at,updated_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		ON CONFLICT (refund_id) DO UPDATE SET status=$5,provider_refund_id=$6,updated_at=$8`,
+		rf.RefundID, rf.OrderID, rf.AmountCents, rf.Reason, string(rf.Status), rf.ProviderRefundID, rf.CreatedAt, rf.UpdatedAt)
+	return err
+}
+
+func (r *PostgresRepo) GetRefund(id string) (*domain.Refund, bool) {
+	var rf domain.Refund
+	err := r.db.QueryRow(`SELECT refund_id,order_id,amount_cents,reason,status,provider_refund_id,created_at,updated_at FROM refunds WHERE refund_id=$1`, id).
+		Scan(&rf.RefundID, &rf.OrderID, &rf.AmountCents, &rf.Reason, (*string)(&rf.Status), &rf.ProviderRefundID, &rf.CreatedAt, &rf.UpdatedAt)
+	if err != nil {
+		return nil, false
+	}
+	return &rf, true
+}
+
+func (r *PostgresRepo) ListRefunds(orderID string) ([]domain.Refund, error) {
+	rows, err := r.db.Query(`SELECT refund_id,order_id,amount_cents,reason,status,provider_refund_id,created_at,updated_at FROM refunds WHERE order_id=$1 ORDER BY created_at ASC`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []domain.Refund
+	for rows.Next() {
+		var rf domain.Refund
+		if err := rows.Scan(&rf.RefundID, &rf.OrderID, &rf.AmountCents, &rf.Reason, (*string)(&rf.Status), &rf.ProviderRefundID, &rf.CreatedAt, &rf.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rf)
+	}
+	return out, rows.Err()
+}
+
+// ReserveRefund stores rf as processing if its order is paid and
+// rf.AmountCents fits in the refundable amount: the order amount less what is
+// refunded or still being refunded. An AmountCents of 0 reserves all of it.
+// The order row stays locked until the refund is written, so concurrent
+// reservations cannot both take the same cents. It returns the refundable
+// amount and whether rf was stored.
+func (r *PostgresRepo) ReserveRefund(rf *domain.Refund) (int, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	var status string
+	var amount, refunded int
+	err = tx.QueryRow(`SELECT status,amount_cents,refunded_cents FROM orders WHERE order_id=$1 FOR UPDATE`, rf.OrderID).Scan(&status, &amount, &refunded)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var inflight int
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(amount_cents),0) FROM refunds WHERE order_id=$1 AND status=$2`, rf.OrderID, string(domain.RefundProcessing)).Scan(&inflight); err != nil {
+		return 0, false, err
+	}
+	refundable := amount - refunded - inflight
+	if domain.OrderStatus(status) != domain.OrderPaid {
+		return 0, false, nil
+	}
+	if rf.AmountCents == 0 {
+		rf.AmountCents = refundable
+	}
+	if rf.AmountCents <= 0 || rf.AmountCents > refundable {
+		return refundable, false, nil
+	}
+	if _, err := tx.Exec(`INSERT INTO refunds (refund_id,order_id,amount_cents,reason,status,provider_refund_id,created_at,updated_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+		rf.RefundID, rf.OrderID, rf.AmountCents, rf.Reason, string(domain.RefundProcessing), rf.ProviderRefundID, rf.CreatedAt, rf.UpdatedAt); err != nil {
+		return 0, false, err
+	}
+	return refundable, true, tx.Commit()
+}
+
+// FinishRefund moves a processing refund to st and, on success, adds its
+// amount to the order's refunded cents in the same transaction. A non-empty
+// providerRefundID replaces the stored one; st may stay processing to record
+// only that. It returns the order afterwards and false when the refund was
+// missing or no longer processing, which makes repeated notifications no-ops.
+func (r *PostgresRepo) FinishRefund(refundID string, st domain.RefundStatus, providerRefundID string, at time.Time) (*domain.Order, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	var orderID string
+	var amount int
+	err = tx.QueryRow(`UPDATE refunds SET status=$2, provider_refund_id=COALESCE(NULLIF($3,''),provider_refund_id), updated_at=$4
+		WHERE refund_id=$1 AND status=$5 RETURNING order_id,amount_cents`,
+		refundID, string(st), providerRefundID, at, string(domain.RefundProcessing)).Scan(&orderID, &amount)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if st == domain.RefundSuccess {
+		if _, err := tx.Exec(`UPDATE orders SET refunded_cents=refunded_cents+$2, updated_at=$3 WHERE order_id=$1`, orderID, amount, at); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	o, ok := r.GetOrder(orderID)
+	if !ok {
+		return nil, false, sql.ErrNoRows
+	}
+	return o, true, nil
+}
+
+func (r *PostgresRepo) LoadPriceCatalog() (domain.PriceCatalog, bool, error) {
+	c := domain.PriceCatalog{CityShippingCents: map[string]int{}}
+	rows, err := r.db.Query(`SELECT type,name,unit_cents,min_qty,max_qty,shipping FROM price_items ORDER BY type ASC`)
+	if err != nil {
+		return c, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var it domain.PriceItem
+		if err := rows.Scan(&it.Type, &it.Name, &it.UnitCents, &it.MinQty, &it.MaxQty, &it.Shipping); err != nil {
+			return c, false, err
+		}
+		c.Items = append(c.Items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return c, false, err
+	}
+	if len(c.Items) == 0 {
+		return c, false, nil
+	}
+	srows, err := r.db.Query(`SELECT city,cents FROM shipping_rates`)
+	if err != nil {
+		return c, false, err
+	}
+	defer srows.Close()
+	for srows.Next() {
+		var city string
+		var cents int
+		if err := srows.Scan(&city, &cents); err != nil {
+			return c, false, err
+		}
+		if city == "*" {
+			c.DefaultShippingCents = cents
+			continue
+		}
+		c.CityShippingCents[city] = cents
+	}
+	return c, true, srows.Err()
+}
+
+func (r *PostgresRepo) ListOrdersByTask(taskID string) ([]domain.Order, error) {
+	rows, err := r.db.Query(`SELECT order_id,task_id,items,city,remark,amount_cents,channel,status,pay_idempotency_key,pay_params,created_at,updated_at,transaction_id,refunded_cents,user_id FROM orders WHERE task_id=$1 ORDER BY created_at DESC`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []domain.Order
+	for rows.Next() {
+		var o domain.Order
+		var items string
+		if err := rows.Scan(&o.OrderID, &o.TaskID, &items, &o.City, &o.Remark, &o.AmountCents, &o.Channel, (*string)(&o.Status), &o.PayIdempotencyKey, &o.PayParams, &o.CreatedAt, &o.UpdatedAt, &o.TransactionID, &o.RefundedCents, &o.UserID); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(items), &o.Items)
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
 func (r *PostgresRepo) UpsertSpecs(specs []domain.SpecDef) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	stmt, err := tx.Prepare(`INSERT INTO specs (code,name,width_px,height_px,dpi,bg_colors)
-		VALUES ($1,$2,$3,$4,$5,$6)
-		ON CONFLICT (code) DO UPDATE SET name=$2,width_px=$3,height_px=$4,dpi=$5,bg_colors=$6`)
+	stmt, err := tx.Prepare(`INSERT INTO specs (code,name,width_px,height_px,dpi,bg_colors,disabled,width_mm,height_mm,min_kb,max_kb,head_height_ratio,top_margin_ratio,formats,allow_custom_color)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+		ON CONFLICT (code) DO UPDATE SET name=$2,width_px=$3,height_px=$4,dpi=$5,bg_colors=$6,disabled=$7,
+			width_mm=$8,height_mm=$9,min_kb=$10,max_kb=$11,head_height_ratio=$12,top_margin_ratio=$13,formats=$14,allow_custom_color=$15`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 	for _, s := range specs {
 		bg, _ := json.Marshal(s.BgColors)
-		if _, err := stmt.Exec(s.Code, s.Name, s.WidthPx, s.HeightPx, s.DPI, string(bg)); err != nil {
+		formats, _ := json.Marshal(s.Formats)
+		if _, err := stmt.Exec(s.Code, s.Name, s.WidthPx, s.HeightPx, s.DPI, string(bg), s.Disabled,
+			s.WidthMM, s.HeightMM, s.MinKB, s.MaxKB, s.HeadHeightRatio, s.TopMarginRatio, string(formats), s.AllowCustomColor); err != nil {
 			return err
 		}
 	}
@@ -188,7 +430,7 @@ func (r *PostgresRepo) UpsertSpecs(specs []domain.SpecDef) error {
 }
 
 func (r *PostgresRepo) ListSpecs() ([]domain.SpecDef, error) {
-	rows, err := r.db.Query(`SELECT code,name,width_px,height_px,dpi,bg_colors FROM specs ORDER BY name ASC`)
+	rows, err := r.db.Query(`SELECT code,name,width_px,height_px,dpi,bg_colors,disabled,width_mm,height_mm,min_kb,max_kb,head_height_ratio,top_margin_ratio,formats,allow_custom_color FROM specs ORDER BY name ASC`)
 	if err != nil {
 		return nil, err
 	}
@@ -196,12 +438,152 @@ func (r *PostgresRepo) ListSpecs() ([]domain.SpecDef, error) {
 	var out []domain.SpecDef
 	for rows.Next() {
 		var s domain.SpecDef
-		var bg string
-		if err := rows.Scan(&s.Code, &s.Name, &s.WidthPx, &s.HeightPx, &s.DPI, &bg); err != nil {
+		var bg, formats string
+		if err := rows.Scan(&s.Code, &s.Name, &s.WidthPx, &s.HeightPx, &s.DPI, &bg, &s.Disabled,
+			&s.WidthMM, &s.HeightMM, &s.MinKB, &s.MaxKB, &s.HeadHeightRatio, &s.TopMarginRatio, &formats, &s.AllowCustomColor); err != nil {
 			return nil, err
 		}
 		_ = json.Unmarshal([]byte(bg), &s.BgColors)
+		_ = json.Unmarshal([]byte(formats), &s.Formats)
 		out = append(out, s)
 	}
-	return out, nil
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) DeleteSpec(code string) error {
+	_, err := r.db.Exec(`DELETE FROM specs WHERE code=$1`, code)
+	return err
+}
+
+func (r *PostgresRepo) UpsertColors(colors []domain.Color) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO colors (name,display_name,hex,gradient) VALUES ($1,$2,$3,$4)
+		ON CONFLICT (name) DO UPDATE SET display_name=$2,hex=$3,gradient=$4`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range colors {
+		var gradient sql.NullString
+		if c.Gradient != nil {
+			b, _ := json.Marshal(c.Gradient)
+			gradient = sql.NullString{String: string(b), Valid: true}
+		}
+		if _, err := stmt.Exec(c.Name, c.DisplayName, c.Hex, gradient); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *PostgresRepo) ListColors() ([]domain.Color, error) {
+	rows, err := r.db.Query(`SELECT name,display_name,hex,gradient FROM colors ORDER BY name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []domain.Color
+	for rows.Next() {
+		var c domain.Color
+		var gradient sql.NullString
+		if err := rows.Scan(&c.Name, &c.DisplayName, &c.Hex, &gradient); err != nil {
+			return nil, err
+		}
+		if gradient.Valid && gradient.String != "" {
+			c.Gradient = &domain.Gradient{}
+			_ = json.Unmarshal([]byte(gradient.String), c.Gradient)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) DeleteColor(name string) error {
+	_, err := r.db.Exec(`DELETE FROM colors WHERE name=$1`, name)
+	return err
+}
+
+func (r *PostgresRepo) PutUploadSession(u *domain.UploadSession) error {
+	parts, _ := json.Marshal(u.Parts)
+	_, err := r.db.Exec(`INSERT INTO upload_sessions (id,user_id,filename,size,sha256,received,parts,status,object_key,width,height,created_at,updated_at,expires_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)
+		ON CONFLICT (id) DO UPDATE SET received=$6,parts=$7,status=$8,object_key=$9,width=$10,height=$11,updated_at=$13,expires_at=$14`,
+		u.ID, u.UserID, u.Filename, u.Size, u.SHA256, u.Received, string(parts), string(u.Status), u.ObjectKey, u.Width, u.Height, u.CreatedAt, u.UpdatedAt, u.ExpiresAt)
+	return err
+}
+
+func (r *PostgresRepo) AppendUploadPart(id string, part domain.UploadPart, updatedAt, expiresAt time.Time) (bool, error) {
+	one, _ := json.Marshal([]domain.UploadPart{part})
+	res, err := r.db.Exec(`UPDATE upload_sessions
+		SET parts=(CASE WHEN jsonb_typeof(parts)='array' THEN parts ELSE '[]'::jsonb END) || $2::jsonb,
+			received=received+$3, updated_at=$4, expires_at=$5
+		WHERE id=$1 AND received=$6 AND status='open'`,
+		id, string(one), part.Size, updatedAt, expiresAt, part.Offset)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *PostgresRepo) CompleteUploadSession(u *domain.UploadSession) (bool, error) {
+	parts, _ := json.Marshal(u.Parts)
+	res, err := r.db.Exec(`UPDATE upload_sessions
+		SET received=$2, parts=$3, status=$4, object_key=$5, width=$6, height=$7, updated_at=$8, expires_at=$9
+		WHERE id=$1 AND status='open'`,
+		u.ID, u.Received, string(parts), string(u.Status), u.ObjectKey, u.Width, u.Height, u.UpdatedAt, u.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+const uploadSessionCols = `id,user_id,filename,size,sha256,received,parts,status,object_key,width,height,created_at,updated_at,expires_at`
+
+func scanUploadSession(row interface{ Scan(...any) error }) (*domain.UploadSession, error) {
+	var u domain.UploadSession
+	var parts []byte
+	if err := row.Scan(&u.ID, &u.UserID, &u.Filename, &u.Size, &u.SHA256, &u.Received, &parts, (*string)(&u.Status), &u.ObjectKey,
+		&u.Width, &u.Height, &u.CreatedAt, &u.UpdatedAt, &u.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if len(parts) > 0 {
+		_ = json.Unmarshal(parts, &u.Parts)
+	}
+	return &u, nil
+}
+
+func (r *PostgresRepo) GetUploadSession(id string) (*domain.UploadSession, bool) {
+	u, err := scanUploadSession(r.db.QueryRow(`SELECT `+uploadSessionCols+` FROM upload_sessions WHERE id=$1`, id))
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+func (r *PostgresRepo) DeleteUploadSession(id string) error {
+	_, err := r.db.Exec(`DELETE FROM upload_sessions WHERE id=$1`, id)
+	return err
+}
+
+func (r *PostgresRepo) ListExpiredUploadSessions(now time.Time, limit int) ([]domain.UploadSession, error) {
+	rows, err := r.db.Query(`SELECT `+uploadSessionCols+` FROM upload_sessions WHERE status=$3 AND expires_at < $1 ORDER BY expires_at ASC LIMIT $2`, now, limit, string(domain.UploadOpen))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []domain.UploadSession
+	for rows.Next() {
+		u, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *u)
+	}
+	return out, rows.Err()
 }
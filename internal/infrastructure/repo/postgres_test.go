@@ -0,0 +1,373 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"permit-backend/internal/domain"
+)
+
+// newTestPostgres opens a migrated PostgresRepo inside a throwaway schema of
+// the database named by PERMIT_TEST_POSTGRES_DSN. The schema is dropped when
+// the test ends; without the variable the test is skipped.
+func newTestPostgres(t *testing.T) *PostgresRepo {
+	t.Helper()
+	r := openTestPostgres(t)
+	m, err := r.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// openTestPostgres is newTestPostgres without applying migrations.
+func openTestPostgres(t *testing.T) *PostgresRepo {
+	t.Helper()
+	dsn := os.Getenv("PERMIT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("PERMIT_TEST_POSTGRES_DSN not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("permit_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+	r, err := NewPostgresRepo(withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", schema)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + schema
+}
+
+// testNow is truncated to the microsecond precision of TIMESTAMPTZ.
+func testNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func TestPostgresRepo_TaskRoundTrip(t *testing.T) {
+	r := newTestPostgres(t)
+	now := testNow()
+	in := &domain.Task{
+		ID:       "task-1",
+		UserID:   "u1",
+		SpecCode: "passport",
+		Spec: domain.TaskSpec{
+			Code: "passport", WidthPx: 390, HeightPx: 567, DPI: 300,
+			WidthMM: 33, HeightMM: 48, MinKB: 20, MaxKB: 200,
+			HeadHeightRatio: 0.6, TopMarginRatio: 0.1, AllowCustomColor: true,
+		},
+		SourceObjectKey:   "uploads/a.jpg",
+		Status:            domain.StatusDone,
+		DefaultBackground: "white",
+		BaselineUrl:       "/assets/task-1/baseline.png",
+		AvailableColors:   []string{"white", "blue", "#123456"},
+		ProcessedUrls:     map[string]string{"white": "/assets/task-1/white.jpg"},
+		LayoutUrls:        map[string]string{"6inch_white_390x567_300dpi_200kb_0": "/assets/task-1/layout.jpg"},
+		ErrorMsg:          "",
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if err := r.Put(in); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := r.Get("task-1")
+	if !ok {
+		t.Fatal("task not found")
+	}
+	assertTask(t, got, in)
+
+	in.Status = domain.StatusFailed
+	in.ErrorMsg = "upstream"
+	in.ProcessedUrls["blue"] = "/assets/task-1/blue.jpg"
+	in.LayoutUrls = nil
+	in.AvailableColors = nil
+	in.UpdatedAt = now.Add(time.Minute)
+	if err := r.Put(in); err != nil {
+		t.Fatal(err)
+	}
+	got, ok = r.Get("task-1")
+	if !ok {
+		t.Fatal("task not found after update")
+	}
+	assertTask(t, got, in)
+
+	if _, ok := r.Get("missing"); ok {
+		t.Fatal("expected missing task")
+	}
+
+	for i, st := range []domain.Status{domain.StatusQueued, domain.StatusProcessing, domain.StatusDone} {
+		if err := r.Put(&domain.Task{ID: "open-" + string(st), Status: st, CreatedAt: now.Add(time.Duration(i) * time.Second), UpdatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids, err := r.ListUnfinishedTasks(); err != nil || !reflect.DeepEqual(ids, []string{"open-queued", "open-processing"}) {
+		t.Fatalf("ListUnfinishedTasks = %v, %v", ids, err)
+	}
+}
+
+func TestPostgresRepo_TaskEmptyMaps(t *testing.T) {
+	r := newTestPostgres(t)
+	now := testNow()
+	if err := r.Put(&domain.Task{ID: "task-2", Status: domain.StatusQueued, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := r.Get("task-2")
+	if !ok {
+		t.Fatal("task not found")
+	}
+	if got.ProcessedUrls == nil || len(got.ProcessedUrls) != 0 {
+		t.Fatalf("processedUrls = %#v, want empty map", got.ProcessedUrls)
+	}
+	if got.LayoutUrls != nil || got.AvailableColors != nil {
+		t.Fatalf("unexpected layouts/colors: %#v %#v", got.LayoutUrls, got.AvailableColors)
+	}
+}
+
+func assertTask(t *testing.T, got, want *domain.Task) {
+	t.Helper()
+	if !got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Fatalf("timestamps = %v/%v, want %v/%v", got.CreatedAt, got.UpdatedAt, want.CreatedAt, want.UpdatedAt)
+	}
+	g, w := *got, *want
+	g.CreatedAt, g.UpdatedAt, w.CreatedAt, w.UpdatedAt = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("task round trip mismatch\n got: %#v\nwant: %#v", g, w)
+	}
+}
+
+func TestPostgresRepo_OrderRoundTrip(t *testing.T) {
+	r := newTestPostgres(t)
+	now := testNow()
+	in := &domain.Order{
+		OrderID:           "o1",
+		UserID:            "u1",
+		TaskID:            "task-1",
+		Items:             []domain.OrderItem{{Type: "print", Qty: 2}},
+		City:              "上海",
+		Remark:            "r",
+		AmountCents:       1500,
+		RefundedCents:     500,
+		Channel:           "wechat",
+		Status:            domain.OrderPaid,
+		TransactionID:     "tx1",
+		PayIdempotencyKey: "k1",
+		PayParams:         `{"a":1}`,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if err := r.PutOrder(in); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := r.GetOrder("o1")
+	if !ok {
+		t.Fatal("order not found")
+	}
+	if !got.CreatedAt.Equal(now) || !got.UpdatedAt.Equal(now) {
+		t.Fatalf("timestamps = %v/%v", got.CreatedAt, got.UpdatedAt)
+	}
+	g, w := *got, *in
+	g.CreatedAt, g.UpdatedAt, w.CreatedAt, w.UpdatedAt = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("order round trip mismatch\n got: %#v\nwant: %#v", g, w)
+	}
+	byTask, err := r.ListOrdersByTask("task-1")
+	if err != nil || len(byTask) != 1 || byTask[0].OrderID != "o1" {
+		t.Fatalf("ListOrdersByTask = %v, %v", byTask, err)
+	}
+
+	in.Status = domain.OrderRefunded
+	tr := domain.OrderTransition{OrderID: "o1", From: domain.OrderPaid, To: domain.OrderRefunded, Actor: "refund", At: now}
+	if err := r.PutOrderWithTransition(in, &tr); err != nil {
+		t.Fatal(err)
+	}
+	// A history row that cannot be written takes the status change with it.
+	in.Status = domain.OrderCanceled
+	bad := domain.OrderTransition{OrderID: "o1", From: domain.OrderRefunded, To: domain.OrderCanceled, Actor: "nul\x00", At: now}
+	if err := r.PutOrderWithTransition(in, &bad); err == nil {
+		t.Fatal("transition with a NUL byte stored")
+	}
+	if got, _ := r.GetOrder("o1"); got.Status != domain.OrderRefunded {
+		t.Fatalf("status = %s after a failed transition", got.Status)
+	}
+	if hist, err := r.ListOrderTransitions("o1"); err != nil || len(hist) != 1 || hist[0].To != domain.OrderRefunded {
+		t.Fatalf("ListOrderTransitions = %v, %v", hist, err)
+	}
+
+	// An update expecting a status the order has left changes nothing.
+	in.Status = domain.OrderPending
+	stale := domain.OrderTransition{OrderID: "o1", From: domain.OrderPaid, To: domain.OrderPending, Actor: "user", At: now}
+	if ok, err := r.UpdateOrder(in, domain.OrderPaid, &stale); err != nil || ok {
+		t.Fatalf("UpdateOrder from paid = %v, %v", ok, err)
+	}
+	if got, _ := r.GetOrder("o1"); got.Status != domain.OrderRefunded {
+		t.Fatalf("status = %s after a stale update", got.Status)
+	}
+	in.Status = domain.OrderCanceled
+	next := domain.OrderTransition{OrderID: "o1", From: domain.OrderRefunded, To: domain.OrderCanceled, Actor: "admin", At: now}
+	if ok, err := r.UpdateOrder(in, domain.OrderRefunded, &next); err != nil || !ok {
+		t.Fatalf("UpdateOrder from refunded = %v, %v", ok, err)
+	}
+	if hist, err := r.ListOrderTransitions("o1"); err != nil || len(hist) != 2 || hist[1].To != domain.OrderCanceled {
+		t.Fatalf("ListOrderTransitions = %v, %v", hist, err)
+	}
+}
+
+func TestPostgresRepo_RefundReservation(t *testing.T) {
+	r := newTestPostgres(t)
+	now := testNow()
+	if err := r.PutOrder(&domain.Order{OrderID: "o1", AmountCents: 1000, Status: domain.OrderPaid, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	reserve := func(id string, cents int) (*domain.Refund, int, bool) {
+		rf := &domain.Refund{RefundID: id, OrderID: "o1", AmountCents: cents, Status: domain.RefundProcessing, CreatedAt: now, UpdatedAt: now}
+		n, ok, err := r.ReserveRefund(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rf, n, ok
+	}
+	if _, n, ok := reserve("r1", 600); !ok || n != 1000 {
+		t.Fatalf("first reservation = %d, %v", n, ok)
+	}
+	if _, n, ok := reserve("r2", 600); ok || n != 400 {
+		t.Fatalf("over-reservation = %d, %v", n, ok)
+	}
+	o, changed, err := r.FinishRefund("r1", domain.RefundSuccess, "wx-1", now)
+	if err != nil || !changed || o.RefundedCents != 600 {
+		t.Fatalf("FinishRefund = %+v, %v, %v", o, changed, err)
+	}
+	if _, changed, err := r.FinishRefund("r1", domain.RefundSuccess, "", now); err != nil || changed {
+		t.Fatalf("repeated FinishRefund = %v, %v", changed, err)
+	}
+	rest, n, ok := reserve("r3", 0)
+	if !ok || n != 400 || rest.AmountCents != 400 {
+		t.Fatalf("reserve rest = %+v, %d, %v", rest, n, ok)
+	}
+	if got, _ := r.GetRefund("r1"); got.Status != domain.RefundSuccess || got.ProviderRefundID != "wx-1" {
+		t.Fatalf("refund r1 = %+v", got)
+	}
+}
+
+func TestPostgresRepo_SpecsAndColors(t *testing.T) {
+	r := newTestPostgres(t)
+	spec := domain.SpecDef{
+		Code: "visa", Name: "签证", WidthPx: 413, HeightPx: 531, DPI: 300,
+		WidthMM: 35, HeightMM: 45, MinKB: 10, MaxKB: 100,
+		HeadHeightRatio: 0.7, TopMarginRatio: 0.08,
+		Formats: []string{"jpg", "png"}, BgColors: []string{"white"},
+		AllowCustomColor: true, Disabled: true,
+	}
+	if err := r.UpsertSpecs([]domain.SpecDef{spec}); err != nil {
+		t.Fatal(err)
+	}
+	specs, err := r.ListSpecs()
+	if err != nil || len(specs) != 1 || !reflect.DeepEqual(specs[0], spec) {
+		t.Fatalf("ListSpecs = %#v, %v", specs, err)
+	}
+	if err := r.DeleteSpec("visa"); err != nil {
+		t.Fatal(err)
+	}
+	if specs, _ := r.ListSpecs(); len(specs) != 0 {
+		t.Fatalf("spec not deleted: %#v", specs)
+	}
+
+	colors := []domain.Color{
+		{Name: "blue", DisplayName: "蓝", Hex: "638cce"},
+		{Name: "grad", DisplayName: "渐变", Hex: "638cce", Gradient: &domain.Gradient{Mode: "linear", Stops: []string{"638cce", "ffffff"}}},
+	}
+	if err := r.UpsertColors(colors); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ListColors()
+	if err != nil || !reflect.DeepEqual(got, colors) {
+		t.Fatalf("ListColors = %#v, %v", got, err)
+	}
+}
+
+func TestPostgresRepo_UploadSessions(t *testing.T) {
+	r := newTestPostgres(t)
+	now := testNow()
+	in := &domain.UploadSession{
+		ID: "up-1", UserID: "u1", Filename: "me.jpg", Size: 300, SHA256: "ab",
+		Received: 200, Status: domain.UploadOpen,
+		Parts:     []domain.UploadPart{{Offset: 0, Size: 100, SHA256: "c1", Key: "parts/up-1/a"}, {Offset: 100, Size: 100, SHA256: "c2", Key: "parts/up-1/b"}},
+		CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(time.Hour),
+	}
+	old := &domain.UploadSession{ID: "up-2", UserID: "u1", Size: 1, SHA256: "cd", Status: domain.UploadOpen, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(-time.Minute)}
+	for _, u := range []*domain.UploadSession{in, old} {
+		if err := r.PutUploadSession(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, ok := r.GetUploadSession("up-1")
+	if !ok || !got.ExpiresAt.Equal(in.ExpiresAt) {
+		t.Fatalf("GetUploadSession = %#v, %v", got, ok)
+	}
+	got.CreatedAt, got.UpdatedAt, got.ExpiresAt = in.CreatedAt, in.UpdatedAt, in.ExpiresAt
+	if !reflect.DeepEqual(got, in) {
+		t.Fatalf("upload session round trip mismatch\n got: %#v\nwant: %#v", got, in)
+	}
+
+	third := domain.UploadPart{Offset: 200, Size: 100, SHA256: "c3", Key: "parts/up-1/c"}
+	if ok, err := r.AppendUploadPart("up-1", domain.UploadPart{Offset: 100, Size: 100, Key: "parts/up-1/x"}, now, now.Add(time.Hour)); err != nil || ok {
+		t.Fatalf("append at a stale offset = %v, %v", ok, err)
+	}
+	if ok, err := r.AppendUploadPart("up-1", third, now, now.Add(time.Hour)); err != nil || !ok {
+		t.Fatalf("AppendUploadPart = %v, %v", ok, err)
+	}
+	if got, _ := r.GetUploadSession("up-1"); got.Received != 300 || len(got.Parts) != 3 || got.Parts[2] != third {
+		t.Fatalf("appended session = %#v", got)
+	}
+
+	in.Status, in.Parts, in.Received, in.ObjectKey, in.Width, in.Height = domain.UploadCompleted, nil, 300, "uploads/up-1_me.jpg", 600, 800
+	if ok, err := r.CompleteUploadSession(in); err != nil || !ok {
+		t.Fatalf("CompleteUploadSession = %v, %v", ok, err)
+	}
+	if ok, err := r.CompleteUploadSession(in); err != nil || ok {
+		t.Fatalf("completing twice = %v, %v", ok, err)
+	}
+	if got, _ := r.GetUploadSession("up-1"); got.Status != domain.UploadCompleted || got.Parts != nil || got.ObjectKey != in.ObjectKey || got.Width != 600 {
+		t.Fatalf("completed session = %#v", got)
+	}
+
+	// Completed sessions never expire.
+	expired, err := r.ListExpiredUploadSessions(now.Add(2*time.Hour), 10)
+	if err != nil || len(expired) != 1 || expired[0].ID != "up-2" {
+		t.Fatalf("ListExpiredUploadSessions = %#v, %v", expired, err)
+	}
+	if err := r.DeleteUploadSession("up-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.GetUploadSession("up-2"); ok {
+		t.Fatal("session not deleted")
+	}
+}
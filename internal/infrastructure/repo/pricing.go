@@ -0,0 +1,27 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"permit-backend/internal/domain"
+)
+
+func LoadPriceCatalogFile(path string) (domain.PriceCatalog, error) {
+	var c domain.PriceCatalog
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	if len(c.Items) == 0 {
+		return c, errors.New("pricing file has no items")
+	}
+	if c.CityShippingCents == nil {
+		c.CityShippingCents = map[string]int{}
+	}
+	return c, nil
+}
@@ -0,0 +1,219 @@
+package wechat
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const notifyMaxSkew = 5 * time.Minute
+
+var ErrNotifySignature = errors.New("wechat pay: notification signature invalid")
+
+type NotifyResource struct {
+	Algorithm      string `json:"algorithm"`
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data"`
+	OriginalType   string `json:"original_type"`
+	Nonce          string `json:"nonce"`
+}
+
+type Notification struct {
+	ID           string         `json:"id"`
+	CreateTime   string         `json:"create_time"`
+	EventType    string         `json:"event_type"`
+	ResourceType string         `json:"resource_type"`
+	Resource     NotifyResource `json:"resource"`
+	Summary      string         `json:"summary"`
+}
+
+type TransactionAmount struct {
+	Total      int    `json:"total"`
+	PayerTotal int    `json:"payer_total"`
+	Currency   string `json:"currency"`
+}
+
+type Transaction struct {
+	AppID         string            `json:"appid"`
+	MchID         string            `json:"mchid"`
+	OutTradeNo    string            `json:"out_trade_no"`
+	TransactionID string            `json:"transaction_id"`
+	TradeState    string            `json:"trade_state"`
+	SuccessTime   string            `json:"success_time"`
+	Amount        TransactionAmount `json:"amount"`
+	Payer         jsapiPayer        `json:"payer"`
+}
+
+func (c *PayClient) VerifyNotify(h http.Header, body []byte) error {
+	ts := h.Get("Wechatpay-Timestamp")
+	nonce := h.Get("Wechatpay-Nonce")
+	sig := h.Get("Wechatpay-Signature")
+	serial := h.Get("Wechatpay-Serial")
+	if ts == "" || nonce == "" || sig == "" || serial == "" {
+		return ErrNotifySignature
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrNotifySignature
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > notifyMaxSkew || d < -notifyMaxSkew {
+		return fmt.Errorf("wechat pay: notification timestamp out of range")
+	}
+	pub, ok := c.PlatformKeys[platformSerial(serial)]
+	if !ok {
+		return fmt.Errorf("wechat pay: unknown platform serial %s", serial)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrNotifySignature
+	}
+	sum := sha256.Sum256([]byte(ts + "\n" + nonce + "\n" + string(body) + "\n"))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], raw); err != nil {
+		return ErrNotifySignature
+	}
+	return nil
+}
+
+func (c *PayClient) ParseNotify(h http.Header, body []byte) (*Notification, []byte, error) {
+	if err := c.VerifyNotify(h, body); err != nil {
+		return nil, nil, err
+	}
+	var n Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, nil, err
+	}
+	plain, err := c.DecryptResource(n.Resource)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &n, plain, nil
+}
+
+func (c *PayClient) ParseTransactionNotify(h http.Header, body []byte) (*Transaction, error) {
+	n, plain, err := c.ParseNotify(h, body)
+	if err != nil {
+		return nil, err
+	}
+	if n.EventType != "TRANSACTION.SUCCESS" {
+		return nil, fmt.Errorf("wechat pay: unexpected event type %s", n.EventType)
+	}
+	var tx Transaction
+	if err := json.Unmarshal(plain, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (c *PayClient) DecryptResource(res NotifyResource) ([]byte, error) {
+	if res.Algorithm != "AEAD_AES_256_GCM" {
+		return nil, fmt.Errorf("wechat pay: unsupported algorithm %s", res.Algorithm)
+	}
+	if len(c.APIv3Key) != 32 {
+		return nil, errors.New("wechat pay: APIv3 key must be 32 bytes")
+	}
+	ct, err := base64.StdEncoding.DecodeString(res.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher([]byte(c.APIv3Key))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(res.Nonce))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, []byte(res.Nonce), ct, []byte(res.AssociatedData))
+}
+
+// platformSerial is the key PlatformKeys uses for a certificate serial:
+// upper-case hex without leading zeros, which big.Int drops but the
+// Wechatpay-Serial header keeps.
+func platformSerial(hex string) string {
+	s := strings.TrimLeft(strings.ToUpper(strings.TrimSpace(hex)), "0")
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+func LoadPlatformKeys(path string) (map[string]*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePlatformKeys(b)
+}
+
+func ParsePlatformKeys(pemBytes []byte) (map[string]*rsa.PublicKey, error) {
+	out := map[string]*rsa.PublicKey{}
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("wechat pay: platform certificate is not RSA")
+		}
+		out[platformSerial(cert.SerialNumber.Text(16))] = pub
+	}
+	if len(out) == 0 {
+		return nil, errors.New("wechat pay: no platform certificate found")
+	}
+	return out, nil
+}
+
+type RefundAmount struct {
+	Total       int `json:"total"`
+	Refund      int `json:"refund"`
+	PayerTotal  int `json:"payer_total"`
+	PayerRefund int `json:"payer_refund"`
+}
+
+type RefundResult struct {
+	MchID         string       `json:"mchid"`
+	OutTradeNo    string       `json:"out_trade_no"`
+	TransactionID string       `json:"transaction_id"`
+	OutRefundNo   string       `json:"out_refund_no"`
+	RefundID      string       `json:"refund_id"`
+	RefundStatus  string       `json:"refund_status"`
+	SuccessTime   string       `json:"success_time"`
+	Amount        RefundAmount `json:"amount"`
+}
+
+func (c *PayClient) ParseRefundNotify(h http.Header, body []byte) (*RefundResult, error) {
+	n, plain, err := c.ParseNotify(h, body)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(n.EventType, "REFUND.") {
+		return nil, fmt.Errorf("wechat pay: unexpected event type %s", n.EventType)
+	}
+	var rr RefundResult
+	if err := json.Unmarshal(plain, &rr); err != nil {
+		return nil, err
+	}
+	return &rr, nil
+}
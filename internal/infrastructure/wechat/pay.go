@@ -0,0 +1,257 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const DefaultPayBaseURL = "https://api.mch.weixin.qq.com"
+
+type PayClient struct {
+	AppID           string
+	MchID           string
+	SerialNo        string
+	PrivateKey      *rsa.PrivateKey
+	APIv3Key        string
+	PlatformKeys    map[string]*rsa.PublicKey
+	NotifyURL       string
+	RefundNotifyURL string
+	BaseURL         string
+	HTTP            *http.Client
+}
+
+type PayError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *PayError) Error() string {
+	return fmt.Sprintf("wechat pay error: %d %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Rejected reports whether WeChat Pay turned the request down (4xx), so
+// nothing was accepted and the request will not complete later.
+func (e *PayError) Rejected() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// IsRejected reports whether err is a *PayError with Rejected true. Transport
+// failures and 5xx answers leave the outcome unknown and are not rejections.
+func IsRejected(err error) bool {
+	var pe *PayError
+	return errors.As(err, &pe) && pe.Rejected()
+}
+
+type jsapiAmount struct {
+	Total    int    `json:"total"`
+	Currency string `json:"currency"`
+}
+
+type jsapiPayer struct {
+	OpenID string `json:"openid"`
+}
+
+type jsapiReq struct {
+	AppID       string      `json:"appid"`
+	MchID       string      `json:"mchid"`
+	Description string      `json:"description"`
+	OutTradeNo  string      `json:"out_trade_no"`
+	NotifyURL   string      `json:"notify_url"`
+	Amount      jsapiAmount `json:"amount"`
+	Payer       jsapiPayer  `json:"payer"`
+}
+
+type jsapiResp struct {
+	PrepayID string `json:"prepay_id"`
+}
+
+func (c *PayClient) Prepay(outTradeNo, description, openID string, amountCents int) (string, error) {
+	req := jsapiReq{
+		AppID:       c.AppID,
+		MchID:       c.MchID,
+		Description: description,
+		OutTradeNo:  outTradeNo,
+		NotifyURL:   c.NotifyURL,
+		Amount:      jsapiAmount{Total: amountCents, Currency: "CNY"},
+		Payer:       jsapiPayer{OpenID: openID},
+	}
+	var out jsapiResp
+	if err := c.do(http.MethodPost, "/v3/pay/transactions/jsapi", req, &out); err != nil {
+		return "", err
+	}
+	if out.PrepayID == "" {
+		return "", errors.New("wechat pay: empty prepay_id")
+	}
+	return out.PrepayID, nil
+}
+
+func (c *PayClient) PayParams(prepayID string) (map[string]any, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := nonceStr()
+	pkg := "prepay_id=" + prepayID
+	sig, err := c.sign(c.AppID + "\n" + ts + "\n" + nonce + "\n" + pkg + "\n")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"appId":     c.AppID,
+		"timeStamp": ts,
+		"nonceStr":  nonce,
+		"package":   pkg,
+		"signType":  "RSA",
+		"paySign":   sig,
+	}, nil
+}
+
+func (c *PayClient) do(method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+	authz, err := c.authorization(method, path, string(body))
+	if err != nil {
+		return err
+	}
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultPayBaseURL
+	}
+	req, err := http.NewRequest(method, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authz)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		pe := &PayError{StatusCode: resp.StatusCode}
+		_ = json.Unmarshal(raw, pe)
+		return pe
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func (c *PayClient) authorization(method, path, body string) (string, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := nonceStr()
+	sig, err := c.sign(method + "\n" + path + "\n" + ts + "\n" + nonce + "\n" + body + "\n")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		c.MchID, nonce, sig, ts, c.SerialNo), nil
+}
+
+func (c *PayClient) sign(msg string) (string, error) {
+	if c.PrivateKey == nil {
+		return "", errors.New("wechat pay: merchant private key not loaded")
+	}
+	sum := sha256.Sum256([]byte(msg))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.PrivateKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(b)
+}
+
+func ParsePrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("wechat pay: invalid private key pem")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rk, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("wechat pay: private key is not RSA")
+		}
+		return rk, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func nonceStr() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type refundAmount struct {
+	Refund   int    `json:"refund"`
+	Total    int    `json:"total"`
+	Currency string `json:"currency"`
+}
+
+type refundReq struct {
+	OutTradeNo  string       `json:"out_trade_no"`
+	OutRefundNo string       `json:"out_refund_no"`
+	Reason      string       `json:"reason,omitempty"`
+	NotifyURL   string       `json:"notify_url,omitempty"`
+	Amount      refundAmount `json:"amount"`
+}
+
+type refundResp struct {
+	RefundID    string `json:"refund_id"`
+	OutRefundNo string `json:"out_refund_no"`
+	Status      string `json:"status"`
+}
+
+func (c *PayClient) Refund(outTradeNo, outRefundNo, reason string, refundCents, totalCents int) (string, string, error) {
+	req := refundReq{
+		OutTradeNo:  outTradeNo,
+		OutRefundNo: outRefundNo,
+		Reason:      reason,
+		NotifyURL:   c.RefundNotifyURL,
+		Amount:      refundAmount{Refund: refundCents, Total: totalCents, Currency: "CNY"},
+	}
+	var out refundResp
+	if err := c.do(http.MethodPost, "/v3/refund/domestic/refunds", req, &out); err != nil {
+		return "", "", err
+	}
+	return out.RefundID, out.Status, nil
+}
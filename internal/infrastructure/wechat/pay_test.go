@@ -0,0 +1,218 @@
+package wechat
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func verifySig(t *testing.T, pub *rsa.PublicKey, msg, sig string) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		t.Fatalf("signature not base64: %v", err)
+	}
+	sum := sha256.Sum256([]byte(msg))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], raw); err != nil {
+		t.Fatalf("signature mismatch for %q: %v", msg, err)
+	}
+}
+
+func TestPayClient_PrepayAndPayParams(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	authRe := regexp.MustCompile(`^WECHATPAY2-SHA256-RSA2048 mchid="([^"]*)",nonce_str="([^"]*)",signature="([^"]*)",timestamp="([^"]*)",serial_no="([^"]*)"$`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v3/pay/transactions/jsapi" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		m := authRe.FindStringSubmatch(r.Header.Get("Authorization"))
+		if m == nil {
+			t.Errorf("bad Authorization header: %q", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if m[1] != "1900000001" || m[5] != "SERIAL123" {
+			t.Errorf("unexpected mchid/serial: %v", m)
+		}
+		verifySig(t, &key.PublicKey, "POST\n/v3/pay/transactions/jsapi\n"+m[4]+"\n"+m[2]+"\n"+string(body)+"\n", m[3])
+		var req jsapiReq
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("bad body: %v", err)
+		}
+		if req.OutTradeNo != "order-1" || req.Amount.Total != 990 || req.Amount.Currency != "CNY" || req.Payer.OpenID != "openid-1" || req.NotifyURL != "https://example.com/notify" {
+			t.Errorf("unexpected request body: %+v", req)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"prepay_id":"wx201410272009395522657a690389285100"}`))
+	}))
+	defer ts.Close()
+
+	c := &PayClient{
+		AppID:      "wxapp",
+		MchID:      "1900000001",
+		SerialNo:   "SERIAL123",
+		PrivateKey: key,
+		NotifyURL:  "https://example.com/notify",
+		BaseURL:    ts.URL,
+	}
+	prepayID, err := c.Prepay("order-1", "证件照订单", "openid-1", 990)
+	if err != nil {
+		t.Fatalf("Prepay error: %v", err)
+	}
+	if prepayID != "wx201410272009395522657a690389285100" {
+		t.Fatalf("unexpected prepay id %q", prepayID)
+	}
+	p, err := c.PayParams(prepayID)
+	if err != nil {
+		t.Fatalf("PayParams error: %v", err)
+	}
+	if p["package"] != "prepay_id="+prepayID || p["signType"] != "RSA" {
+		t.Fatalf("unexpected pay params: %v", p)
+	}
+	msg := p["appId"].(string) + "\n" + p["timeStamp"].(string) + "\n" + p["nonceStr"].(string) + "\n" + p["package"].(string) + "\n"
+	verifySig(t, &key.PublicKey, msg, p["paySign"].(string))
+}
+
+func TestPayClient_ErrorResponse(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"code":"PARAM_ERROR","message":"openid mismatch"}`))
+	}))
+	defer ts.Close()
+	c := &PayClient{AppID: "wxapp", MchID: "1", SerialNo: "S", PrivateKey: key, BaseURL: ts.URL}
+	_, err := c.Prepay("order-1", "desc", "openid", 1)
+	pe, ok := err.(*PayError)
+	if !ok {
+		t.Fatalf("expected *PayError, got %v", err)
+	}
+	if pe.StatusCode != http.StatusBadRequest || pe.Code != "PARAM_ERROR" || !IsRejected(err) {
+		t.Fatalf("unexpected error: %+v", pe)
+	}
+	if IsRejected(&PayError{StatusCode: http.StatusServiceUnavailable}) || IsRejected(io.ErrUnexpectedEOF) {
+		t.Fatal("5xx or transport error reported as rejected")
+	}
+}
+
+func newPlatformCert(t *testing.T) (*rsa.PrivateKey, []byte) {
+	return newPlatformCertSerial(t, 0x5157F09EFDC096DE)
+}
+
+func newPlatformCertSerial(t *testing.T, serial int64) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "Tenpay.com Root CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestPayClient_ParseTransactionNotify(t *testing.T) {
+	platformKey, certPEM := newPlatformCert(t)
+	keys, err := ParsePlatformKeys(certPEM)
+	if err != nil {
+		t.Fatalf("parse platform keys: %v", err)
+	}
+	apiV3Key := "0123456789abcdef0123456789abcdef"
+	c := &PayClient{MchID: "1900000001", APIv3Key: apiV3Key, PlatformKeys: keys}
+
+	plain := `{"mchid":"1900000001","appid":"wxapp","out_trade_no":"order-1","transaction_id":"4200000001","trade_state":"SUCCESS","amount":{"total":990,"payer_total":990,"currency":"CNY"},"payer":{"openid":"openid-1"}}`
+	block, _ := aes.NewCipher([]byte(apiV3Key))
+	gcm, _ := cipher.NewGCM(block)
+	nonce := "fdasflkja484"
+	ct := gcm.Seal(nil, []byte(nonce), []byte(plain), []byte("transaction"))
+	body, _ := json.Marshal(Notification{
+		ID:           "EV-2018022511223320873",
+		EventType:    "TRANSACTION.SUCCESS",
+		ResourceType: "encrypt-resource",
+		Resource: NotifyResource{
+			Algorithm:      "AEAD_AES_256_GCM",
+			Ciphertext:     base64.StdEncoding.EncodeToString(ct),
+			AssociatedData: "transaction",
+			OriginalType:   "transaction",
+			Nonce:          nonce,
+		},
+	})
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sum := sha256.Sum256([]byte(ts + "\n" + "n0nce\n" + string(body) + "\n"))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, platformKey, crypto.SHA256, sum[:])
+	h := http.Header{}
+	h.Set("Wechatpay-Timestamp", ts)
+	h.Set("Wechatpay-Nonce", "n0nce")
+	h.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sig))
+	h.Set("Wechatpay-Serial", "5157F09EFDC096DE")
+
+	tx, err := c.ParseTransactionNotify(h, body)
+	if err != nil {
+		t.Fatalf("ParseTransactionNotify error: %v", err)
+	}
+	if tx.OutTradeNo != "order-1" || tx.TransactionID != "4200000001" || tx.Amount.Total != 990 || tx.MchID != "1900000001" {
+		t.Fatalf("unexpected transaction: %+v", tx)
+	}
+
+	tampered := append([]byte(nil), body...)
+	tampered[len(tampered)-2] = ' '
+	if _, err := c.ParseTransactionNotify(h, tampered); err != ErrNotifySignature {
+		t.Fatalf("expected ErrNotifySignature for tampered body, got %v", err)
+	}
+	h.Set("Wechatpay-Timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	if _, err := c.ParseTransactionNotify(h, body); err == nil {
+		t.Fatalf("expected stale timestamp to be rejected")
+	}
+}
+
+func TestPayClient_VerifyNotifyLeadingZeroSerial(t *testing.T) {
+	platformKey, certPEM := newPlatformCertSerial(t, 0x0A1B2C3D4E5F6071)
+	keys, err := ParsePlatformKeys(certPEM)
+	if err != nil {
+		t.Fatalf("parse platform keys: %v", err)
+	}
+	c := &PayClient{PlatformKeys: keys}
+	body := []byte(`{"id":"EV-1"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sum := sha256.Sum256([]byte(ts + "\n" + "n0nce\n" + string(body) + "\n"))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, platformKey, crypto.SHA256, sum[:])
+	h := http.Header{}
+	h.Set("Wechatpay-Timestamp", ts)
+	h.Set("Wechatpay-Nonce", "n0nce")
+	h.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sig))
+	// WeChat sends the serial zero-padded; big.Int formats it without.
+	for _, serial := range []string{"0A1B2C3D4E5F6071", "0a1b2c3d4e5f6071", "A1B2C3D4E5F6071"} {
+		h.Set("Wechatpay-Serial", serial)
+		if err := c.VerifyNotify(h, body); err != nil {
+			t.Errorf("serial %s: %v", serial, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrQueueFull = errors.New("worker queue full")
+	ErrClosed    = errors.New("worker pool closed")
+)
+
+type Pool struct {
+	jobs   chan string
+	handle func(string)
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewPool(workers, depth int, handle func(string)) *Pool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if depth < 0 {
+		depth = 0
+	}
+	p := &Pool{jobs: make(chan string, depth), handle: handle}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.run()
+	}
+	return p
+}
+
+func (p *Pool) run() {
+	defer p.wg.Done()
+	for id := range p.jobs {
+		p.handle(id)
+	}
+}
+
+func (p *Pool) Submit(id string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.jobs <- id:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (p *Pool) Pending() int {
+	return len(p.jobs)
+}
+
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
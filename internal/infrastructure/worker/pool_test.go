@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool_BackPressureAndDrain(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var done []string
+	p := NewPool(1, 1, func(id string) {
+		<-release
+		mu.Lock()
+		done = append(done, id)
+		mu.Unlock()
+	})
+
+	if err := p.Submit("a"); err != nil {
+		t.Fatalf("submit a: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.Pending() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Submit("b"); err != nil {
+		t.Fatalf("submit b: %v", err)
+	}
+	if err := p.Submit("c"); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if len(done) != 2 {
+		t.Fatalf("expected 2 jobs drained, got %v", done)
+	}
+	if err := p.Submit("d"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package photo
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the orientation (1-8) stored in the Exif APP1
+// segment of a JPEG, or 1 when there is none or it cannot be read.
+func exifOrientation(jpg []byte) int {
+	for i := 2; i+4 <= len(jpg); {
+		if jpg[i] != 0xff {
+			return 1
+		}
+		marker := jpg[i+1]
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return 1 // image data starts; metadata comes before it
+		}
+		n := int(binary.BigEndian.Uint16(jpg[i+2:]))
+		if n < 2 || i+2+n > len(jpg) {
+			return 1
+		}
+		seg := jpg[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from IFD0 of a TIFF header.
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	off := int(bo.Uint32(t[4:]))
+	if off < 8 || off+2 > len(t) {
+		return 1
+	}
+	count := int(bo.Uint16(t[off:]))
+	for e := off + 2; e+12 <= len(t) && count > 0; e, count = e+12, count-1 {
+		if bo.Uint16(t[e:]) != exifOrientationTag {
+			continue
+		}
+		// SHORT, count 1: the value sits in the first two bytes of the
+		// value field.
+		if o := int(bo.Uint16(t[e+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+		return 1
+	}
+	return 1
+}
@@ -0,0 +1,66 @@
+package photo
+
+import "image"
+
+// Metrics are exposure and focus measurements of an image region.
+type Metrics struct {
+	// BlurScore is the variance of the Laplacian of luma; lower is
+	// blurrier. It depends on resolution, so compare images of similar size.
+	BlurScore float64
+	// Brightness is the mean luma, 0-255.
+	Brightness float64
+	// Overexposed and Underexposed are the fractions of pixels clipped to
+	// near white (luma >= 250) and near black (luma <= 5).
+	Overexposed  float64
+	Underexposed float64
+}
+
+// Measure computes Metrics over region of img; an empty region means the
+// whole image.
+func Measure(img image.Image, region image.Rectangle) Metrics {
+	r := region.Intersect(img.Bounds())
+	if r.Empty() {
+		r = img.Bounds()
+	}
+	w, h := r.Dx(), r.Dy()
+	if w == 0 || h == 0 {
+		return Metrics{}
+	}
+	luma := make([]float64, w*h)
+	var m Metrics
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			cr, cg, cb, _ := img.At(r.Min.X+x, r.Min.Y+y).RGBA()
+			l := (0.299*float64(cr) + 0.587*float64(cg) + 0.114*float64(cb)) / 257
+			luma[y*w+x] = l
+			m.Brightness += l
+			switch {
+			case l >= 250:
+				m.Overexposed++
+			case l <= 5:
+				m.Underexposed++
+			}
+		}
+	}
+	n := float64(w * h)
+	m.Brightness /= n
+	m.Overexposed /= n
+	m.Underexposed /= n
+
+	if w < 3 || h < 3 {
+		return m
+	}
+	var sum, sumSq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			lap := luma[i-1] + luma[i+1] + luma[i-w] + luma[i+w] - 4*luma[i]
+			sum += lap
+			sumSq += lap * lap
+		}
+	}
+	k := float64((w - 2) * (h - 2))
+	mean := sum / k
+	m.BlurScore = sumSq/k - mean*mean
+	return m
+}
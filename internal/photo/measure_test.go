@@ -0,0 +1,74 @@
+package photo
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// checkerboard is w x h with square cells of cell pixels, alternating lo
+// and hi grey.
+func checkerboard(w, h, cell int, lo, hi uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := lo
+			if (x/cell+y/cell)%2 == 1 {
+				v = hi
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+// boxBlur averages each pixel over a (2r+1)^2 square.
+func boxBlur(src *image.Gray, r int) *image.Gray {
+	b := src.Bounds()
+	dst := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sum, n := 0, 0
+			for dy := -r; dy <= r; dy++ {
+				for dx := -r; dx <= r; dx++ {
+					if p := image.Pt(x+dx, y+dy); p.In(b) {
+						sum += int(src.GrayAt(p.X, p.Y).Y)
+						n++
+					}
+				}
+			}
+			dst.SetGray(x, y, color.Gray{uint8(sum / n)})
+		}
+	}
+	return dst
+}
+
+func TestMeasure_Blur(t *testing.T) {
+	sharp := checkerboard(200, 200, 8, 60, 190)
+	blurred := boxBlur(sharp, 4)
+	s, b := Measure(sharp, image.Rectangle{}), Measure(blurred, image.Rectangle{})
+	if s.BlurScore <= 10*b.BlurScore {
+		t.Fatalf("blur score sharp %.1f, blurred %.1f; want sharp far higher", s.BlurScore, b.BlurScore)
+	}
+	if flat := Measure(checkerboard(50, 50, 100, 128, 128), image.Rectangle{}); flat.BlurScore != 0 {
+		t.Fatalf("flat image blur score = %v", flat.BlurScore)
+	}
+}
+
+func TestMeasure_Exposure(t *testing.T) {
+	// Left half black, right half white.
+	img := checkerboard(100, 100, 50, 0, 255)
+	m := Measure(img, image.Rect(0, 0, 100, 50))
+	if m.Brightness < 127 || m.Brightness > 128 || m.Overexposed != 0.5 || m.Underexposed != 0.5 {
+		t.Fatalf("metrics = %+v", m)
+	}
+	// A region inside the black cell sees only black.
+	m = Measure(img, image.Rect(10, 10, 40, 40))
+	if m.Brightness != 0 || m.Underexposed != 1 {
+		t.Fatalf("region metrics = %+v", m)
+	}
+	// A region outside the image falls back to the whole image.
+	if m = Measure(img, image.Rect(500, 500, 600, 600)); m.Overexposed != 0.5 {
+		t.Fatalf("fallback metrics = %+v", m)
+	}
+}
@@ -0,0 +1,275 @@
+// Package photo validates and normalizes user uploads before they are
+// stored: the content must really be a supported image, it is turned
+// upright, scaled down to a sane size and re-encoded without metadata.
+package photo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	_ "golang.org/x/image/webp"
+
+	"permit-backend/internal/algo"
+)
+
+// Rejection reasons, reported to clients in the 400 response.
+const (
+	ReasonEmpty       = "empty"
+	ReasonUnsupported = "unsupported_format"
+	ReasonCorrupt     = "corrupt"
+	ReasonTooSmall    = "too_small"
+	ReasonTooLarge    = "too_large"
+)
+
+// Rejection is returned for input that is not a usable photo.
+type Rejection struct {
+	Reason  string
+	Message string
+}
+
+func (r *Rejection) Error() string { return r.Reason + ": " + r.Message }
+
+func reject(reason, format string, args ...any) *Rejection {
+	return &Rejection{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Options bound what Normalize accepts. Zero values disable a limit.
+// ConvertCmd is run for HEIC, which has no Go decoder: it reads the image
+// on stdin and must write JPEG or PNG to stdout, e.g. ["magick", "-",
+// "jpeg:-"]. It is killed after ConvertTimeout or once it has written more
+// than ConvertMaxBytes. Without ConvertCmd HEIC is rejected.
+type Options struct {
+	MaxDimension    int
+	MaxPixels       int
+	MinDimension    int
+	ConvertCmd      []string
+	ConvertTimeout  time.Duration
+	ConvertMaxBytes int64
+}
+
+// Result is a normalized upload.
+type Result struct {
+	Data        []byte
+	Format      string // "jpeg" or "png"
+	ContentType string
+	Width       int
+	Height      int
+	Source      string // sniffed input format
+	Orientation int    // EXIF orientation that was applied, 1 if none
+	Scaled      bool
+}
+
+// Ext is the file extension for Format, with the dot.
+func (r *Result) Ext() string {
+	if r.Format == "png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+// Normalize checks that data is a JPEG, PNG, WebP or HEIC image, decodes it
+// fully, applies the EXIF orientation, scales the longer side down to
+// MaxDimension and re-encodes it. PNG stays PNG so transparency survives;
+// everything else becomes JPEG. Re-encoding drops EXIF (including GPS),
+// XMP and text chunks. Unusable input yields a *Rejection.
+func Normalize(ctx context.Context, data []byte, opts Options) (*Result, error) {
+	if len(data) == 0 {
+		return nil, reject(ReasonEmpty, "file is empty")
+	}
+	res := &Result{Source: Sniff(data), Orientation: 1}
+	switch res.Source {
+	case "jpeg", "png", "webp":
+	case "heic":
+		if len(opts.ConvertCmd) == 0 {
+			return nil, reject(ReasonUnsupported, "heic images are not supported, upload jpg, png or webp")
+		}
+		out, err := convert(ctx, opts, data)
+		if err != nil {
+			return nil, err
+		}
+		if f := Sniff(out); f != "jpeg" && f != "png" {
+			return nil, fmt.Errorf("convert %s: command wrote %s, want jpeg or png", res.Source, http.DetectContentType(out))
+		}
+		data = out
+	default:
+		return nil, reject(ReasonUnsupported, "content is %s, not a jpg, png, webp or heic image", http.DetectContentType(data))
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, reject(ReasonCorrupt, "cannot read image header: %v", err)
+	}
+	if opts.MaxPixels > 0 && cfg.Width*cfg.Height > opts.MaxPixels {
+		return nil, reject(ReasonTooLarge, "image is %dx%d, above the %d megapixel limit", cfg.Width, cfg.Height, opts.MaxPixels/1000000)
+	}
+	if format == "jpeg" {
+		res.Orientation = exifOrientation(data)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, reject(ReasonCorrupt, "cannot decode image: %v", err)
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if opts.MinDimension > 0 && min(w, h) < opts.MinDimension {
+		return nil, reject(ReasonTooSmall, "image is %dx%d, the shorter side must be at least %d pixels", w, h, opts.MinDimension)
+	}
+	// Scale before turning so the rotation works on the smaller image.
+	if m := opts.MaxDimension; m > 0 && max(w, h) > m {
+		if w >= h {
+			w, h = m, max(1, h*m/w)
+		} else {
+			w, h = max(1, w*m/h), m
+		}
+		img = algo.Resize(img, w, h)
+		res.Scaled = true
+	}
+	img = orient(img, res.Orientation)
+	res.Width, res.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	var buf bytes.Buffer
+	if format == "png" {
+		res.Format, res.ContentType = "png", "image/png"
+		err = png.Encode(&buf, img)
+	} else {
+		res.Format, res.ContentType = "jpeg", "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Data = buf.Bytes()
+	return res, nil
+}
+
+// Sniff identifies the image format from the leading bytes: "jpeg", "png",
+// "gif", "webp", "heic", or "" when it is none of these.
+func Sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return "heic"
+		}
+	}
+	return ""
+}
+
+// convert pipes data through opts.ConvertCmd. A non-zero exit means the
+// converter could not read the input and is reported as a corrupt upload,
+// as is running out of time or output; failing to start the command is a
+// server error.
+func convert(ctx context.Context, opts Options, data []byte) ([]byte, error) {
+	cctx := ctx
+	if opts.ConvertTimeout > 0 {
+		var cancel context.CancelFunc
+		cctx, cancel = context.WithTimeout(ctx, opts.ConvertTimeout)
+		defer cancel()
+	}
+	c := exec.CommandContext(cctx, opts.ConvertCmd[0], opts.ConvertCmd[1:]...)
+	c.Stdin = bytes.NewReader(data)
+	out := &cappedBuffer{max: opts.ConvertMaxBytes, fail: true}
+	stderr := &cappedBuffer{max: 200}
+	c.Stdout, c.Stderr = out, stderr
+	// Do not wait on pipes held open by a killed converter's children.
+	c.WaitDelay = time.Second
+	err := c.Run()
+	switch {
+	case out.over:
+		return nil, reject(ReasonTooLarge, "converted image is larger than %d bytes", opts.ConvertMaxBytes)
+	case err == nil:
+		return out.buf.Bytes(), nil
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("convert image: %w", ctx.Err())
+	case cctx.Err() != nil:
+		return nil, reject(ReasonCorrupt, "image conversion took longer than %s", opts.ConvertTimeout)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return nil, reject(ReasonCorrupt, "cannot convert image: %s", strings.TrimSpace(stderr.buf.String()))
+	}
+	return nil, fmt.Errorf("convert image: %w", err)
+}
+
+var errOutputLimit = errors.New("output limit reached")
+
+// cappedBuffer keeps at most max bytes (0 means no limit). Past the limit it
+// fails the write when fail is set, which stops the copy from the child and
+// so the child, and otherwise drops the rest.
+type cappedBuffer struct {
+	buf  bytes.Buffer
+	max  int64
+	fail bool
+	over bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.max > 0 && int64(b.buf.Len()+len(p)) > b.max {
+		b.over = true
+		if b.fail {
+			return 0, errOutputLimit
+		}
+		b.buf.Write(p[:b.max-int64(b.buf.Len())])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// orient returns img turned upright for EXIF orientation o (1-8).
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// (sx, sy) is the stored pixel shown at (x, y).
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			si, di := src.PixOffset(sx, sy), dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
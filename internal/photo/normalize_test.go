@@ -0,0 +1,210 @@
+package photo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testJPEG is w x h, red in the top-left quadrant and grey elsewhere.
+func testJPEG(w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{0x80, 0x80, 0x80, 0xff}
+			if x < w/2 && y < h/2 {
+				c = color.RGBA{0xff, 0, 0, 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	return buf.Bytes()
+}
+
+// withExif inserts a big-endian Exif APP1 segment carrying orientation and
+// a GPS IFD pointer followed by a marker string.
+func withExif(jpg []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(8))
+	_ = binary.Write(&tiff, binary.BigEndian, uint16(2))
+	_ = binary.Write(&tiff, binary.BigEndian, []uint16{exifOrientationTag, 3})
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(1))
+	_ = binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})
+	_ = binary.Write(&tiff, binary.BigEndian, []uint16{0x8825, 4})
+	_ = binary.Write(&tiff, binary.BigEndian, []uint32{1, 38})
+	_ = binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("GPS:31.2304N,121.4737E")
+
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(seg)+2))
+	out = append(out, seg...)
+	return append(out, jpg[2:]...)
+}
+
+func rejectionReason(err error) string {
+	var r *Rejection
+	if errors.As(err, &r) {
+		return r.Reason
+	}
+	return ""
+}
+
+func TestNormalize_OrientsAndStripsExif(t *testing.T) {
+	src := withExif(testJPEG(400, 300), 6)
+	if o := exifOrientation(src); o != 6 {
+		t.Fatalf("orientation = %d", o)
+	}
+	res, err := Normalize(context.Background(), src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Width != 300 || res.Height != 400 || res.Orientation != 6 || res.Format != "jpeg" {
+		t.Fatalf("result = %dx%d orientation %d %s", res.Width, res.Height, res.Orientation, res.Format)
+	}
+	if bytes.Contains(res.Data, []byte("Exif")) || bytes.Contains(res.Data, []byte("GPS:")) {
+		t.Fatal("metadata survived normalization")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(res.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turned clockwise, the red top-left quadrant ends up top-right.
+	if r, g, _, _ := img.At(280, 20).RGBA(); r < 0xe000 || g > 0x3000 {
+		t.Fatalf("top-right after rotation = %x %x, want red", r, g)
+	}
+	if r, g, _, _ := img.At(20, 20).RGBA(); r > 0xa000 || g < 0x6000 {
+		t.Fatalf("top-left after rotation = %x %x, want grey", r, g)
+	}
+}
+
+func TestNormalize_Orientations(t *testing.T) {
+	// Every orientation must put the stored top-left (red) quadrant at the
+	// displayed position EXIF says it belongs.
+	want := map[int]image.Point{1: {0, 0}, 2: {1, 0}, 3: {1, 1}, 4: {0, 1}, 5: {0, 0}, 6: {1, 0}, 7: {1, 1}, 8: {0, 1}}
+	for o, corner := range want {
+		res, err := Normalize(context.Background(), withExif(testJPEG(200, 100), uint16(o)), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _ := jpeg.Decode(bytes.NewReader(res.Data))
+		x := 5 + corner.X*(res.Width-10)
+		y := 5 + corner.Y*(res.Height-10)
+		if r, g, _, _ := img.At(x, y).RGBA(); r < 0xe000 || g > 0x3000 {
+			t.Fatalf("orientation %d: pixel (%d,%d) = %x %x, want red", o, x, y, r, g)
+		}
+	}
+}
+
+func TestNormalize_Limits(t *testing.T) {
+	res, err := Normalize(context.Background(), testJPEG(1200, 800), Options{MaxDimension: 600})
+	if err != nil || res.Width != 600 || res.Height != 400 || !res.Scaled {
+		t.Fatalf("downscale = %+v, %v", res, err)
+	}
+	if _, err := Normalize(context.Background(), testJPEG(1200, 800), Options{MaxPixels: 500000}); rejectionReason(err) != ReasonTooLarge {
+		t.Fatalf("max pixels: %v", err)
+	}
+	if _, err := Normalize(context.Background(), testJPEG(150, 800), Options{MinDimension: 200}); rejectionReason(err) != ReasonTooSmall {
+		t.Fatalf("min dimension: %v", err)
+	}
+}
+
+func TestNormalize_Rejections(t *testing.T) {
+	jpg := testJPEG(300, 300)
+	cases := map[string]struct {
+		data   []byte
+		reason string
+	}{
+		"empty":     {nil, ReasonEmpty},
+		"pdf":       {[]byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n"), ReasonUnsupported},
+		"gif":       {[]byte("GIF89a\x01\x00\x01\x00"), ReasonUnsupported},
+		"truncated": {jpg[:len(jpg)/2], ReasonCorrupt},
+		"header":    {[]byte{0xff, 0xd8, 0xff, 0xe0, 0, 2}, ReasonCorrupt},
+		"webp":      {[]byte("RIFF\x10\x00\x00\x00WEBPVP8 \x00\x00\x00\x00"), ReasonCorrupt},
+		"heic":      {[]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), ReasonUnsupported},
+	}
+	for name, c := range cases {
+		if _, err := Normalize(context.Background(), c.data, Options{}); rejectionReason(err) != c.reason {
+			t.Errorf("%s: got %v, want %s", name, err, c.reason)
+		}
+	}
+}
+
+func TestNormalize_WebP(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Normalize(context.Background(), data, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != "webp" || res.Format != "jpeg" || res.Width != 150 || res.Height != 100 || Sniff(res.Data) != "jpeg" {
+		t.Fatalf("webp = %+v", res)
+	}
+}
+
+func TestNormalize_PNGKeepsAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 300))
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	res, err := Normalize(context.Background(), buf.Bytes(), Options{})
+	if err != nil || res.Format != "png" || res.Ext() != ".png" {
+		t.Fatalf("png = %+v, %v", res, err)
+	}
+	out, _ := png.Decode(bytes.NewReader(res.Data))
+	if _, _, _, a := out.At(10, 10).RGBA(); a != 0 {
+		t.Fatalf("alpha = %x, want transparent", a)
+	}
+}
+
+func TestNormalize_ConvertCmd(t *testing.T) {
+	// The stand-in converter ignores stdin and prints a JPEG, as a real one
+	// would after decoding the HEIC it was given.
+	out := filepath.Join(t.TempDir(), "converted.jpg")
+	if err := os.WriteFile(out, withExif(testJPEG(400, 300), 8), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	res, err := Normalize(context.Background(), heic, Options{ConvertCmd: []string{"sh", "-c", "cat >/dev/null; cat " + out}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != "heic" || res.Format != "jpeg" || res.Width != 300 || res.Height != 400 {
+		t.Fatalf("converted = %+v", res)
+	}
+
+	_, err = Normalize(context.Background(), heic, Options{ConvertCmd: []string{"sh", "-c", "echo bad heic >&2; exit 1"}})
+	if rejectionReason(err) != ReasonCorrupt {
+		t.Fatalf("failing converter: %v", err)
+	}
+	_, err = Normalize(context.Background(), heic, Options{ConvertCmd: []string{"/nonexistent/converter"}})
+	if err == nil || rejectionReason(err) != "" {
+		t.Fatalf("missing converter should be a server error: %v", err)
+	}
+}
+
+func TestNormalize_ConvertLimits(t *testing.T) {
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	start := time.Now()
+	_, err := Normalize(context.Background(), heic, Options{ConvertCmd: []string{"sleep", "5"}, ConvertTimeout: 100 * time.Millisecond})
+	if rejectionReason(err) != ReasonCorrupt || time.Since(start) > 3*time.Second {
+		t.Fatalf("slow converter: %v after %s", err, time.Since(start))
+	}
+	_, err = Normalize(context.Background(), heic, Options{ConvertCmd: []string{"head", "-c", "100000", "/dev/zero"}, ConvertMaxBytes: 1000})
+	if rejectionReason(err) != ReasonTooLarge {
+		t.Fatalf("chatty converter: %v", err)
+	}
+}
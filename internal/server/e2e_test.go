@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"permit-backend/internal/algo"
+	"permit-backend/internal/algo/algostub"
+	"permit-backend/internal/config"
+)
+
+// The tests in this file run the server against algostub over HTTP, so the
+// multipart requests and JSON answers of internal/algo are exercised end to
+// end, including the stub's scripted faults.
+
+// newE2EServer starts a stub and a server calling it with algoTimeout per
+// request and a single quick retry.
+func newE2EServer(t *testing.T, algoTimeout time.Duration) (http.Handler, *algostub.Stub) {
+	t.Helper()
+	stub := algostub.New()
+	up := httptest.NewServer(stub)
+	t.Cleanup(up.Close)
+
+	cfg := config.Default()
+	cfg.AssetsDir, cfg.UploadsDir, cfg.PrivateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	cfg.JWTSecret = "test-secret"
+	cfg.AlgoURL = up.URL
+	cfg.AlgoFaceDetect = true
+	cfg.AlgoTimeout = algoTimeout
+	cfg.AlgoRetries = 1
+	cfg.AlgoRetryBackoff = 10 * time.Millisecond
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown(t.Context()) })
+	return s.Handler(), stub
+}
+
+func testJPEG(w, h int) []byte {
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil)
+	return buf.Bytes()
+}
+
+func postUpload(t *testing.T, h http.Handler, token, name string, data []byte) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("file", name)
+	_, _ = fw.Write(data)
+	_ = mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/upload", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var out map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec, out
+}
+
+func uploadPhoto(t *testing.T, h http.Handler, token, name string, data []byte) string {
+	t.Helper()
+	rec, out := postUpload(t, h, token, name, data)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	return out["objectKey"].(string)
+}
+
+func createTask(t *testing.T, h http.Handler, token, spec, objectKey string) string {
+	t.Helper()
+	rec, task := doJSON(t, h, http.MethodPost, "/api/tasks", token, map[string]any{"specCode": spec, "sourceObjectKey": objectKey})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create task: %d %s", rec.Code, rec.Body.String())
+	}
+	return task["id"].(string)
+}
+
+// waitTask polls the task until it is done or failed.
+func waitTask(t *testing.T, h http.Handler, token, id string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, task := doJSON(t, h, http.MethodGet, "/api/tasks/"+id, token, nil)
+		if task["status"] == "done" || task["status"] == "failed" {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s still %v", id, task["status"])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// doneTask uploads a photo and returns the id of a finished passport task.
+func doneTask(t *testing.T, h http.Handler, token string) string {
+	t.Helper()
+	id := createTask(t, h, token, "passport", uploadPhoto(t, h, token, "me.jpg", testJPEG(600, 800)))
+	if task := waitTask(t, h, token, id); task["status"] != "done" {
+		t.Fatalf("task failed: %v", task)
+	}
+	return id
+}
+
+func errCode(body map[string]any) any {
+	e, _ := body["error"].(map[string]any)
+	return e["code"]
+}
+
+func TestE2E_Pipeline(t *testing.T) {
+	h, stub := newE2EServer(t, 10*time.Second)
+	tok := login(t, h, "e2e")
+	id := doneTask(t, h, tok)
+
+	form := stub.LastForm("/idphoto")
+	if form.Get("height") != "472" || form.Get("width") != "354" || form.Get("dpi") != "300" || form.Get("hd") != "true" {
+		t.Fatalf("/idphoto form = %v", form)
+	}
+	if form := stub.LastForm("/add_background"); form.Get("color") != "ffffff" || form.Get("render") != "0" {
+		t.Fatalf("/add_background form = %v", form)
+	}
+
+	if rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/background", tok, map[string]any{"color": "blue"}); rec.Code != http.StatusOK {
+		t.Fatalf("background: %d %v", rec.Code, body)
+	}
+	if got := stub.LastForm("/add_background").Get("color"); got != "638cce" {
+		t.Fatalf("background color sent = %q", got)
+	}
+
+	rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/layout", tok, map[string]any{"color": "blue"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("layout: %d %v", rec.Code, body)
+	}
+	if form := stub.LastForm("/generate_layout_photos"); form.Get("height") != "472" || form.Get("width") != "354" {
+		t.Fatalf("/generate_layout_photos form = %v", form)
+	}
+	req := httptest.NewRequest(http.MethodGet, body["url"].(string), nil)
+	get := httptest.NewRecorder()
+	h.ServeHTTP(get, req)
+	img, err := jpeg.Decode(get.Body)
+	if err != nil {
+		t.Fatalf("layout asset: %d %v", get.Code, err)
+	}
+	if b := img.Bounds(); b.Dx() != 1205 || b.Dy() != 1795 {
+		t.Fatalf("layout sheet = %v", b)
+	}
+
+	for _, bad := range []map[string]any{
+		{"color": "blue", "paper": "a4", "dpi": 100000},
+		{"color": "blue", "widthPx": -354},
+		{"color": "blue", "widthPx": 4000, "heightPx": 6000},
+	} {
+		if rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/layout", tok, bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("layout %v: want 400, got %d %v", bad, rec.Code, body)
+		}
+	}
+}
+
+func TestE2E_TransientErrorIsRetried(t *testing.T) {
+	h, stub := newE2EServer(t, 10*time.Second)
+	stub.Inject(algostub.Fault{Path: "/idphoto", Status: http.StatusInternalServerError, Times: 1})
+	doneTask(t, h, login(t, h, "e2e"))
+	if n := stub.Calls("/idphoto"); n != 2 {
+		t.Fatalf("/idphoto calls = %d, want 2", n)
+	}
+}
+
+func TestE2E_ServerErrors(t *testing.T) {
+	h, stub := newE2EServer(t, 10*time.Second)
+	tok := login(t, h, "e2e")
+
+	stub.Inject(algostub.Fault{Path: "/idphoto", Status: http.StatusInternalServerError, Times: 2})
+	id := createTask(t, h, tok, "passport", uploadPhoto(t, h, tok, "me.jpg", testJPEG(600, 800)))
+	if task := waitTask(t, h, tok, id); task["status"] != "failed" || !strings.Contains(task["errorMsg"].(string), "status 500") {
+		t.Fatalf("task after persistent 500 = %v", task)
+	}
+
+	id = doneTask(t, h, tok)
+	stub.Inject(algostub.Fault{Path: "/add_background", Status: http.StatusBadGateway})
+	rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/background", tok, map[string]any{"color": "red"})
+	if rec.Code != http.StatusServiceUnavailable || errCode(body) != "AlgoUnavailable" {
+		t.Fatalf("background with failing algo = %d %v", rec.Code, body)
+	}
+}
+
+func TestE2E_LatencyTimesOut(t *testing.T) {
+	h, stub := newE2EServer(t, 300*time.Millisecond)
+	tok := login(t, h, "e2e")
+
+	stub.Inject(algostub.Fault{Path: "/idphoto", LatencyMs: 5000})
+	start := time.Now()
+	id := createTask(t, h, tok, "passport", uploadPhoto(t, h, tok, "me.jpg", testJPEG(600, 800)))
+	if task := waitTask(t, h, tok, id); task["status"] != "failed" || !strings.Contains(task["errorMsg"].(string), "Timeout") {
+		t.Fatalf("task with slow algo = %v", task)
+	}
+	if d := time.Since(start); d > 4*time.Second {
+		t.Fatalf("timeout not applied, took %v", d)
+	}
+	if n := stub.Calls("/idphoto"); n != 2 {
+		t.Fatalf("timeouts should be retried once: /idphoto calls = %d", n)
+	}
+}
+
+func TestE2E_MalformedResponses(t *testing.T) {
+	h, stub := newE2EServer(t, 10*time.Second)
+	tok := login(t, h, "e2e")
+
+	stub.Inject(algostub.Fault{Path: "/idphoto", BadBase64: true, Times: 1})
+	id := createTask(t, h, tok, "passport", uploadPhoto(t, h, tok, "me.jpg", testJPEG(600, 800)))
+	if task := waitTask(t, h, tok, id); task["status"] != "failed" || !strings.Contains(task["errorMsg"].(string), "decode baseline") {
+		t.Fatalf("task after bad base64 = %v", task)
+	}
+
+	id = doneTask(t, h, tok)
+	stub.Inject(algostub.Fault{Path: "/add_background", BadBase64: true})
+	rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/background", tok, map[string]any{"color": "blue"})
+	if rec.Code != http.StatusBadGateway || errCode(body) != "AlgoError" {
+		t.Fatalf("background with bad base64 = %d %v", rec.Code, body)
+	}
+
+	// The service answers 200 with status false when it cannot use the input.
+	stub.Inject(algostub.Fault{Path: "/idphoto", Reject: "no face detected", Times: 1})
+	id = createTask(t, h, tok, "passport", uploadPhoto(t, h, tok, "me.jpg", testJPEG(600, 800)))
+	if task := waitTask(t, h, tok, id); task["status"] != "failed" || !strings.Contains(task["errorMsg"].(string), "no face detected") {
+		t.Fatalf("task rejected by algo = %v", task)
+	}
+	if n := stub.Calls("/idphoto"); n != 3 {
+		t.Fatalf("status false must not be retried: /idphoto calls = %d", n)
+	}
+}
+
+func TestE2E_QualityCheck(t *testing.T) {
+	h, stub := newE2EServer(t, 10*time.Second)
+	tok := login(t, h, "e2e")
+	key := uploadPhoto(t, h, tok, "me.jpg", testJPEG(600, 800))
+	path := "/api/uploads/" + strings.TrimPrefix(key, "uploads/") + "/check"
+	rules := func(body map[string]any) map[string]any {
+		out := map[string]any{}
+		list, _ := body["rules"].([]any)
+		for _, r := range list {
+			m := r.(map[string]any)
+			out[m["rule"].(string)] = m["status"]
+		}
+		return out
+	}
+
+	// The stub reports one well-placed face; the all-black photo is dark.
+	rec, body := doJSON(t, h, http.MethodPost, path, tok, nil)
+	if rec.Code != http.StatusOK || body["specCode"] != "passport" || body["faceCount"] != float64(1) || body["result"] != "fail" {
+		t.Fatalf("check = %d %v", rec.Code, body)
+	}
+	if r := rules(body); r["face_count"] != "pass" || r["tilt"] != "pass" || r["brightness"] != "fail" {
+		t.Fatalf("rules = %v", r)
+	}
+	if stub.Calls("/detect_faces") != 1 {
+		t.Fatalf("/detect_faces calls = %d", stub.Calls("/detect_faces"))
+	}
+
+	stub.SetFaces([]algo.Face{{X: 100, Y: 100, Width: 180, Height: 230, Roll: 14}, {X: 400, Y: 120, Width: 90, Height: 110}})
+	rec, body = doJSON(t, h, http.MethodPost, path, tok, map[string]any{"specCode": "cn_1inch"})
+	if r := rules(body); rec.Code != http.StatusOK || body["faceCount"] != float64(2) || r["face_count"] != "fail" || r["tilt"] != "fail" {
+		t.Fatalf("two tilted faces = %d %v", rec.Code, body)
+	}
+
+	// A detector outage only skips the face rules.
+	stub.Inject(algostub.Fault{Path: "/detect_faces", Status: http.StatusInternalServerError})
+	rec, body = doJSON(t, h, http.MethodPost, path, tok, nil)
+	if r := rules(body); rec.Code != http.StatusOK || body["faceCount"] != nil || r["face_count"] != "skip" || r["blur"] == "skip" {
+		t.Fatalf("check without detector = %d %v", rec.Code, body)
+	}
+
+	if rec, body := doJSON(t, h, http.MethodPost, "/api/uploads/missing.jpg/check", tok, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("missing upload = %d %v", rec.Code, body)
+	}
+	if rec, body := doJSON(t, h, http.MethodPost, path, login(t, h, "someone-else"), nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("other user's upload = %d %v", rec.Code, body)
+	}
+	if rec, body := doJSON(t, h, http.MethodPost, path, tok, map[string]any{"specCode": "nope"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown spec = %d %v", rec.Code, body)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, path, "", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("check without token = %d", rec.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+const readyCheckTimeout = 2 * time.Second
+
+// pingRetry calls ping up to attempts times, sleeping interval between
+// failures, and returns the last error.
+func pingRetry(ctx context.Context, ping func(context.Context) error, attempts int, interval time.Duration) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = ping(ctx); err == nil {
+			return nil
+		}
+		if i == attempts-1 {
+			break
+		}
+		log.Printf("database ping %d/%d failed: %v", i+1, attempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	return err
+}
+
+type checkResult struct {
+	Status    string `json:"status"`
+	Mode      string `json:"mode,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+func runCheck(ctx context.Context, fn func(context.Context) error) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := fn(ctx)
+	res := checkResult{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status = "down"
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// handleHealthz is the liveness probe: the process is up and serving.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.json(w, r, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// handleReadyz reports the database and the algo service. Only the database
+// gates readiness (503); an unreachable algo service marks the instance
+// degraded since orders, downloads and payments still work without it.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	db := checkResult{Status: "ok", Mode: "memory"}
+	if s.pg != nil {
+		db = runCheck(ctx, s.pg.Ping)
+		db.Mode = "postgres"
+	}
+	al := runCheck(ctx, s.algo.Ping)
+	al.Mode = s.cfg.AlgoMode
+
+	status, code := "ok", http.StatusOK
+	if al.Status != "ok" {
+		status = "degraded"
+	}
+	if db.Status != "ok" {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	s.json(w, r, code, map[string]any{
+		"status":      status,
+		"checks":      map[string]checkResult{"db": db, "algo": al},
+		"algoBreaker": s.breaker.Stats().State.String(),
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"permit-backend/internal/infrastructure/breaker"
+)
+
+// handleMetrics exposes algo breaker and task queue state in the Prometheus
+// text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	st := s.breaker.Stats()
+	var b strings.Builder
+	gauge := func(name, help string, v any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, v)
+	}
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+
+	fmt.Fprintf(&b, "# HELP permit_algo_breaker_state Algo circuit breaker state (1 for the current state).\n# TYPE permit_algo_breaker_state gauge\n")
+	for _, state := range []breaker.State{breaker.Closed, breaker.HalfOpen, breaker.Open} {
+		v := 0
+		if st.State == state {
+			v = 1
+		}
+		fmt.Fprintf(&b, "permit_algo_breaker_state{state=%q} %d\n", state.String(), v)
+	}
+	gauge("permit_algo_breaker_consecutive_failures", "Consecutive algo failures counted by the breaker.", st.ConsecutiveFailures)
+	counter("permit_algo_breaker_opened_total", "Times the algo circuit breaker opened.", st.Opened)
+	fmt.Fprintf(&b, "# HELP permit_algo_calls_total Algo calls by outcome.\n# TYPE permit_algo_calls_total counter\n")
+	fmt.Fprintf(&b, "permit_algo_calls_total{result=\"ok\"} %d\n", st.Succeeded)
+	fmt.Fprintf(&b, "permit_algo_calls_total{result=\"failed\"} %d\n", st.Failed)
+	fmt.Fprintf(&b, "permit_algo_calls_total{result=\"rejected\"} %d\n", st.Rejected)
+	gauge("permit_algo_inflight", "Algo calls currently running.", st.InFlight)
+	gauge("permit_algo_max_concurrent", "Concurrency limit for algo calls.", st.MaxConcurrent)
+	gauge("permit_task_queue_pending", "Tasks waiting for a worker.", s.pool.Pending())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(b.String()))
+}
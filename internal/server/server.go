@@ -1,51 +1,103 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"permit-backend/internal/algo"
 	"permit-backend/internal/config"
 	"permit-backend/internal/domain"
 	"permit-backend/internal/infrastructure/asset"
+	"permit-backend/internal/infrastructure/breaker"
 	"permit-backend/internal/infrastructure/repo"
 	"permit-backend/internal/infrastructure/wechat"
+	"permit-backend/internal/infrastructure/worker"
+	"permit-backend/internal/photo"
+	"permit-backend/internal/storage"
 	"permit-backend/internal/usecase"
 )
 
 type Server struct {
-	cfg      config.Config
-	engine   *gin.Engine
-	taskSvc  *usecase.TaskService
-	orderSvc *usecase.OrderService
-	authSvc  *usecase.AuthService
-	pg       *repo.PostgresRepo
+	cfg        config.Config
+	engine     *gin.Engine
+	taskSvc    *usecase.TaskService
+	orderSvc   *usecase.OrderService
+	authSvc    *usecase.AuthService
+	specSvc    *usecase.SpecService
+	colorSvc   *usecase.ColorService
+	qualitySvc *usecase.QualityService
+	uploadSvc  *usecase.UploadService
+	pg         *repo.PostgresRepo
+	algo       algoService
+	breaker    *breaker.Breaker
+	pool       *worker.Pool
+	wxPay      *wechat.PayClient
+	uploads    storage.Storage
+	previews   storage.Storage
+	private    storage.Storage
+	done       chan struct{}
+	stop       sync.Once
 }
 
-func New(cfg config.Config) *Server {
+// New wires the server for cfg. It fails when the selected storage backend
+// cannot be reached instead of silently falling back to memory.
+func New(cfg config.Config) (*Server, error) {
 	s := &Server{cfg: cfg}
+	if cfg.AssetSignKey == "" && cfg.JWTSecret == "" {
+		return nil, errors.New("asset URLs need a signing key: set PERMIT_ASSET_SIGN_KEY or PERMIT_JWT_SECRET")
+	}
+	if b := algoBudget(cfg); cfg.HTTPWriteTimeout > 0 && cfg.HTTPWriteTimeout <= b {
+		return nil, fmt.Errorf("PERMIT_HTTP_WRITE_TIMEOUT %s must exceed the %s an algorithm call may take with retries", cfg.HTTPWriteTimeout, b)
+	}
+	if !cfg.PayMock {
+		pc, err := newWechatPayClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("wechat pay: %w", err)
+		}
+		s.wxPay = pc
+	}
 
 	var taskRepo usecase.TaskRepo
 	var orderRepo usecase.OrderRepo
 	var userRepo usecase.UserRepo
+	var specRepo usecase.SpecRepo
+	var colorRepo usecase.ColorRepo
+	var uploadRepo usecase.UploadRepo
 
-	if strings.TrimSpace(cfg.PostgresDSN) != "" {
-		pg, err := repo.NewPostgresRepo(cfg.PostgresDSN)
-		if err == nil {
-			taskRepo = pg
-			orderRepo = &pgOrderRepo{pg: pg}
-			userRepo = pg
-			s.pg = pg
+	switch cfg.Storage {
+	case "postgres":
+		if strings.TrimSpace(cfg.PostgresDSN) == "" {
+			return nil, errors.New("storage postgres requires POSTGRES_DSN")
+		}
+		pg, err := openPostgres(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: %w", err)
 		}
+		taskRepo = pg
+		orderRepo = &pgOrderRepo{pg: pg}
+		userRepo = pg
+		specRepo = pg
+		colorRepo = pg
+		uploadRepo = pg
+		s.pg = pg
+	case "", "memory":
+	default:
+		return nil, fmt.Errorf("unknown storage %q (want memory or postgres)", cfg.Storage)
 	}
 	if taskRepo == nil {
 		taskRepo = repo.NewMemoryTaskRepo()
@@ -56,22 +108,78 @@ func New(cfg config.Config) *Server {
 	if userRepo == nil {
 		userRepo = repo.NewMemoryUserRepo()
 	}
+	if specRepo == nil {
+		specRepo = repo.NewMemorySpecRepo()
+	}
+	if uploadRepo == nil {
+		uploadRepo = repo.NewMemoryUploadRepo()
+	}
+	s.specSvc = &usecase.SpecService{Repo: specRepo}
+	if err := s.specSvc.Seed(usecase.DefaultSpecs()); err != nil {
+		log.Printf("seed specs failed: %v", err)
+	}
+	if colorRepo == nil {
+		colorRepo = repo.NewMemoryColorRepo()
+	}
+	s.colorSvc = &usecase.ColorService{Repo: colorRepo}
+	if err := s.colorSvc.Seed(usecase.DefaultColors()); err != nil {
+		log.Printf("seed colors failed: %v", err)
+	}
 
-	fs := asset.NewFSWriter(cfg.AssetsDir)
-	al := algoAdapter{}
+	s.uploads, s.previews, s.private = newObjectStores(cfg)
+	switch cfg.AlgoMode {
+	case "", "http":
+		s.algo = algo.NewClient(cfg.AlgoURL, cfg.AlgoTimeout, cfg.AlgoRetries, cfg.AlgoRetryBackoff)
+	case "local":
+		s.algo = algo.NewLocal()
+	default:
+		return nil, fmt.Errorf("unknown algo mode %q (want http or local)", cfg.AlgoMode)
+	}
+	s.breaker = breaker.New(cfg.AlgoBreakerThreshold, cfg.AlgoBreakerCooldown, cfg.AlgoMaxConcurrent, cfg.AlgoAcquireTimeout)
 
 	s.taskSvc = &usecase.TaskService{
-		Repo:       taskRepo,
-		Assets:     fs,
-		Algo:       al,
-		AlgoURL:    cfg.AlgoURL,
-		UploadsDir: cfg.UploadsDir,
-		AssetsDir:  cfg.AssetsDir,
+		Repo:    taskRepo,
+		Assets:  asset.NewStore(s.previews, s.private),
+		Algo:    algoAdapter{c: s.algo, b: s.breaker},
+		Uploads: s.uploads,
+	}
+	s.qualitySvc = &usecase.QualityService{Uploads: s.uploads}
+	if cfg.AlgoFaceDetect {
+		s.qualitySvc.Faces = algoAdapter{c: s.algo, b: s.breaker}
+	}
+	s.uploadSvc = &usecase.UploadService{
+		Repo:       uploadRepo,
+		Uploads:    s.uploads,
+		Photo:      s.photoOptions(),
+		MaxBytes:   cfg.UploadMaxBytes,
+		ChunkBytes: cfg.UploadChunkBytes,
+		TTL:        cfg.UploadSessionTTL,
+	}
+	s.done = make(chan struct{})
+	go s.sweepUploads(max(min(cfg.UploadSessionTTL/2, 10*time.Minute), time.Second))
+	// Queued tasks outlive the request that created them.
+	s.pool = worker.NewPool(cfg.TaskWorkers, cfg.TaskQueueSize, func(id string) {
+		s.taskSvc.ProcessTask(context.Background(), id, s.colorOf)
+	})
+	s.taskSvc.Queue = s.pool
+	// The queue lives in memory, so tasks a previous run had accepted are
+	// only in the database.
+	if s.pg != nil {
+		if ids, err := s.pg.ListUnfinishedTasks(); err != nil {
+			log.Printf("list unfinished tasks: %v", err)
+		} else if len(ids) > 0 {
+			log.Printf("resumed %d of %d unfinished tasks", s.taskSvc.Resume(ids), len(ids))
+		}
 	}
 	s.orderSvc = &usecase.OrderService{
 		Repo:        orderRepo,
 		PayMock:     cfg.PayMock,
 		WechatAppID: cfg.WechatAppID,
+		WechatMchID: cfg.WechatMchID,
+		Catalog:     s.loadPriceCatalog(),
+	}
+	if s.wxPay != nil {
+		s.orderSvc.WechatPay = s.wxPay
 	}
 	wc := &wechat.Client{AppID: cfg.WechatAppID, Secret: cfg.WechatSecret}
 	s.authSvc = &usecase.AuthService{Repo: userRepo, Wechat: wc, JWTSecret: cfg.JWTSecret}
@@ -81,7 +189,7 @@ func New(cfg config.Config) *Server {
 	s.engine.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
 		if c.Request.Method == http.MethodOptions {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
@@ -90,19 +198,64 @@ func New(cfg config.Config) *Server {
 	})
 	s.engine.Use(s.authMiddleware())
 	s.routesGin()
-	return s
+	return s, nil
+}
+
+// algoBudget is how long a request may wait on the algorithm service: a
+// breaker slot, then every attempt with the backoff between them. Local
+// mode has no timeout or retries.
+func algoBudget(cfg config.Config) time.Duration {
+	if cfg.AlgoMode == "local" {
+		return 0
+	}
+	d := cfg.AlgoAcquireTimeout
+	for i := 0; i <= cfg.AlgoRetries; i++ {
+		d += cfg.AlgoTimeout
+		if i < cfg.AlgoRetries {
+			d += cfg.AlgoRetryBackoff << i
+		}
+	}
+	return d
 }
 
 func (s *Server) Handler() http.Handler {
 	return s.engine
 }
 
+// Shutdown stops accepting tasks, waits for queued and running ones to
+// finish, then closes the database pool. The pool is closed even when ctx
+// expires first so connections are not leaked on exit. Calling it again is
+// harmless.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop.Do(func() { close(s.done) })
+	err := s.pool.Shutdown(ctx)
+	if s.pg != nil {
+		if cerr := s.pg.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 func (s *Server) routesGin() {
-	s.engine.Static("/assets", s.cfg.AssetsDir)
+	assets := func(c *gin.Context) { s.handleSignedAsset(c.Writer, c.Request, "/assets/", s.previews) }
+	s.engine.GET("/assets/*key", assets)
+	s.engine.HEAD("/assets/*key", assets)
+	files := func(c *gin.Context) { s.handleSignedAsset(c.Writer, c.Request, "/api/files/", s.private) }
+	s.engine.GET("/api/files/*key", files)
+	s.engine.HEAD("/api/files/*key", files)
+	s.engine.GET("/healthz", func(c *gin.Context) { s.handleHealthz(c.Writer, c.Request) })
+	s.engine.GET("/readyz", func(c *gin.Context) { s.handleReadyz(c.Writer, c.Request) })
+	s.engine.GET("/metrics", s.adminMiddleware(), func(c *gin.Context) { s.handleMetrics(c.Writer, c.Request) })
 	s.engine.POST("/api/login", func(c *gin.Context) { s.handleLogin(c.Writer, c.Request) })
 	s.engine.GET("/api/specs", func(c *gin.Context) { s.handleSpecs(c.Writer, c.Request) })
-	s.engine.POST("/api/specs", func(c *gin.Context) { s.handleUpdateSpecs(c.Writer, c.Request) })
+	s.engine.GET("/api/colors", func(c *gin.Context) { s.handleColors(c.Writer, c.Request) })
 	s.engine.POST("/api/upload", func(c *gin.Context) { s.handleUpload(c.Writer, c.Request) })
+	s.engine.POST("/api/uploads/:key/check", func(c *gin.Context) { s.handleCheckUpload(c.Writer, c.Request, c.Param("key")) })
+	s.engine.POST("/api/uploads/sessions", func(c *gin.Context) { s.handleInitUploadSession(c.Writer, c.Request) })
+	s.engine.GET("/api/uploads/sessions/:id", func(c *gin.Context) { s.handleGetUploadSession(c.Writer, c.Request, c.Param("id")) })
+	s.engine.PUT("/api/uploads/sessions/:id", func(c *gin.Context) { s.handlePutUploadChunk(c.Writer, c.Request, c.Param("id")) })
+	s.engine.POST("/api/uploads/sessions/:id/complete", func(c *gin.Context) { s.handleCompleteUploadSession(c.Writer, c.Request, c.Param("id")) })
 	s.engine.GET("/api/me", func(c *gin.Context) { s.handleMe(c.Writer, c.Request) })
 	s.engine.POST("/api/tasks", func(c *gin.Context) { s.handleCreateTask(c.Writer, c.Request) })
 	s.engine.GET("/api/tasks/:id", func(c *gin.Context) {
@@ -125,6 +278,8 @@ func (s *Server) routesGin() {
 		r.URL.Path = "/api/download/" + c.Param("id")
 		s.handleDownloadInfo(c.Writer, r)
 	})
+	s.engine.GET("/api/pricing", func(c *gin.Context) { s.handlePricing(c.Writer, c.Request) })
+	s.engine.POST("/api/orders/quote", func(c *gin.Context) { s.handleQuote(c.Writer, c.Request) })
 	s.engine.POST("/api/orders", func(c *gin.Context) { s.handleOrders(c.Writer, c.Request) })
 	s.engine.GET("/api/orders", func(c *gin.Context) { s.handleOrders(c.Writer, c.Request) })
 	s.engine.GET("/api/orders/:id", func(c *gin.Context) {
@@ -132,9 +287,28 @@ func (s *Server) routesGin() {
 		r.URL.Path = "/api/orders/" + c.Param("id")
 		s.handleGetOrder(c.Writer, r)
 	})
+	s.engine.GET("/api/orders/:id/transitions", func(c *gin.Context) {
+		s.handleOrderTransitions(c.Writer, c.Request, c.Param("id"))
+	})
+	s.engine.GET("/api/orders/:id/refunds", func(c *gin.Context) {
+		s.handleListRefunds(c.Writer, c.Request, c.Param("id"))
+	})
 	s.engine.POST("/api/pay/wechat", func(c *gin.Context) { s.handlePayWechat(c.Writer, c.Request) })
 	s.engine.POST("/api/pay/douyin", func(c *gin.Context) { s.handlePayDouyin(c.Writer, c.Request) })
+	s.engine.POST("/api/pay/wechat/notify", func(c *gin.Context) { s.handleWechatPayNotify(c.Writer, c.Request) })
+	s.engine.POST("/api/pay/wechat/refund-notify", func(c *gin.Context) { s.handleWechatRefundNotify(c.Writer, c.Request) })
 	s.engine.POST("/api/pay/callback", func(c *gin.Context) { s.handlePayCallback(c.Writer, c.Request) })
+
+	admin := s.engine.Group("/api/admin", s.adminMiddleware())
+	admin.GET("/specs", func(c *gin.Context) { s.handleAdminListSpecs(c.Writer, c.Request) })
+	admin.POST("/specs", func(c *gin.Context) { s.handleAdminSaveSpec(c.Writer, c.Request, "") })
+	admin.PUT("/specs/:code", func(c *gin.Context) { s.handleAdminSaveSpec(c.Writer, c.Request, c.Param("code")) })
+	admin.POST("/specs/:code/disable", func(c *gin.Context) { s.handleAdminSetSpecDisabled(c.Writer, c.Request, c.Param("code"), true) })
+	admin.POST("/specs/:code/enable", func(c *gin.Context) { s.handleAdminSetSpecDisabled(c.Writer, c.Request, c.Param("code"), false) })
+	admin.DELETE("/specs/:code", func(c *gin.Context) { s.handleAdminDeleteSpec(c.Writer, c.Request, c.Param("code")) })
+	admin.PUT("/colors/:name", func(c *gin.Context) { s.handleAdminSaveColor(c.Writer, c.Request, c.Param("name")) })
+	admin.DELETE("/colors/:name", func(c *gin.Context) { s.handleAdminDeleteColor(c.Writer, c.Request, c.Param("name")) })
+	admin.POST("/orders/:id/refund", func(c *gin.Context) { s.handleRefund(c.Writer, c.Request, c.Param("id")) })
 }
 
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -153,29 +327,92 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer f.Close()
 	name := filepath.Base(hdr.Filename)
-	if !validImageName(name) {
-		s.err(w, r, http.StatusBadRequest, "BadRequest", "only jpg/png allowed")
+	if !s.validImageName(name) {
+		s.rejectImage(w, r, &photo.Rejection{Reason: photo.ReasonUnsupported, Message: s.imageNameHint()})
 		return
 	}
-	id := randomID()
-	outName := id + "_" + name
-	outPath := filepath.Join(s.cfg.UploadsDir, outName)
-	if err := os.MkdirAll(s.cfg.UploadsDir, 0o755); err != nil {
-		s.err(w, r, http.StatusInternalServerError, "ServerError", "cannot create uploads dir")
+	data, err := io.ReadAll(f)
+	if err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "cannot read file")
 		return
 	}
-	dst, err := os.Create(outPath)
+	img, err := photo.Normalize(r.Context(), data, s.photoOptions())
+	var rej *photo.Rejection
+	if errors.As(err, &rej) {
+		s.rejectImage(w, r, rej)
+		return
+	}
+	if err != nil {
+		log.Printf("normalize upload %s: %v", name, err)
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "cannot process image")
+		return
+	}
+	up, err := s.uploadSvc.Store(r.Context(), userIDFrom(r), name, img)
 	if err != nil {
+		log.Printf("store upload %s: %v", name, err)
 		s.err(w, r, http.StatusInternalServerError, "ServerError", "cannot save file")
 		return
 	}
-	defer dst.Close()
-	if _, err := io.Copy(dst, f); err != nil {
-		s.err(w, r, http.StatusInternalServerError, "ServerError", "cannot write file")
+	s.json(w, r, http.StatusOK, map[string]any{
+		"objectKey": up.ObjectKey,
+		"width":     img.Width,
+		"height":    img.Height,
+	})
+}
+
+type checkUploadReq struct {
+	SpecCode string `json:"specCode"`
+}
+
+// handleCheckUpload runs the quality pre-check on one of the caller's
+// uploads against a spec (passport by default). The body is optional.
+func (s *Server) handleCheckUpload(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodPost {
+		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST accepted")
+		return
+	}
+	key = strings.TrimPrefix(key, "uploads/")
+	if key == "" || strings.Contains(key, "..") || strings.ContainsAny(key, "/\\") {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid upload key")
+		return
+	}
+	if _, err := s.uploadSvc.Owned(userIDFrom(r), "uploads/"+key); err != nil {
+		s.uploadErr(w, r, err)
+		return
+	}
+	var req checkUploadReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
+		return
+	}
+	spec, err := s.specSvc.Find(orDefault(req.SpecCode, "passport"))
+	if err != nil {
+		s.catalogErr(w, r, err)
+		return
+	}
+	rep, err := s.qualitySvc.Check(r.Context(), "uploads/"+key, spec)
+	if err != nil {
+		s.taskErr(w, r, err, "cannot check upload")
 		return
 	}
-	objKey := "uploads/" + outName
-	s.json(w, r, http.StatusOK, map[string]string{"objectKey": objKey})
+	s.json(w, r, http.StatusOK, rep)
+}
+
+func (s *Server) photoOptions() photo.Options {
+	return photo.Options{
+		MaxDimension:    s.cfg.UploadMaxDimension,
+		MaxPixels:       s.cfg.UploadMaxPixels,
+		MinDimension:    s.cfg.UploadMinDimension,
+		ConvertCmd:      strings.Fields(s.cfg.ImageConvertCmd),
+		ConvertTimeout:  s.cfg.ImageConvertTimeout,
+		ConvertMaxBytes: s.cfg.ImageConvertMaxBytes,
+	}
+}
+
+// rejectImage answers 400 InvalidImage with the rejection reason so
+// clients can tell the user what to fix.
+func (s *Server) rejectImage(w http.ResponseWriter, r *http.Request, rej *photo.Rejection) {
+	s.errDetail(w, r, http.StatusBadRequest, "InvalidImage", rej.Message, map[string]any{"reason": rej.Reason})
 }
 
 type createTaskReq struct {
@@ -197,20 +434,15 @@ type generateBackgroundReq struct {
 }
 
 type generateLayoutReq struct {
-	Color    string `json:"color"`
-	WidthPx  int    `json:"widthPx"`
-	HeightPx int    `json:"heightPx"`
-	DPI      int    `json:"dpi"`
-	KB       int    `json:"kb"`
-}
-
-type Spec struct {
-	Code     string   `json:"code"`
-	Name     string   `json:"name"`
-	WidthPx  int      `json:"widthPx"`
-	HeightPx int      `json:"heightPx"`
-	DPI      int      `json:"dpi"`
-	BgColors []string `json:"bgColors"`
+	Color         string  `json:"color"`
+	WidthPx       int     `json:"widthPx"`
+	HeightPx      int     `json:"heightPx"`
+	DPI           int     `json:"dpi"`
+	KB            int     `json:"kb"`
+	Paper         string  `json:"paper"`
+	PaperWidthMM  float64 `json:"paperWidthMm"`
+	PaperHeightMM float64 `json:"paperHeightMm"`
+	Copies        int     `json:"copies"`
 }
 
 type createOrderReq struct {
@@ -227,53 +459,133 @@ func (s *Server) handleSpecs(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET accepted")
 		return
 	}
-	if s.pg != nil {
-		if items, err := s.pg.ListSpecs(); err == nil && len(items) > 0 {
-			out := make([]Spec, 0, len(items))
-			for _, it := range items {
-				out = append(out, Spec{
-					Code: it.Code, Name: it.Name, WidthPx: it.WidthPx, HeightPx: it.HeightPx, DPI: it.DPI, BgColors: it.BgColors,
-				})
-			}
-			s.json(w, r, http.StatusOK, out)
-			return
-		}
+	items, err := s.specSvc.List(false)
+	if err != nil {
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "list specs failed")
+		return
 	}
-	s.json(w, r, http.StatusOK, s.defaultSpecs())
+	s.json(w, r, http.StatusOK, items)
 }
 
-func (s *Server) defaultSpecs() []Spec {
-	return []Spec{
-		{Code: "passport", Name: "护照", WidthPx: 354, HeightPx: 472, DPI: 300, BgColors: []string{"white", "blue", "red"}},
-		{Code: "cn_1inch", Name: "一寸", WidthPx: 295, HeightPx: 413, DPI: 300, BgColors: []string{"white", "blue", "red", "tint", "grey", "gradient", "dark_blue", "sky_blue"}},
-		{Code: "cn_2inch", Name: "二寸", WidthPx: 413, HeightPx: 579, DPI: 300, BgColors: []string{"white", "blue", "red", "tint", "grey", "gradient", "dark_blue", "sky_blue"}},
-		{Code: "cn_2inch_small", Name: "小二寸", WidthPx: 413, HeightPx: 531, DPI: 300, BgColors: []string{"white", "blue", "red", "tint", "grey", "gradient", "dark_blue", "sky_blue"}},
-		{Code: "cn_1inch_large", Name: "大一寸", WidthPx: 390, HeightPx: 567, DPI: 300, BgColors: []string{"white", "blue", "red", "tint", "grey", "gradient", "dark_blue", "sky_blue"}},
+func (s *Server) handleAdminListSpecs(w http.ResponseWriter, r *http.Request) {
+	items, err := s.specSvc.List(true)
+	if err != nil {
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "list specs failed")
+		return
 	}
+	s.json(w, r, http.StatusOK, items)
 }
 
-func (s *Server) handleUpdateSpecs(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST accepted")
+func (s *Server) handleAdminSaveSpec(w http.ResponseWriter, r *http.Request, code string) {
+	var req domain.SpecDef
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
 		return
 	}
-	if s.pg == nil {
-		s.err(w, r, http.StatusNotImplemented, "NotImplemented", "PostgreSQL not configured")
+	var sp domain.SpecDef
+	var err error
+	if code == "" {
+		sp, err = s.specSvc.Create(req)
+	} else {
+		sp, err = s.specSvc.Update(code, req)
+	}
+	if err != nil {
+		s.catalogErr(w, r, err)
 		return
 	}
-	siteBg := []string{"blue", "white", "red", "tint", "grey", "gradient", "dark_blue", "sky_blue"}
-	specs := []domain.SpecDef{
-		{Code: "cn_1inch", Name: "一寸", WidthPx: 295, HeightPx: 413, DPI: 300, BgColors: siteBg},
-		{Code: "cn_2inch", Name: "二寸", WidthPx: 413, HeightPx: 579, DPI: 300, BgColors: siteBg},
-		{Code: "cn_2inch_small", Name: "小二寸", WidthPx: 413, HeightPx: 531, DPI: 300, BgColors: siteBg},
-		{Code: "cn_1inch_large", Name: "大一寸", WidthPx: 390, HeightPx: 567, DPI: 300, BgColors: siteBg},
-		{Code: "cn_social_security", Name: "社保证（300dpi，无回执）", WidthPx: 358, HeightPx: 441, DPI: 300, BgColors: []string{"white"}},
+	s.json(w, r, http.StatusOK, sp)
+}
+
+func (s *Server) handleAdminSetSpecDisabled(w http.ResponseWriter, r *http.Request, code string, disabled bool) {
+	sp, err := s.specSvc.SetDisabled(code, disabled)
+	if err != nil {
+		s.catalogErr(w, r, err)
+		return
 	}
-	if err := s.pg.UpsertSpecs(specs); err != nil {
-		s.err(w, r, http.StatusInternalServerError, "ServerError", "update specs failed")
+	s.json(w, r, http.StatusOK, sp)
+}
+
+func (s *Server) handleAdminDeleteSpec(w http.ResponseWriter, r *http.Request, code string) {
+	if err := s.specSvc.Delete(code); err != nil {
+		s.catalogErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, map[string]any{"deleted": code})
+}
+
+func (s *Server) handleColors(w http.ResponseWriter, r *http.Request) {
+	items, err := s.colorSvc.List()
+	if err != nil {
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "list colors failed")
 		return
 	}
-	s.json(w, r, http.StatusOK, map[string]any{"updated": len(specs)})
+	s.json(w, r, http.StatusOK, items)
+}
+
+func (s *Server) handleAdminSaveColor(w http.ResponseWriter, r *http.Request, name string) {
+	var req domain.Color
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
+		return
+	}
+	req.Name = name
+	c, err := s.colorSvc.Save(req)
+	if err != nil {
+		s.catalogErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, c)
+}
+
+func (s *Server) handleAdminDeleteColor(w http.ResponseWriter, r *http.Request, name string) {
+	if err := s.colorSvc.Delete(name); err != nil {
+		s.catalogErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, map[string]any{"deleted": name})
+}
+
+func (s *Server) catalogErr(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.(type) {
+	case usecase.ErrBadRequest:
+		s.err(w, r, http.StatusBadRequest, "BadRequest", err.Error())
+	case usecase.ErrNotFound:
+		s.err(w, r, http.StatusNotFound, "NotFound", err.Error())
+	case usecase.ErrConflict:
+		s.err(w, r, http.StatusConflict, "Conflict", err.Error())
+	default:
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "catalog request failed")
+	}
+}
+
+// taskErr maps errors from on-demand task rendering. An unreachable or
+// tripped algo service is 503 AlgoUnavailable; other algo failures surface
+// as 502 with the service's own message.
+func (s *Server) taskErr(w http.ResponseWriter, r *http.Request, err error, fallback string) {
+	var ae *algo.Error
+	if algo.IsUnavailable(err) {
+		s.algoUnavailable(w, r, err.Error())
+		return
+	}
+	switch e := err.(type) {
+	case usecase.ErrNotFound:
+		s.err(w, r, http.StatusNotFound, "NotFound", e.Error())
+	case usecase.ErrBadRequest:
+		s.err(w, r, http.StatusBadRequest, "BadRequest", e.Error())
+	case usecase.ErrUpstream:
+		s.err(w, r, http.StatusBadGateway, "AlgoError", e.Error())
+	default:
+		if errors.As(err, &ae) {
+			s.err(w, r, http.StatusBadGateway, "AlgoError", ae.Error())
+			return
+		}
+		s.err(w, r, http.StatusInternalServerError, "ServerError", fallback)
+	}
+}
+
+func (s *Server) algoUnavailable(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.cfg.AlgoBreakerCooldown/time.Second)))
+	s.err(w, r, http.StatusServiceUnavailable, "AlgoUnavailable", msg)
 }
 
 type loginReq struct {
@@ -307,14 +619,8 @@ func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET accepted")
 		return
 	}
-	authz := r.Header.Get("Authorization")
-	if !strings.HasPrefix(strings.ToLower(authz), "bearer ") {
-		s.err(w, r, http.StatusUnauthorized, "Unauthorized", "token required")
-		return
-	}
-	tk := strings.TrimSpace(authz[7:])
-	uid, oid, err := s.authSvc.Verify(tk)
-	if err != nil || strings.TrimSpace(uid) == "" || strings.TrimSpace(oid) == "" {
+	uid, oid := userIDFrom(r), openIDFrom(r)
+	if strings.TrimSpace(uid) == "" || strings.TrimSpace(oid) == "" {
 		s.err(w, r, http.StatusUnauthorized, "Unauthorized", "token invalid")
 		return
 	}
@@ -331,17 +637,6 @@ func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
 	s.json(w, r, http.StatusOK, u)
 }
 
-func (s *Server) findSpec(code string) Spec {
-	code = strings.TrimSpace(strings.ToLower(code))
-	specs := s.defaultSpecs()
-	for _, sp := range specs {
-		if strings.ToLower(sp.Code) == code {
-			return sp
-		}
-	}
-	return specs[0]
-}
-
 func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		var req createOrderReq
@@ -353,12 +648,12 @@ func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
 			s.err(w, r, http.StatusBadRequest, "BadRequest", "taskId required")
 			return
 		}
-		if _, ok := s.taskSvc.Repo.Get(req.TaskID); !ok {
+		if _, err := s.taskSvc.GetForUser(userIDFrom(r), req.TaskID); err != nil {
 			s.err(w, r, http.StatusBadRequest, "BadRequest", "task not found")
 			return
 		}
-		if req.AmountCents <= 0 {
-			s.err(w, r, http.StatusBadRequest, "BadRequest", "amountCents required")
+		if req.AmountCents < 0 {
+			s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid amountCents")
 			return
 		}
 		if len(req.Items) == 0 {
@@ -372,6 +667,7 @@ func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		o := &domain.Order{
+			UserID:      userIDFrom(r),
 			TaskID:      req.TaskID,
 			Items:       req.Items,
 			City:        req.City,
@@ -379,8 +675,16 @@ func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
 			AmountCents: req.AmountCents,
 			Channel:     orDefault(req.Channel, "wechat"),
 		}
-		id, _ := s.orderSvc.Create(o)
-		s.json(w, r, http.StatusOK, map[string]any{"orderId": id, "status": string(o.Status)})
+		id, err := s.orderSvc.Create(o)
+		if err != nil {
+			if _, ok := err.(usecase.ErrBadRequest); ok {
+				s.err(w, r, http.StatusBadRequest, "BadRequest", err.Error())
+				return
+			}
+			s.err(w, r, http.StatusInternalServerError, "ServerError", "create order failed")
+			return
+		}
+		s.json(w, r, http.StatusOK, map[string]any{"orderId": id, "status": string(o.Status), "amountCents": o.AmountCents})
 		return
 	}
 	if r.Method == http.MethodGet {
@@ -397,13 +701,44 @@ func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
 				pageSize = i
 			}
 		}
-		items, total := s.orderSvc.Repo.List(page, pageSize)
+		items, total := s.orderSvc.Repo.List(userIDFrom(r), page, pageSize)
 		s.json(w, r, http.StatusOK, map[string]any{"items": items, "page": page, "pageSize": pageSize, "total": total})
 		return
 	}
 	s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET/POST accepted")
 }
 
+func (s *Server) handlePricing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET accepted")
+		return
+	}
+	s.json(w, r, http.StatusOK, s.orderSvc.Catalog)
+}
+
+type quoteReq struct {
+	Items []domain.OrderItem `json:"items"`
+	City  string             `json:"city"`
+}
+
+func (s *Server) handleQuote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST accepted")
+		return
+	}
+	var req quoteReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
+		return
+	}
+	amount, err := s.orderSvc.Quote(req.Items, req.City)
+	if err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	s.json(w, r, http.StatusOK, map[string]any{"amountCents": amount})
+}
+
 func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only GET accepted")
@@ -414,14 +749,83 @@ func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "order id required")
 		return
 	}
-	o, ok := s.orderSvc.Repo.Get(id)
+	o, ok := s.ownedOrder(w, r, id)
 	if !ok {
-		s.err(w, r, http.StatusNotFound, "NotFound", "order not found")
 		return
 	}
 	s.json(w, r, http.StatusOK, o)
 }
 
+func (s *Server) handleOrderTransitions(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := s.ownedOrder(w, r, id); !ok {
+		return
+	}
+	items, err := s.orderSvc.Transitions(id)
+	if err != nil {
+		if _, ok := err.(usecase.ErrNotFound); ok {
+			s.err(w, r, http.StatusNotFound, "NotFound", "order not found")
+			return
+		}
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "list transitions failed")
+		return
+	}
+	s.json(w, r, http.StatusOK, map[string]any{"orderId": id, "items": items})
+}
+
+type refundReq struct {
+	AmountCents int    `json:"amountCents"`
+	Reason      string `json:"reason"`
+}
+
+// handleRefund is admin-only: a customer asks for a refund through support,
+// not by refunding their own order.
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request, id string) {
+	var req refundReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
+		return
+	}
+	if req.AmountCents < 0 {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "amountCents must not be negative")
+		return
+	}
+	rf, err := s.orderSvc.Refund(id, req.AmountCents, strings.TrimSpace(req.Reason))
+	if err != nil {
+		switch err.(type) {
+		case usecase.ErrNotFound:
+			s.err(w, r, http.StatusNotFound, "NotFound", "order not found")
+		case usecase.ErrBadRequest:
+			s.err(w, r, http.StatusBadRequest, "BadRequest", err.Error())
+		case usecase.ErrInvalidTransition:
+			s.err(w, r, http.StatusConflict, "InvalidTransition", err.Error())
+		case usecase.ErrNotImplemented:
+			s.err(w, r, http.StatusNotImplemented, "NotImplemented", err.Error())
+		case usecase.ErrUpstream:
+			s.err(w, r, http.StatusBadGateway, "WechatError", err.Error())
+		default:
+			s.err(w, r, http.StatusInternalServerError, "ServerError", "refund failed")
+		}
+		return
+	}
+	s.json(w, r, http.StatusOK, rf)
+}
+
+func (s *Server) handleListRefunds(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := s.ownedOrder(w, r, id); !ok {
+		return
+	}
+	items, err := s.orderSvc.Refunds(id)
+	if err != nil {
+		if _, ok := err.(usecase.ErrNotFound); ok {
+			s.err(w, r, http.StatusNotFound, "NotFound", "order not found")
+			return
+		}
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "list refunds failed")
+		return
+	}
+	s.json(w, r, http.StatusOK, map[string]any{"orderId": id, "items": items})
+}
+
 type payReq struct {
 	OrderID string `json:"orderId"`
 }
@@ -453,11 +857,10 @@ func (s *Server) handlePay(w http.ResponseWriter, r *http.Request, channel strin
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "orderId required")
 		return
 	}
-	if !s.cfg.PayMock {
-		s.err(w, r, http.StatusNotImplemented, "NotImplemented", "real payment not configured")
+	if _, ok := s.ownedOrder(w, r, req.OrderID); !ok {
 		return
 	}
-	p, err := s.orderSvc.Pay(req.OrderID, channel, idempotencyKey)
+	p, err := s.orderSvc.Pay(req.OrderID, channel, idempotencyKey, openIDFrom(r))
 	if err != nil {
 		switch err.(type) {
 		case usecase.ErrNotFound:
@@ -466,6 +869,12 @@ func (s *Server) handlePay(w http.ResponseWriter, r *http.Request, channel strin
 			s.err(w, r, http.StatusConflict, "Conflict", err.Error())
 		case usecase.ErrBadRequest:
 			s.err(w, r, http.StatusBadRequest, "BadRequest", err.Error())
+		case usecase.ErrInvalidTransition:
+			s.err(w, r, http.StatusConflict, "InvalidTransition", err.Error())
+		case usecase.ErrNotImplemented:
+			s.err(w, r, http.StatusNotImplemented, "NotImplemented", err.Error())
+		case usecase.ErrUpstream:
+			s.err(w, r, http.StatusBadGateway, "WechatError", err.Error())
 		default:
 			s.err(w, r, http.StatusInternalServerError, "ServerError", "payment failed")
 		}
@@ -491,6 +900,10 @@ func (s *Server) handlePayCallback(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "Idempotency-Key required")
 		return
 	}
+	if !s.cfg.PayMock {
+		s.err(w, r, http.StatusForbidden, "Forbidden", "use /api/pay/wechat/notify for real payments")
+		return
+	}
 	var req payCallbackReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
@@ -506,6 +919,8 @@ func (s *Server) handlePayCallback(w http.ResponseWriter, r *http.Request) {
 			s.err(w, r, http.StatusNotFound, "NotFound", "order not found")
 		case usecase.ErrBadRequest:
 			s.err(w, r, http.StatusBadRequest, "BadRequest", err.Error())
+		case usecase.ErrInvalidTransition:
+			s.err(w, r, http.StatusConflict, "InvalidTransition", err.Error())
 		default:
 			s.err(w, r, http.StatusInternalServerError, "ServerError", "callback failed")
 		}
@@ -513,6 +928,92 @@ func (s *Server) handlePayCallback(w http.ResponseWriter, r *http.Request) {
 	}
 	s.json(w, r, http.StatusOK, map[string]any{"ok": true})
 }
+
+func (s *Server) handleWechatPayNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.wechatNotifyFail(w, r, http.StatusMethodNotAllowed, "only POST accepted")
+		return
+	}
+	if s.wxPay == nil {
+		s.wechatNotifyFail(w, r, http.StatusNotImplemented, "wechat pay not configured")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		s.wechatNotifyFail(w, r, http.StatusBadRequest, "read body failed")
+		return
+	}
+	tx, err := s.wxPay.ParseTransactionNotify(r.Header, body)
+	if err != nil {
+		s.wechatNotifyFail(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+	err = s.orderSvc.ConfirmPayment(usecase.PayNotification{
+		OutTradeNo:    tx.OutTradeNo,
+		TransactionID: tx.TransactionID,
+		MchID:         tx.MchID,
+		TradeState:    tx.TradeState,
+		AmountCents:   tx.Amount.Total,
+	})
+	if err != nil {
+		switch err.(type) {
+		case usecase.ErrNotFound:
+			s.wechatNotifyFail(w, r, http.StatusNotFound, "order not found")
+		case usecase.ErrBadRequest:
+			s.wechatNotifyFail(w, r, http.StatusBadRequest, err.Error())
+		case usecase.ErrInvalidTransition:
+			s.wechatNotifyFail(w, r, http.StatusConflict, err.Error())
+		default:
+			s.wechatNotifyFail(w, r, http.StatusInternalServerError, "confirm payment failed")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleWechatRefundNotify(w http.ResponseWriter, r *http.Request) {
+	if s.wxPay == nil {
+		s.wechatNotifyFail(w, r, http.StatusNotImplemented, "wechat pay not configured")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		s.wechatNotifyFail(w, r, http.StatusBadRequest, "read body failed")
+		return
+	}
+	rr, err := s.wxPay.ParseRefundNotify(r.Header, body)
+	if err != nil {
+		s.wechatNotifyFail(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+	err = s.orderSvc.ConfirmRefund(usecase.RefundNotification{
+		OutRefundNo: rr.OutRefundNo,
+		RefundID:    rr.RefundID,
+		MchID:       rr.MchID,
+		Status:      rr.RefundStatus,
+		AmountCents: rr.Amount.Refund,
+	})
+	if err != nil {
+		switch err.(type) {
+		case usecase.ErrNotFound:
+			s.wechatNotifyFail(w, r, http.StatusNotFound, err.Error())
+		case usecase.ErrBadRequest:
+			s.wechatNotifyFail(w, r, http.StatusBadRequest, err.Error())
+		case usecase.ErrInvalidTransition:
+			s.wechatNotifyFail(w, r, http.StatusConflict, err.Error())
+		default:
+			s.wechatNotifyFail(w, r, http.StatusInternalServerError, "confirm refund failed")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) wechatNotifyFail(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	log.Printf("wechat notify %s %d %s", r.URL.Path, status, msg)
+	s.json(w, r, status, map[string]string{"code": "FAIL", "message": msg})
+}
+
 func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		s.err(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "only POST accepted")
@@ -527,23 +1028,25 @@ func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "sourceObjectKey required")
 		return
 	}
-	userID := "dev-user"
-	authz := r.Header.Get("Authorization")
-	if strings.HasPrefix(strings.ToLower(authz), "bearer ") {
-		tk := strings.TrimSpace(authz[7:])
-		if uid, _, err := s.authSvc.Verify(tk); err == nil && strings.TrimSpace(uid) != "" {
-			userID = uid
-		}
+	userID := userIDFrom(r)
+	if _, err := s.uploadSvc.Owned(userID, req.SourceObjectKey); err != nil {
+		s.uploadErr(w, r, err)
+		return
+	}
+	spec, err := s.specSvc.Find(orDefault(req.SpecCode, "passport"))
+	if err != nil {
+		s.catalogErr(w, r, err)
+		return
 	}
-	spec := s.findSpec(orDefault(req.SpecCode, "passport"))
-	if req.WidthPx == 0 {
-		req.WidthPx = spec.WidthPx
+	ts := spec.TaskSpec()
+	if req.WidthPx != 0 {
+		ts.WidthPx = req.WidthPx
 	}
-	if req.HeightPx == 0 {
-		req.HeightPx = spec.HeightPx
+	if req.HeightPx != 0 {
+		ts.HeightPx = req.HeightPx
 	}
-	if req.DPI == 0 {
-		req.DPI = spec.DPI
+	if req.DPI != 0 {
+		ts.DPI = req.DPI
 	}
 	if len(req.AvailableColors) == 0 {
 		if len(req.Colors) != 0 {
@@ -552,8 +1055,29 @@ func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
 			req.AvailableColors = spec.BgColors
 		}
 	}
-	t, _ := s.taskSvc.CreateTask(userID, orDefault(req.SpecCode, "passport"), req.SourceObjectKey, req.DefaultBackground, req.WidthPx, req.HeightPx, req.DPI, req.AvailableColors, colorHexOf)
-	s.json(w, r, http.StatusOK, t)
+	if req.DefaultBackground != "" {
+		c, err := s.colorSvc.Resolve(req.DefaultBackground, ts.AllowCustomColor)
+		if err != nil {
+			s.catalogErr(w, r, err)
+			return
+		}
+		req.DefaultBackground = c.Name
+	}
+	if !s.breaker.Allow() {
+		s.algoUnavailable(w, r, "algo service unavailable, retry later")
+		return
+	}
+	t, err := s.taskSvc.CreateTask(r.Context(), userID, ts, req.SourceObjectKey, req.DefaultBackground, req.AvailableColors, s.colorOf)
+	if err != nil {
+		if _, ok := err.(usecase.ErrUnavailable); ok {
+			w.Header().Set("Retry-After", "5")
+			s.err(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+			return
+		}
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "create task failed")
+		return
+	}
+	s.json(w, r, http.StatusOK, s.taskView(t, userID))
 }
 
 func (s *Server) handleGenerateBackground(w http.ResponseWriter, r *http.Request) {
@@ -577,28 +1101,28 @@ func (s *Server) handleGenerateBackground(w http.ResponseWriter, r *http.Request
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "color required")
 		return
 	}
-	t, ok := s.taskSvc.Repo.Get(id)
+	t, ok := s.ownedTask(w, r, id)
 	if !ok {
-		s.err(w, r, http.StatusNotFound, "NotFound", "task not found")
 		return
 	}
 	dpi := req.DPI
 	if dpi == 0 {
 		dpi = t.Spec.DPI
 	}
-	url, err := s.taskSvc.GenerateBackground(id, req.Color, dpi, colorHexOf)
+	c, err := s.colorSvc.Resolve(req.Color, t.Spec.AllowCustomColor)
 	if err != nil {
-		if _, ok := err.(usecase.ErrNotFound); ok {
-			s.err(w, r, http.StatusNotFound, "NotFound", err.Error())
-			return
-		}
-		s.err(w, r, http.StatusInternalServerError, "ServerError", "generate background failed")
+		s.catalogErr(w, r, err)
+		return
+	}
+	url, err := s.taskSvc.GenerateBackground(r.Context(), id, c.Name, dpi, s.colorOf)
+	if err != nil {
+		s.taskErr(w, r, err, "generate background failed")
 		return
 	}
 	s.json(w, r, http.StatusOK, map[string]any{
 		"taskId": id,
-		"color":  req.Color,
-		"url":    url,
+		"color":  c.Name,
+		"url":    s.signURL(url, userIDFrom(r), s.cfg.PreviewTTL),
 		"status": "done",
 	})
 }
@@ -624,39 +1148,38 @@ func (s *Server) handleGenerateLayout(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "color required")
 		return
 	}
-	t, ok := s.taskSvc.Repo.Get(id)
+	t, ok := s.ownedTask(w, r, id)
 	if !ok {
-		s.err(w, r, http.StatusNotFound, "NotFound", "task not found")
 		return
 	}
-	width := req.WidthPx
-	height := req.HeightPx
-	dpi := req.DPI
-	if width == 0 || height == 0 || dpi == 0 {
-		sp := s.findSpec(orDefault(t.SpecCode, "passport"))
-		if width == 0 {
-			width = sp.WidthPx
-		}
-		if height == 0 {
-			height = sp.HeightPx
-		}
-		if dpi == 0 {
-			dpi = sp.DPI
-		}
+	c, err := s.colorSvc.Resolve(req.Color, t.Spec.AllowCustomColor)
+	if err != nil {
+		s.catalogErr(w, r, err)
+		return
+	}
+	paper, ok := domain.LookupPaper(req.Paper, req.PaperWidthMM, req.PaperHeightMM)
+	if !ok {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "unknown paper "+req.Paper)
+		return
 	}
-	url, err := s.taskSvc.GenerateLayout(id, req.Color, width, height, dpi, req.KB, colorHexOf)
+	key, url, err := s.taskSvc.GenerateLayout(r.Context(), id, c.Name, usecase.LayoutOptions{
+		WidthPx:  req.WidthPx,
+		HeightPx: req.HeightPx,
+		DPI:      req.DPI,
+		KB:       req.KB,
+		Paper:    paper,
+		Copies:   req.Copies,
+	}, s.colorOf)
 	if err != nil {
-		if _, ok := err.(usecase.ErrNotFound); ok {
-			s.err(w, r, http.StatusNotFound, "NotFound", err.Error())
-			return
-		}
-		s.err(w, r, http.StatusInternalServerError, "ServerError", "generate layout failed")
+		s.taskErr(w, r, err, "generate layout failed")
 		return
 	}
 	s.json(w, r, http.StatusOK, map[string]any{
 		"taskId": id,
-		"layout": "6inch",
-		"url":    url,
+		"layout": key,
+		"paper":  paper,
+		"color":  c.Name,
+		"url":    s.signURL(url, userIDFrom(r), s.cfg.PreviewTTL),
 		"status": "done",
 	})
 }
@@ -670,12 +1193,11 @@ func (s *Server) handleGetTask(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "task id required")
 		return
 	}
-	t, ok := s.taskSvc.Repo.Get(id)
+	t, ok := s.ownedTask(w, r, id)
 	if !ok {
-		s.err(w, r, http.StatusNotFound, "NotFound", "task not found")
 		return
 	}
-	s.json(w, r, http.StatusOK, t)
+	s.json(w, r, http.StatusOK, s.taskView(t, userIDFrom(r)))
 }
 
 func (s *Server) handleDownloadInfo(w http.ResponseWriter, r *http.Request) {
@@ -688,21 +1210,143 @@ func (s *Server) handleDownloadInfo(w http.ResponseWriter, r *http.Request) {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "task id required")
 		return
 	}
-	t, ok := s.taskSvc.Repo.Get(id)
-	if !ok || t.Status != domain.StatusDone {
+	t, ok := s.ownedTask(w, r, id)
+	if !ok {
+		return
+	}
+	if t.Status != domain.StatusDone {
 		s.err(w, r, http.StatusBadRequest, "BadRequest", "task not ready")
 		return
 	}
+	if !s.orderSvc.PaidForTask(userIDFrom(r), id) {
+		s.err(w, r, http.StatusPaymentRequired, "PaymentRequired", "order not paid")
+		return
+	}
+	userID := userIDFrom(r)
+	ttl := s.cfg.DownloadTTL
+	urls := make(map[string]string, len(t.ProcessedUrls))
+	for color, u := range t.ProcessedUrls {
+		urls[color] = s.signURL("/api/files/"+id+"/"+path.Base(u), userID, ttl)
+	}
+	layouts := make(map[string]string, len(t.LayoutUrls))
+	for name, u := range t.LayoutUrls {
+		layouts[name] = s.signURL("/api/files/"+id+"/"+path.Base(u), userID, ttl)
+	}
 	s.json(w, r, http.StatusOK, map[string]any{
-		"taskId":    id,
-		"urls":      t.ProcessedUrls,
-		"expiresIn": 600,
+		"taskId":     id,
+		"urls":       urls,
+		"layoutUrls": layouts,
+		"expiresIn":  int(ttl.Seconds()),
 	})
 }
 
-func validImageName(name string) bool {
+// signURL signs an asset path for userID, valid for ttl.
+func (s *Server) signURL(p, userID string, ttl time.Duration) string {
+	return asset.Sign(s.signKey(), p, userID, time.Now().Add(ttl))
+}
+
+// signKey is AssetSignKey, falling back to JWTSecret; New refuses to start
+// without either, so it is never empty.
+func (s *Server) signKey() []byte {
+	if s.cfg.AssetSignKey != "" {
+		return []byte(s.cfg.AssetSignKey)
+	}
+	return []byte(s.cfg.JWTSecret)
+}
+
+// taskView returns a copy of t with preview URLs signed for userID. The
+// baseline cut-out is an internal intermediate and is not exposed.
+func (s *Server) taskView(t *domain.Task, userID string) domain.Task {
+	v := *t
+	v.BaselineUrl = ""
+	v.ProcessedUrls = make(map[string]string, len(t.ProcessedUrls))
+	for k, u := range t.ProcessedUrls {
+		v.ProcessedUrls[k] = s.signURL(u, userID, s.cfg.PreviewTTL)
+	}
+	if t.LayoutUrls != nil {
+		v.LayoutUrls = make(map[string]string, len(t.LayoutUrls))
+		for k, u := range t.LayoutUrls {
+			v.LayoutUrls[k] = s.signURL(u, userID, s.cfg.PreviewTTL)
+		}
+	}
+	return v
+}
+
+func (s *Server) handleSignedAsset(w http.ResponseWriter, r *http.Request, prefix string, store storage.Storage) {
+	q := r.URL.Query()
+	uid := q.Get("uid")
+	if !asset.Verify(s.signKey(), r.URL.Path, uid, q.Get("exp"), q.Get("sig"), time.Now()) {
+		s.err(w, r, http.StatusForbidden, "Forbidden", "invalid or expired signature")
+		return
+	}
+	if caller := s.optionalUserID(r); caller != "" && caller != uid {
+		s.err(w, r, http.StatusForbidden, "Forbidden", "url issued to another user")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	if s.cfg.S3PresignRedirect {
+		if u, err := store.PresignGet(r.Context(), key, time.Minute); err == nil {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	}
+	rc, info, err := store.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			s.err(w, r, http.StatusNotFound, "NotFound", "file not found")
+			return
+		}
+		s.err(w, r, http.StatusBadGateway, "StorageError", "read file failed")
+		return
+	}
+	if err := asset.ServeObject(w, r, rc, info); err != nil {
+		log.Printf("serve %s: %v", r.URL.Path, err)
+	}
+}
+
+func (s *Server) ownedTask(w http.ResponseWriter, r *http.Request, id string) (*domain.Task, bool) {
+	t, err := s.taskSvc.GetForUser(userIDFrom(r), id)
+	if err != nil {
+		s.err(w, r, http.StatusNotFound, "NotFound", "task not found")
+		return nil, false
+	}
+	return t, true
+}
+
+func (s *Server) ownedOrder(w http.ResponseWriter, r *http.Request, id string) (*domain.Order, bool) {
+	o, err := s.orderSvc.GetForUser(userIDFrom(r), id)
+	if err != nil {
+		s.err(w, r, http.StatusNotFound, "NotFound", "order not found")
+		return nil, false
+	}
+	return o, true
+}
+
+// imageExts lists the upload extensions. HEIC is only accepted when a
+// converter is configured, since there is no decoder for it in process.
+func (s *Server) imageExts() []string {
+	exts := []string{".jpg", ".jpeg", ".png", ".webp"}
+	if s.cfg.ImageConvertCmd != "" {
+		exts = append(exts, ".heic", ".heif")
+	}
+	return exts
+}
+
+func (s *Server) validImageName(name string) bool {
 	n := strings.ToLower(name)
-	return strings.HasSuffix(n, ".jpg") || strings.HasSuffix(n, ".jpeg") || strings.HasSuffix(n, ".png")
+	for _, ext := range s.imageExts() {
+		if strings.HasSuffix(n, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) imageNameHint() string {
+	if s.cfg.ImageConvertCmd != "" {
+		return "only jpg/png/webp/heic allowed"
+	}
+	return "only jpg/png/webp allowed"
 }
 
 func randomID() string {
@@ -727,20 +1371,27 @@ func orDefault(s, d string) string {
 }
 
 func (s *Server) err(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	s.errDetail(w, r, status, code, msg, nil)
+}
+
+// errDetail is err with extra fields added to the error object.
+func (s *Server) errDetail(w http.ResponseWriter, r *http.Request, status int, code, msg string, detail map[string]any) {
 	reqID := ""
 	if v := r.Header.Get("Idempotency-Key"); v != "" {
 		reqID = v
 	}
 	log.Printf("error %s %s %d %s", r.Method, r.URL.Path, status, msg)
+	e := map[string]any{
+		"code":      code,
+		"message":   msg,
+		"requestId": reqID,
+	}
+	for k, v := range detail {
+		e[k] = v
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"error": map[string]any{
-			"code":      code,
-			"message":   msg,
-			"requestId": reqID,
-		},
-	})
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": e})
 }
 
 func (s *Server) json(w http.ResponseWriter, r *http.Request, status int, v any) {
@@ -756,55 +1407,271 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
 			return
 		}
 		p := c.Request.URL.Path
-		if strings.HasPrefix(p, "/assets") || p == "/api/login" {
+		if strings.HasPrefix(p, "/assets") || strings.HasPrefix(p, "/api/files/") || strings.HasPrefix(p, "/api/admin/") || p == "/api/login" || p == "/healthz" || p == "/readyz" || p == "/metrics" || p == "/api/pay/wechat/notify" || p == "/api/pay/wechat/refund-notify" {
 			c.Next()
 			return
 		}
-		authz := c.GetHeader("Authorization")
-		if strings.HasPrefix(strings.ToLower(authz), "bearer ") {
-			tk := strings.TrimSpace(authz[7:])
-			if uid, _, err := s.authSvc.Verify(tk); err == nil && strings.TrimSpace(uid) != "" {
-				c.Next()
-				return
-			}
+		if uid, oid, ok := s.bearerUser(c.Request); ok {
+			c.Set(string(ctxUserID), uid)
+			c.Set(string(ctxOpenID), oid)
+			ctx := context.WithValue(c.Request.Context(), ctxUserID, uid)
+			ctx = context.WithValue(ctx, ctxOpenID, oid)
+			c.Request = c.Request.WithContext(ctx)
+			c.Next()
+			return
 		}
 		s.err(c.Writer, c.Request, http.StatusUnauthorized, "Unauthorized", "token required")
 		c.Abort()
 	}
 }
 
-func colorHexOf(name string) string {
-	switch strings.ToLower(strings.TrimSpace(name)) {
-	case "white":
-		return "ffffff"
-	case "blue":
-		return "638cce"
-	case "red":
-		return "ff0000"
-	default:
-		return "ffffff"
+// adminMiddleware guards /api/admin with a static X-Admin-Token. The admin
+// API is off when no token is configured.
+func (s *Server) adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tk := c.GetHeader("X-Admin-Token")
+		if s.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(tk), []byte(s.cfg.AdminToken)) != 1 {
+			s.err(c.Writer, c.Request, http.StatusForbidden, "Forbidden", "admin token required")
+			c.Abort()
+			return
+		}
+		c.Next()
 	}
 }
 
-type algoAdapter struct{}
+func (s *Server) bearerUser(r *http.Request) (string, string, bool) {
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(authz), "bearer ") {
+		return "", "", false
+	}
+	uid, oid, err := s.authSvc.Verify(strings.TrimSpace(authz[7:]))
+	if err != nil || strings.TrimSpace(uid) == "" {
+		return "", "", false
+	}
+	return uid, oid, true
+}
+
+// optionalUserID returns the caller on routes that skip authMiddleware.
+func (s *Server) optionalUserID(r *http.Request) string {
+	uid, _, _ := s.bearerUser(r)
+	return uid
+}
+
+type ctxKey string
+
+const (
+	ctxUserID ctxKey = "user_id"
+	ctxOpenID ctxKey = "openid"
+)
 
-func (algoAdapter) IDPhoto(baseURL, imagePath string, height, width, dpi int) (algo.IDPhotoResp, error) {
-	return algo.IDPhoto(baseURL, imagePath, height, width, dpi)
+func userIDFrom(r *http.Request) string {
+	v, _ := r.Context().Value(ctxUserID).(string)
+	return v
 }
-func (algoAdapter) AddBackgroundBase64(baseURL, rgbaBase64, colorHex string, dpi int) (algo.AddBackgroundResp, error) {
-	return algo.AddBackgroundBase64(baseURL, rgbaBase64, colorHex, dpi)
+
+func openIDFrom(r *http.Request) string {
+	v, _ := r.Context().Value(ctxOpenID).(string)
+	return v
 }
-func (algoAdapter) AddBackgroundFile(baseURL string, rgbaPNG []byte, colorHex string, dpi int) (algo.AddBackgroundResp, error) {
-	return algo.AddBackgroundFile(baseURL, rgbaPNG, colorHex, dpi)
+
+// colorOf resolves names already validated by a handler; anything the
+// registry no longer knows renders white.
+func (s *Server) colorOf(name string) domain.Color {
+	c, err := s.colorSvc.Resolve(name, true)
+	if err != nil {
+		return domain.Color{Name: "white", DisplayName: "white", Hex: "ffffff"}
+	}
+	return c
 }
-func (algoAdapter) GenerateLayoutPhotosFile(baseURL string, rgbImage []byte, height, width, dpi, kb int) (algo.LayoutResp, error) {
-	return algo.GenerateLayoutPhotosFile(baseURL, rgbImage, height, width, dpi, kb)
+
+// newObjectStores returns the uploads, preview and original stores. With
+// S3 all three share one bucket under fixed prefixes.
+func newObjectStores(cfg config.Config) (uploads, previews, originals storage.Storage) {
+	if cfg.ObjectStore == "s3" {
+		s3 := storage.NewS3(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3PathStyle)
+		return storage.WithPrefix(s3, "uploads"), storage.WithPrefix(s3, "assets"), storage.WithPrefix(s3, "private")
+	}
+	return storage.NewFS(cfg.UploadsDir), storage.NewFS(cfg.AssetsDir), storage.NewFS(cfg.PrivateDir)
+}
+
+// algoService is the algo backend: the HTTP client for the external service
+// or the in-process fallback.
+type algoService interface {
+	usecase.AlgoClient
+	usecase.FaceDetector
+	Ping(ctx context.Context) error
+}
+
+// algoAdapter runs every algo call through the circuit breaker, which also
+// bounds how many run at once. Rejections come back as unavailable
+// *algo.Error values so callers handle them like an unreachable service.
+type algoAdapter struct {
+	c algoService
+	b *breaker.Breaker
+}
+
+func (a algoAdapter) guard(ctx context.Context, op string, fn func() error) error {
+	err := a.b.Do(ctx, fn, algo.IsUnavailable)
+	if errors.Is(err, breaker.ErrOpen) || errors.Is(err, breaker.ErrBusy) {
+		return &algo.Error{Op: op, Err: err}
+	}
+	return err
+}
+
+func (a algoAdapter) IDPhotoFile(ctx context.Context, image []byte, filename string, height, width, dpi int, opts algo.IDPhotoOptions) (out algo.IDPhotoResp, err error) {
+	err = a.guard(ctx, "/idphoto", func() error {
+		out, err = a.c.IDPhotoFile(ctx, image, filename, height, width, dpi, opts)
+		return err
+	})
+	return out, err
+}
+func (a algoAdapter) AddBackgroundBase64(ctx context.Context, rgbaBase64, colorHex string, render, dpi, kb int) (out algo.AddBackgroundResp, err error) {
+	err = a.guard(ctx, "/add_background", func() error {
+		out, err = a.c.AddBackgroundBase64(ctx, rgbaBase64, colorHex, render, dpi, kb)
+		return err
+	})
+	return out, err
+}
+func (a algoAdapter) AddBackgroundFile(ctx context.Context, rgbaPNG []byte, colorHex string, render, dpi, kb int) (out algo.AddBackgroundResp, err error) {
+	err = a.guard(ctx, "/add_background", func() error {
+		out, err = a.c.AddBackgroundFile(ctx, rgbaPNG, colorHex, render, dpi, kb)
+		return err
+	})
+	return out, err
+}
+func (a algoAdapter) GenerateLayoutPhotosFile(ctx context.Context, rgbImage []byte, height, width, dpi, kb int) (out algo.LayoutResp, err error) {
+	err = a.guard(ctx, "/generate_layout_photos", func() error {
+		out, err = a.c.GenerateLayoutPhotosFile(ctx, rgbImage, height, width, dpi, kb)
+		return err
+	})
+	return out, err
+}
+func (a algoAdapter) DetectFaces(ctx context.Context, image []byte) (out algo.FacesResp, err error) {
+	err = a.guard(ctx, "/detect_faces", func() error {
+		out, err = a.c.DetectFaces(ctx, image)
+		return err
+	})
+	return out, err
+}
+
+func (s *Server) loadPriceCatalog() domain.PriceCatalog {
+	if s.cfg.PricingFile != "" {
+		c, err := repo.LoadPriceCatalogFile(s.cfg.PricingFile)
+		if err == nil {
+			return c
+		}
+		log.Printf("load pricing file failed: %v", err)
+	}
+	if s.pg != nil {
+		if c, ok, err := s.pg.LoadPriceCatalog(); err != nil {
+			log.Printf("load pricing from postgres failed: %v", err)
+		} else if ok {
+			return c
+		}
+	}
+	return usecase.DefaultPriceCatalog()
+}
+
+// newWechatPayClient builds the client for real payments. Notifications can
+// only be verified and decrypted with the platform certificate and a 32 byte
+// APIv3 key, so both are required.
+func newWechatPayClient(cfg config.Config) (*wechat.PayClient, error) {
+	if cfg.WechatMchID == "" || cfg.WechatMchSerialNo == "" || cfg.WechatMchKeyPath == "" {
+		return nil, fmt.Errorf("merchant id, serial no and private key path required")
+	}
+	if len(cfg.WechatAPIv3Key) != 32 {
+		return nil, fmt.Errorf("APIv3 key must be 32 bytes, got %d", len(cfg.WechatAPIv3Key))
+	}
+	if cfg.WechatPlatformCertPath == "" {
+		return nil, fmt.Errorf("platform certificate path required to verify notifications")
+	}
+	key, err := wechat.LoadPrivateKey(cfg.WechatMchKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	pc := &wechat.PayClient{
+		AppID:           cfg.WechatAppID,
+		MchID:           cfg.WechatMchID,
+		SerialNo:        cfg.WechatMchSerialNo,
+		PrivateKey:      key,
+		APIv3Key:        cfg.WechatAPIv3Key,
+		NotifyURL:       cfg.WechatNotifyURL,
+		RefundNotifyURL: cfg.WechatRefundNotifyURL,
+		BaseURL:         cfg.WechatPayBaseURL,
+	}
+	keys, err := wechat.LoadPlatformKeys(cfg.WechatPlatformCertPath)
+	if err != nil {
+		return nil, err
+	}
+	pc.PlatformKeys = keys
+	return pc, nil
+}
+
+// openPostgres connects, waiting up to DBPingRetries attempts for the
+// database, and brings the schema up to date when DBAutoMigrate is set;
+// otherwise it only warns about pending migrations, which are then applied
+// with `permit-backend migrate up`.
+func openPostgres(cfg config.Config) (*repo.PostgresRepo, error) {
+	pg, err := repo.NewPostgresRepo(cfg.PostgresDSN)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if err := pingRetry(ctx, pg.Ping, cfg.DBPingRetries, cfg.DBPingInterval); err != nil {
+		pg.Close()
+		return nil, err
+	}
+	m, err := pg.Migrator()
+	if err != nil {
+		pg.Close()
+		return nil, err
+	}
+	if cfg.DBAutoMigrate {
+		applied, err := m.Up(ctx)
+		if err != nil {
+			pg.Close()
+			return nil, err
+		}
+		for _, mg := range applied {
+			log.Printf("applied migration %04d_%s", mg.Version, mg.Name)
+		}
+		return pg, nil
+	}
+	if n, err := m.Pending(ctx); err != nil {
+		log.Printf("check migrations failed: %v", err)
+	} else if n > 0 {
+		log.Printf("%d pending migrations; run `permit-backend migrate up`", n)
+	}
+	return pg, nil
 }
 
 type pgOrderRepo struct{ pg *repo.PostgresRepo }
 
 func (p *pgOrderRepo) Put(o *domain.Order) error           { return p.pg.PutOrder(o) }
 func (p *pgOrderRepo) Get(id string) (*domain.Order, bool) { return p.pg.GetOrder(id) }
-func (p *pgOrderRepo) List(page, pageSize int) ([]domain.Order, int) {
-	return p.pg.ListOrders(page, pageSize)
+func (p *pgOrderRepo) List(userID string, page, pageSize int) ([]domain.Order, int) {
+	return p.pg.ListOrders(userID, page, pageSize)
+}
+func (p *pgOrderRepo) ListByTask(taskID string) ([]domain.Order, error) {
+	return p.pg.ListOrdersByTask(taskID)
+}
+func (p *pgOrderRepo) PutWithTransition(o *domain.Order, t *domain.OrderTransition) error {
+	return p.pg.PutOrderWithTransition(o, t)
+}
+func (p *pgOrderRepo) UpdateOrder(o *domain.Order, from domain.OrderStatus, t *domain.OrderTransition) (bool, error) {
+	return p.pg.UpdateOrder(o, from, t)
+}
+func (p *pgOrderRepo) ListTransitions(orderID string) ([]domain.OrderTransition, error) {
+	return p.pg.ListOrderTransitions(orderID)
+}
+func (p *pgOrderRepo) PutRefund(rf *domain.Refund) error          { return p.pg.PutRefund(rf) }
+func (p *pgOrderRepo) GetRefund(id string) (*domain.Refund, bool) { return p.pg.GetRefund(id) }
+func (p *pgOrderRepo) ListRefunds(orderID string) ([]domain.Refund, error) {
+	return p.pg.ListRefunds(orderID)
+}
+func (p *pgOrderRepo) ReserveRefund(rf *domain.Refund) (int, bool, error) {
+	return p.pg.ReserveRefund(rf)
+}
+func (p *pgOrderRepo) FinishRefund(refundID string, st domain.RefundStatus, providerRefundID string, at time.Time) (*domain.Order, bool, error) {
+	return p.pg.FinishRefund(refundID, st, providerRefundID, at)
 }
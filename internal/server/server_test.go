@@ -0,0 +1,813 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"permit-backend/internal/algo"
+	"permit-backend/internal/config"
+	"permit-backend/internal/domain"
+	"permit-backend/internal/infrastructure/asset"
+	"permit-backend/internal/infrastructure/breaker"
+	"permit-backend/internal/infrastructure/repo"
+	"permit-backend/internal/infrastructure/wechat"
+	"permit-backend/internal/infrastructure/worker"
+	"permit-backend/internal/photo"
+	"permit-backend/internal/storage"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.AssetsDir = t.TempDir()
+	cfg.UploadsDir = t.TempDir()
+	cfg.PrivateDir = t.TempDir()
+	cfg.JWTSecret = "test-secret"
+	cfg.AdminToken = "admin-secret"
+	cfg.AlgoURL = "http://127.0.0.1:1"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s
+}
+
+func doJSON(t *testing.T, h http.Handler, method, path, token string, body any) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var out map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec, out
+}
+
+func login(t *testing.T, h http.Handler, openid string) string {
+	t.Helper()
+	rec, out := doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"code": "mock_" + openid})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	return out["token"].(string)
+}
+
+func TestOwnership(t *testing.T) {
+	h := newTestServer(t).Handler()
+	alice := login(t, h, "alice")
+	bob := login(t, h, "bob")
+	src := uploadPhoto(t, h, alice, "a.jpg", testJPEG(600, 800))
+
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/tasks", bob, map[string]any{"specCode": "passport", "sourceObjectKey": src}); rec.Code != http.StatusNotFound {
+		t.Fatalf("task from foreign upload: want 404, got %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/tasks", alice, map[string]any{"specCode": "passport", "sourceObjectKey": "uploads/a.jpg"}); rec.Code != http.StatusNotFound {
+		t.Fatalf("task from unknown upload: want 404, got %d", rec.Code)
+	}
+	rec, task := doJSON(t, h, http.MethodPost, "/api/tasks", alice, map[string]any{"specCode": "passport", "sourceObjectKey": src})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create task: %d %s", rec.Code, rec.Body.String())
+	}
+	taskID := task["id"].(string)
+
+	if rec, _ := doJSON(t, h, http.MethodGet, "/api/tasks/"+taskID, alice, nil); rec.Code != http.StatusOK {
+		t.Fatalf("owner get task: %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodGet, "/api/tasks/"+taskID, bob, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("foreign get task: want 404, got %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/orders", bob, map[string]any{"taskId": taskID, "items": []map[string]any{{"type": "electronic", "qty": 1}}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("order on foreign task: want 400, got %d", rec.Code)
+	}
+
+	rec, order := doJSON(t, h, http.MethodPost, "/api/orders", alice, map[string]any{"taskId": taskID, "items": []map[string]any{{"type": "electronic", "qty": 1}}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create order: %d %s", rec.Code, rec.Body.String())
+	}
+	orderID := order["orderId"].(string)
+
+	if rec, _ := doJSON(t, h, http.MethodGet, "/api/orders/"+orderID, bob, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("foreign get order: want 404, got %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodGet, "/api/orders/"+orderID, alice, nil); rec.Code != http.StatusOK {
+		t.Fatalf("owner get order: %d", rec.Code)
+	}
+	if _, list := doJSON(t, h, http.MethodGet, "/api/orders", bob, nil); list["total"].(float64) != 0 {
+		t.Fatalf("foreign list should be empty: %v", list)
+	}
+	if _, list := doJSON(t, h, http.MethodGet, "/api/orders", alice, nil); list["total"].(float64) != 1 {
+		t.Fatalf("owner list should have 1 order: %v", list)
+	}
+}
+
+func TestRefundRequiresAdmin(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	alice := login(t, h, "alice")
+	src := uploadPhoto(t, h, alice, "a.jpg", testJPEG(600, 800))
+	_, task := doJSON(t, h, http.MethodPost, "/api/tasks", alice, map[string]any{"specCode": "passport", "sourceObjectKey": src})
+	_, order := doJSON(t, h, http.MethodPost, "/api/orders", alice, map[string]any{"taskId": task["id"], "items": []map[string]any{{"type": "electronic", "qty": 1}}})
+	orderID := order["orderId"].(string)
+	for _, st := range []string{"pending", "paid"} {
+		if err := s.orderSvc.Callback(orderID, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/orders/"+orderID+"/refund", alice, map[string]any{}); rec.Code != http.StatusNotFound {
+		t.Fatalf("owner refund: want 404, got %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/admin/orders/"+orderID+"/refund", alice, map[string]any{}); rec.Code != http.StatusForbidden {
+		t.Fatalf("refund without admin token: want 403, got %d", rec.Code)
+	}
+	rec, rf := doAdmin(t, h, http.MethodPost, "/api/admin/orders/"+orderID+"/refund", map[string]any{"reason": "duplicate"})
+	if rec.Code != http.StatusOK || rf["status"] != "success" {
+		t.Fatalf("admin refund: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := doAdmin(t, h, http.MethodPost, "/api/admin/orders/"+orderID+"/refund", map[string]any{}); rec.Code != http.StatusConflict {
+		t.Fatalf("second refund: want 409, got %d", rec.Code)
+	}
+	if _, list := doJSON(t, h, http.MethodGet, "/api/orders/"+orderID+"/refunds", alice, nil); len(list["items"].([]any)) != 1 {
+		t.Fatalf("owner refunds = %v", list)
+	}
+}
+
+// wechatNotifier signs notifications the way WeChat Pay does: the resource
+// is sealed with the APIv3 key and the request signed with the platform key.
+type wechatNotifier struct {
+	key      *rsa.PrivateKey
+	apiV3Key string
+}
+
+func newWechatNotifier(t *testing.T, s *Server) *wechatNotifier {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &wechatNotifier{key: key, apiV3Key: "0123456789abcdef0123456789abcdef"}
+	s.wxPay = &wechat.PayClient{MchID: "1900000001", APIv3Key: n.apiV3Key, PlatformKeys: map[string]*rsa.PublicKey{"PLATFORM1": &key.PublicKey}}
+	s.orderSvc.WechatMchID = "1900000001"
+	return n
+}
+
+func (n *wechatNotifier) post(t *testing.T, h http.Handler, path, event string, resource any, sign *rsa.PrivateKey) *httptest.ResponseRecorder {
+	t.Helper()
+	plain, _ := json.Marshal(resource)
+	block, _ := aes.NewCipher([]byte(n.apiV3Key))
+	gcm, _ := cipher.NewGCM(block)
+	nonce := "fdasflkja484"
+	body, _ := json.Marshal(wechat.Notification{
+		ID:        "EV-" + randomID(),
+		EventType: event,
+		Resource: wechat.NotifyResource{
+			Algorithm:      "AEAD_AES_256_GCM",
+			Ciphertext:     base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), plain, []byte("transaction"))),
+			AssociatedData: "transaction",
+			Nonce:          nonce,
+		},
+	})
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sum := sha256.Sum256([]byte(ts + "\nn0nce\n" + string(body) + "\n"))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, sign, crypto.SHA256, sum[:])
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Wechatpay-Timestamp", ts)
+	req.Header.Set("Wechatpay-Nonce", "n0nce")
+	req.Header.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sig))
+	req.Header.Set("Wechatpay-Serial", "PLATFORM1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWechatPayNotify(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	wx := newWechatNotifier(t, s)
+	alice := login(t, h, "alice")
+	src := uploadPhoto(t, h, alice, "a.jpg", testJPEG(600, 800))
+	_, task := doJSON(t, h, http.MethodPost, "/api/tasks", alice, map[string]any{"specCode": "passport", "sourceObjectKey": src})
+	_, order := doJSON(t, h, http.MethodPost, "/api/orders", alice, map[string]any{"taskId": task["id"], "items": []map[string]any{{"type": "electronic", "qty": 1}}})
+	orderID := order["orderId"].(string)
+	o, _ := s.orderSvc.Repo.Get(orderID)
+	paid := map[string]any{"mchid": "1900000001", "out_trade_no": orderID, "transaction_id": "4200000001", "trade_state": "SUCCESS", "amount": map[string]any{"total": o.AmountCents}}
+
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if rec := wx.post(t, h, "/api/pay/wechat/notify", "TRANSACTION.SUCCESS", paid, forger); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("forged signature: want 401, got %d %s", rec.Code, rec.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/pay/wechat/notify", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unsigned: want 401, got %d", rec.Code)
+	}
+	short := map[string]any{"mchid": "1900000001", "out_trade_no": orderID, "transaction_id": "4200000001", "trade_state": "SUCCESS", "amount": map[string]any{"total": 1}}
+	if rec := wx.post(t, h, "/api/pay/wechat/notify", "TRANSACTION.SUCCESS", short, wx.key); rec.Code != http.StatusBadRequest {
+		t.Fatalf("amount mismatch: want 400, got %d", rec.Code)
+	}
+	if o, _ := s.orderSvc.Repo.Get(orderID); o.Status != domain.OrderCreated || o.TransactionID != "" {
+		t.Fatalf("rejected notifications changed the order: %+v", o)
+	}
+
+	if rec := wx.post(t, h, "/api/pay/wechat/notify", "TRANSACTION.SUCCESS", paid, wx.key); rec.Code != http.StatusNoContent {
+		t.Fatalf("valid notification: %d %s", rec.Code, rec.Body.String())
+	}
+	if o, _ := s.orderSvc.Repo.Get(orderID); o.Status != domain.OrderPaid || o.TransactionID != "4200000001" {
+		t.Fatalf("order after payment = %+v", o)
+	}
+	before, _ := s.orderSvc.Repo.ListTransitions(orderID)
+
+	// WeChat retries until it sees a 2xx; a replay must be acknowledged
+	// without touching the order again.
+	replay := map[string]any{"mchid": "1900000001", "out_trade_no": orderID, "transaction_id": "4200000002", "trade_state": "SUCCESS", "amount": map[string]any{"total": o.AmountCents}}
+	for _, res := range []map[string]any{paid, replay} {
+		if rec := wx.post(t, h, "/api/pay/wechat/notify", "TRANSACTION.SUCCESS", res, wx.key); rec.Code != http.StatusNoContent {
+			t.Fatalf("replay: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	after, _ := s.orderSvc.Repo.ListTransitions(orderID)
+	if o, _ := s.orderSvc.Repo.Get(orderID); o.Status != domain.OrderPaid || o.TransactionID != "4200000001" || len(after) != len(before) {
+		t.Fatalf("replay changed the order: %+v, %d transitions, was %d", o, len(after), len(before))
+	}
+}
+
+func TestWechatRefundNotify(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	wx := newWechatNotifier(t, s)
+	alice := login(t, h, "alice")
+	src := uploadPhoto(t, h, alice, "a.jpg", testJPEG(600, 800))
+	_, task := doJSON(t, h, http.MethodPost, "/api/tasks", alice, map[string]any{"specCode": "passport", "sourceObjectKey": src})
+	_, order := doJSON(t, h, http.MethodPost, "/api/orders", alice, map[string]any{"taskId": task["id"], "items": []map[string]any{{"type": "electronic", "qty": 1}}})
+	orderID := order["orderId"].(string)
+	if err := s.orderSvc.Callback(orderID, "paid"); err != nil {
+		t.Fatal(err)
+	}
+	rf := &domain.Refund{RefundID: "rf-1", OrderID: orderID, CreatedAt: time.Now().UTC()}
+	if _, ok, err := s.orderSvc.Repo.ReserveRefund(rf); err != nil || !ok {
+		t.Fatalf("ReserveRefund = %v, %v", ok, err)
+	}
+	done := map[string]any{"mchid": "1900000001", "out_trade_no": orderID, "out_refund_no": "rf-1", "refund_id": "50000001", "refund_status": "SUCCESS", "amount": map[string]any{"refund": rf.AmountCents}}
+
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if rec := wx.post(t, h, "/api/pay/wechat/refund-notify", "REFUND.SUCCESS", done, forger); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("forged signature: want 401, got %d", rec.Code)
+	}
+	if got, _ := s.orderSvc.Repo.GetRefund("rf-1"); got.Status != domain.RefundProcessing {
+		t.Fatalf("forged notification changed the refund: %+v", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := wx.post(t, h, "/api/pay/wechat/refund-notify", "REFUND.SUCCESS", done, wx.key); rec.Code != http.StatusNoContent {
+			t.Fatalf("notification %d: %d %s", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	got, _ := s.orderSvc.Repo.GetRefund("rf-1")
+	o, _ := s.orderSvc.Repo.Get(orderID)
+	if got.Status != domain.RefundSuccess || got.ProviderRefundID != "50000001" || o.Status != domain.OrderRefunded || o.RefundedCents != o.AmountCents {
+		t.Fatalf("after refund notifications: refund %+v, order %+v", got, o)
+	}
+}
+
+func TestSignedAssets(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	dir := filepath.Join(s.cfg.AssetsDir, "task1")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "white.jpg"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/assets/task1/white.jpg", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("unsigned: want 403, got %d", rec.Code)
+	}
+	url := s.signURL("/assets/task1/white.jpg", "u1", time.Minute)
+	rec := get(url, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" || rec.Header().Get("ETag") == "" {
+		t.Fatalf("signed get: %d %v", rec.Code, rec.Header())
+	}
+	if rec := get(url, map[string]string{"Range": "bytes=2-4"}); rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Fatalf("range: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(url, map[string]string{"If-None-Match": rec.Header().Get("ETag")}); rec.Code != http.StatusNotModified {
+		t.Fatalf("etag: want 304, got %d", rec.Code)
+	}
+	if rec := get(strings.Replace(url, "uid=u1", "uid=u2", 1), nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("tampered uid: want 403, got %d", rec.Code)
+	}
+	if rec := get(s.signURL("/assets/task1/white.jpg", "u1", -time.Minute), nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expired: want 403, got %d", rec.Code)
+	}
+	other := login(t, h, "someone-else")
+	if rec := get(url, map[string]string{"Authorization": "Bearer " + other}); rec.Code != http.StatusForbidden {
+		t.Fatalf("foreign caller: want 403, got %d", rec.Code)
+	}
+}
+
+func doAdmin(t *testing.T, h http.Handler, method, path string, body any) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("X-Admin-Token", "admin-secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var out map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec, out
+}
+
+func TestSpecCatalogAdmin(t *testing.T) {
+	h := newTestServer(t).Handler()
+	user := login(t, h, "alice")
+	src := uploadPhoto(t, h, user, "a.jpg", testJPEG(600, 800))
+	visa := map[string]any{"code": "us_visa", "name": "美国签证", "widthPx": 600, "heightPx": 600, "dpi": 300, "bgColors": []string{"white"}}
+
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/admin/specs", user, visa); rec.Code != http.StatusForbidden {
+		t.Fatalf("create without admin token: want 403, got %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/tasks", user, map[string]any{"specCode": "us_visa", "sourceObjectKey": src}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown spec: want 400, got %d", rec.Code)
+	}
+	if rec, _ := doAdmin(t, h, http.MethodPost, "/api/admin/specs", visa); rec.Code != http.StatusOK {
+		t.Fatalf("create spec: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := doAdmin(t, h, http.MethodPost, "/api/admin/specs", visa); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate spec: want 409, got %d", rec.Code)
+	}
+	visa["widthPx"] = 610
+	if rec, out := doAdmin(t, h, http.MethodPut, "/api/admin/specs/us_visa", visa); rec.Code != http.StatusOK || out["widthPx"].(float64) != 610 {
+		t.Fatalf("update spec: %d %v", rec.Code, out)
+	}
+	rec, task := doJSON(t, h, http.MethodPost, "/api/tasks", user, map[string]any{"specCode": "us_visa", "sourceObjectKey": src})
+	if rec.Code != http.StatusOK || task["spec"].(map[string]any)["widthPx"].(float64) != 610 {
+		t.Fatalf("task should use catalog spec: %d %v", rec.Code, task)
+	}
+
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/tasks", user, map[string]any{"specCode": "us_visa", "sourceObjectKey": src, "defaultBackground": "#aabbcc"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("custom color on restricted spec: want 400, got %d", rec.Code)
+	}
+	visa["allowCustomColor"] = true
+	if rec, _ := doAdmin(t, h, http.MethodPut, "/api/admin/specs/us_visa", visa); rec.Code != http.StatusOK {
+		t.Fatalf("allow custom colors: %d", rec.Code)
+	}
+	if rec, task := doJSON(t, h, http.MethodPost, "/api/tasks", user, map[string]any{"specCode": "us_visa", "sourceObjectKey": src, "defaultBackground": "#AABBCC"}); rec.Code != http.StatusOK || task["defaultBackground"] != "#aabbcc" {
+		t.Fatalf("custom color on permissive spec: %d %v", rec.Code, task)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/tasks", user, map[string]any{"specCode": "us_visa", "sourceObjectKey": src, "defaultBackground": "mauve"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown color: want 400, got %d", rec.Code)
+	}
+
+	if rec, _ := doAdmin(t, h, http.MethodPost, "/api/admin/specs/us_visa/disable", nil); rec.Code != http.StatusOK {
+		t.Fatalf("disable spec: %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodPost, "/api/tasks", user, map[string]any{"specCode": "us_visa", "sourceObjectKey": src}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("disabled spec: want 400, got %d", rec.Code)
+	}
+	rec, _ = doJSON(t, h, http.MethodGet, "/api/specs", user, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "passport") || strings.Contains(rec.Body.String(), "us_visa") {
+		t.Fatalf("disabled spec listed publicly: %s", rec.Body.String())
+	}
+	if rec, _ := doAdmin(t, h, http.MethodDelete, "/api/admin/specs/us_visa", nil); rec.Code != http.StatusOK {
+		t.Fatalf("delete spec: %d", rec.Code)
+	}
+	if rec, _ := doAdmin(t, h, http.MethodDelete, "/api/admin/specs/us_visa", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete missing spec: want 404, got %d", rec.Code)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	rec, body := doJSON(t, h, http.MethodGet, "/healthz", "", nil)
+	if rec.Code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("healthz = %d %v", rec.Code, body)
+	}
+	// The algo service at 127.0.0.1:1 is down: degraded but still ready.
+	rec, body = doJSON(t, h, http.MethodGet, "/readyz", "", nil)
+	if rec.Code != http.StatusOK || body["status"] != "degraded" {
+		t.Fatalf("readyz = %d %v", rec.Code, body)
+	}
+	checks, _ := body["checks"].(map[string]any)
+	db, _ := checks["db"].(map[string]any)
+	al, _ := checks["algo"].(map[string]any)
+	if db["status"] != "ok" || db["mode"] != "memory" || al["status"] != "down" {
+		t.Fatalf("checks = %v", checks)
+	}
+
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+	s.algo.(*algo.Client).BaseURL = up.URL
+	rec, body = doJSON(t, h, http.MethodGet, "/readyz", "", nil)
+	if rec.Code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("readyz with algo up = %d %v", rec.Code, body)
+	}
+}
+
+func TestNewRejectsUnusableStorage(t *testing.T) {
+	cfg := config.Default()
+	cfg.AssetsDir, cfg.UploadsDir, cfg.PrivateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	cfg.JWTSecret = "test-secret"
+
+	cfg.Storage = "mongo"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("unknown storage accepted")
+	}
+	cfg.Storage = "postgres"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("postgres without DSN accepted")
+	}
+	cfg.PostgresDSN = "postgres://permit@127.0.0.1:1/permit?sslmode=disable&connect_timeout=1"
+	cfg.DBPingRetries = 2
+	cfg.DBPingInterval = 0
+	if _, err := New(cfg); err == nil {
+		t.Fatal("unreachable postgres accepted")
+	}
+}
+
+func TestNewRequiresSignKey(t *testing.T) {
+	cfg := config.Default()
+	cfg.AssetsDir, cfg.UploadsDir, cfg.PrivateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	if _, err := New(cfg); err == nil {
+		t.Fatal("started without a key for signed URLs")
+	}
+	forged, _ := url.Parse(asset.Sign(nil, "/api/files/a.jpg", "u1", time.Now().Add(time.Hour)))
+	if q := forged.Query(); asset.Verify(nil, forged.Path, "u1", q.Get("exp"), q.Get("sig"), time.Now()) {
+		t.Fatal("empty key verified a signature")
+	}
+	cfg.AssetSignKey = "asset-secret"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Shutdown(context.Background())
+}
+
+func TestNewRequiresNotifyKeysForRealPay(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{SerialNumber: big.NewInt(0x0A1B), Subject: pkix.Name{CommonName: "platform"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, certPath := filepath.Join(dir, "apiclient_key.pem"), filepath.Join(dir, "platform.pem")
+	_ = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600)
+	_ = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+
+	cfg := config.Default()
+	cfg.AssetsDir, cfg.UploadsDir, cfg.PrivateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	cfg.JWTSecret = "test-secret"
+	cfg.PayMock = false
+	cfg.WechatMchID, cfg.WechatMchSerialNo, cfg.WechatMchKeyPath = "1900000001", "MCHSERIAL", keyPath
+	cfg.WechatAPIv3Key = "0123456789abcdef0123456789abcdef"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("real pay started without a platform certificate")
+	}
+	cfg.WechatPlatformCertPath = certPath
+	cfg.WechatAPIv3Key = "too-short"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("real pay started with a short APIv3 key")
+	}
+	cfg.WechatAPIv3Key = "0123456789abcdef0123456789abcdef"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Shutdown(context.Background())
+}
+
+func TestNewRejectsShortWriteTimeout(t *testing.T) {
+	cfg := config.Default()
+	cfg.AssetsDir, cfg.UploadsDir, cfg.PrivateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	cfg.JWTSecret = "test-secret"
+	if b := algoBudget(cfg); cfg.HTTPWriteTimeout <= b {
+		t.Fatalf("default write timeout %s does not cover the algorithm budget %s", cfg.HTTPWriteTimeout, b)
+	}
+	cfg.HTTPWriteTimeout = cfg.AlgoTimeout
+	if _, err := New(cfg); err == nil {
+		t.Fatal("write timeout shorter than algorithm retries accepted")
+	}
+	cfg.AlgoMode = "local"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Shutdown(context.Background())
+}
+
+func TestShutdownDrainsPoolAndClosesDB(t *testing.T) {
+	s := newTestServer(t)
+	// Swap in a pool whose jobs wait to be released, and a database handle
+	// that never connects, to watch what Shutdown waits for.
+	_ = s.pool.Shutdown(context.Background())
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var ran []string
+	s.pool = worker.NewPool(1, 4, func(id string) {
+		<-release
+		mu.Lock()
+		ran = append(ran, id)
+		mu.Unlock()
+	})
+	pg, err := repo.NewPostgresRepo("postgres://permit@127.0.0.1:1/permit?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.pg = pg
+	for _, id := range []string{"t1", "t2"} {
+		if err := s.pool.Submit(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned with tasks queued: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := s.pool.Submit("t3"); !errors.Is(err, worker.ErrClosed) {
+		t.Fatalf("submit during shutdown: %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 {
+		t.Fatalf("ran %v before shutdown returned", ran)
+	}
+	if err := pg.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("database still open: %v", err)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 2; i++ {
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("shutdown %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestPingRetry(t *testing.T) {
+	calls := 0
+	err := pingRetry(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}, 5, time.Millisecond)
+	if err != nil || calls != 3 {
+		t.Fatalf("err=%v calls=%d", err, calls)
+	}
+	calls = 0
+	err = pingRetry(context.Background(), func(context.Context) error { calls++; return errors.New("down") }, 2, time.Millisecond)
+	if err == nil || calls != 2 {
+		t.Fatalf("err=%v calls=%d", err, calls)
+	}
+}
+
+func TestAlgoBreakerRejectsWithUnavailable(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	s.algo.(*algo.Client).Retries = 0
+	al := algoAdapter{c: s.algo, b: s.breaker}
+	for i := 0; i < s.cfg.AlgoBreakerThreshold; i++ {
+		if _, err := al.AddBackgroundFile(context.Background(), []byte("x"), "ffffff", 0, 300, 0); !algo.IsUnavailable(err) {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	_, err := al.AddBackgroundFile(context.Background(), []byte("x"), "ffffff", 0, 300, 0)
+	if !errors.Is(err, breaker.ErrOpen) || !algo.IsUnavailable(err) {
+		t.Fatalf("open breaker err = %v", err)
+	}
+
+	tok := login(t, h, "breaker")
+	src := uploadPhoto(t, h, tok, "a.jpg", testJPEG(600, 800))
+	rec, body := doJSON(t, h, http.MethodPost, "/api/tasks", tok, map[string]any{"specCode": "passport", "sourceObjectKey": src})
+	e, _ := body["error"].(map[string]any)
+	if rec.Code != http.StatusServiceUnavailable || e["code"] != "AlgoUnavailable" || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("create task with open breaker = %d %v", rec.Code, body)
+	}
+
+	if rec, _ := doJSON(t, h, http.MethodGet, "/metrics", "", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("metrics without admin token = %d", rec.Code)
+	}
+	if rec, _ := doJSON(t, h, http.MethodGet, "/metrics", tok, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("metrics with a user token = %d", rec.Code)
+	}
+	mrec, _ := doAdmin(t, h, http.MethodGet, "/metrics", nil)
+	m := mrec.Body.String()
+	if mrec.Code != http.StatusOK {
+		t.Fatalf("metrics with admin token = %d", mrec.Code)
+	}
+	for _, want := range []string{`permit_algo_breaker_state{state="open"} 1`, "permit_algo_breaker_opened_total 1", `permit_algo_calls_total{result="rejected"} 1`} {
+		if !strings.Contains(m, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, m)
+		}
+	}
+	_, body = doJSON(t, h, http.MethodGet, "/readyz", "", nil)
+	if body["algoBreaker"] != "open" {
+		t.Fatalf("readyz = %v", body)
+	}
+}
+
+func TestLocalAlgoPipeline(t *testing.T) {
+	cfg := config.Default()
+	cfg.AssetsDir, cfg.UploadsDir, cfg.PrivateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	cfg.JWTSecret = "test-secret"
+	cfg.AlgoMode = "grpc"
+	if _, err := New(cfg); err == nil {
+		t.Fatal("unknown algo mode accepted")
+	}
+	cfg.AlgoMode = "local"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	h := s.Handler()
+	tok := login(t, h, "offline")
+
+	key := uploadPhoto(t, h, tok, "me.jpg", testJPEG(600, 800))
+	id := createTask(t, h, tok, "passport", key)
+	if task := waitTask(t, h, tok, id); task["status"] != "done" {
+		t.Fatalf("task failed: %v", task)
+	}
+	// Without face detection the pre-check still measures the photo.
+	if rec, body := doJSON(t, h, http.MethodPost, "/api/uploads/"+strings.TrimPrefix(key, "uploads/")+"/check", tok, nil); rec.Code != http.StatusOK || body["faceCount"] != nil || body["brightness"] == nil {
+		t.Fatalf("check: %d %v", rec.Code, body)
+	}
+
+	if rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/background", tok, map[string]any{"color": "blue"}); rec.Code != http.StatusOK {
+		t.Fatalf("background: %d %v", rec.Code, body)
+	}
+	if rec, body := doJSON(t, h, http.MethodPost, "/api/tasks/"+id+"/layout", tok, map[string]any{"color": "blue"}); rec.Code != http.StatusOK {
+		t.Fatalf("layout: %d %v", rec.Code, body)
+	}
+	_, ready := doJSON(t, h, http.MethodGet, "/readyz", "", nil)
+	if checks, _ := ready["checks"].(map[string]any); ready["status"] != "ok" || checks["algo"].(map[string]any)["mode"] != "local" {
+		t.Fatalf("readyz = %v", ready)
+	}
+}
+
+func TestUploadValidation(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	tok := login(t, h, "uploader")
+
+	for name, c := range map[string]struct {
+		file   string
+		data   []byte
+		reason string
+	}{
+		"renamed pdf": {"scan.jpg", []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n"), photo.ReasonUnsupported},
+		"empty":       {"me.jpg", nil, photo.ReasonEmpty},
+		"truncated":   {"me.jpg", testJPEG(600, 800)[:300], photo.ReasonCorrupt},
+		"tiny":        {"me.png", testJPEG(40, 60), photo.ReasonTooSmall},
+		"extension":   {"me.gif", testJPEG(600, 800), photo.ReasonUnsupported},
+		"heic":        {"me.heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), photo.ReasonUnsupported},
+	} {
+		rec, body := postUpload(t, h, tok, c.file, c.data)
+		e, _ := body["error"].(map[string]any)
+		if rec.Code != http.StatusBadRequest || e["code"] != "InvalidImage" || e["reason"] != c.reason {
+			t.Errorf("%s: %d %v, want reason %s", name, rec.Code, body, c.reason)
+		}
+	}
+
+	s.cfg.UploadMaxDimension = 400
+	rec, body := postUpload(t, h, tok, "big.png", testJPEG(1200, 900))
+	if rec.Code != http.StatusOK || body["width"] != 400.0 || body["height"] != 300.0 {
+		t.Fatalf("downscaled upload = %d %v", rec.Code, body)
+	}
+	key := body["objectKey"].(string)
+	if !strings.HasSuffix(key, "_big.jpg") {
+		t.Fatalf("object key %q should carry the re-encoded extension", key)
+	}
+	data, err := storage.ReadAll(context.Background(), s.uploads, strings.TrimPrefix(key, "uploads/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if photo.Sniff(data) != "jpeg" {
+		t.Fatalf("stored object is %q", photo.Sniff(data))
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.UploadChunkBytes = 4096
+	s.uploadSvc.ChunkBytes = 4096
+	h := s.Handler()
+	tok := login(t, h, "mobile")
+	file := testJPEG(600, 800)
+	sum := sha256.Sum256(file)
+
+	rec, sess := doJSON(t, h, http.MethodPost, "/api/uploads/sessions", tok, map[string]any{"filename": "me.jpg", "size": len(file), "sha256": hex.EncodeToString(sum[:])})
+	if rec.Code != http.StatusCreated || sess["offset"] != 0.0 || sess["chunkSize"] != 4096.0 {
+		t.Fatalf("init = %d %v", rec.Code, sess)
+	}
+	path := "/api/uploads/sessions/" + sess["id"].(string)
+	put := func(off int, chunk []byte) (*httptest.ResponseRecorder, map[string]any) {
+		req := httptest.NewRequest(http.MethodPut, path+"?offset="+strconv.Itoa(off), bytes.NewReader(chunk))
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var out map[string]any
+		_ = json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec, out
+	}
+
+	if rec, body := put(0, file[:4096]); rec.Code != http.StatusOK || body["offset"] != 4096.0 {
+		t.Fatalf("first chunk = %d %v", rec.Code, body)
+	}
+	// After a disconnect the client asks where to resume; a chunk at the
+	// wrong offset is refused with the right one.
+	rec, body := put(0, file[:4096])
+	if e, _ := body["error"].(map[string]any); rec.Code != http.StatusConflict || e["code"] != "OffsetMismatch" || e["offset"] != 4096.0 {
+		t.Fatalf("stale chunk = %d %v", rec.Code, body)
+	}
+	if rec, body := doJSON(t, h, http.MethodGet, path, login(t, h, "someone-else"), nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("other user's session = %d %v", rec.Code, body)
+	}
+	_, cur := doJSON(t, h, http.MethodGet, path, tok, nil)
+	for off := int(cur["offset"].(float64)); off < len(file); off += 4096 {
+		if rec, body := put(off, file[off:min(off+4096, len(file))]); rec.Code != http.StatusOK {
+			t.Fatalf("chunk at %d = %d %v", off, rec.Code, body)
+		}
+	}
+
+	rec, done := doJSON(t, h, http.MethodPost, path+"/complete", tok, nil)
+	if rec.Code != http.StatusOK || done["width"] != 600.0 || !strings.HasSuffix(done["objectKey"].(string), "_me.jpg") {
+		t.Fatalf("complete = %d %v", rec.Code, done)
+	}
+	if rec, task := doJSON(t, h, http.MethodPost, "/api/tasks", tok, map[string]any{"specCode": "passport", "sourceObjectKey": done["objectKey"]}); rec.Code != http.StatusOK {
+		t.Fatalf("task from chunked upload = %d %v", rec.Code, task)
+	}
+
+	rec, body = doJSON(t, h, http.MethodPost, "/api/uploads/sessions", tok, map[string]any{"filename": "me.jpg", "size": 10, "sha256": "nope"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("init with bad sha256 = %d %v", rec.Code, body)
+	}
+	rec, body = doJSON(t, h, http.MethodPost, "/api/uploads/sessions", tok, map[string]any{"filename": "doc.pdf", "size": 10, "sha256": hex.EncodeToString(sum[:])})
+	if e, _ := body["error"].(map[string]any); rec.Code != http.StatusBadRequest || e["code"] != "InvalidImage" {
+		t.Fatalf("init with pdf name = %d %v", rec.Code, body)
+	}
+}
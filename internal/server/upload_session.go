@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"permit-backend/internal/domain"
+	"permit-backend/internal/photo"
+	"permit-backend/internal/usecase"
+)
+
+// Chunked uploads: POST /api/uploads/sessions opens a session, the client
+// PUTs the file in order with ?offset=, GETs the session to learn where to
+// resume after a disconnect, and POSTs .../complete to get the objectKey a
+// single-shot /api/upload would have returned.
+
+type initUploadSessionReq struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+func (s *Server) handleInitUploadSession(w http.ResponseWriter, r *http.Request) {
+	var req initUploadSessionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "invalid json")
+		return
+	}
+	name := filepath.Base(req.Filename)
+	if !s.validImageName(name) {
+		s.rejectImage(w, r, &photo.Rejection{Reason: photo.ReasonUnsupported, Message: s.imageNameHint()})
+		return
+	}
+	sess, err := s.uploadSvc.Init(userIDFrom(r), name, req.Size, req.SHA256)
+	if err != nil {
+		s.uploadErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusCreated, s.uploadSessionView(sess))
+}
+
+func (s *Server) handleGetUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess, err := s.uploadSvc.Get(userIDFrom(r), id)
+	if err != nil {
+		s.uploadErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, s.uploadSessionView(sess))
+}
+
+// handlePutUploadChunk takes the raw chunk as the body. X-Chunk-SHA256, when
+// sent, is checked before the chunk is kept.
+func (s *Server) handlePutUploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "offset query parameter required")
+		return
+	}
+	// One byte past the limit is enough for the service to reject it.
+	data, err := io.ReadAll(io.LimitReader(r.Body, s.cfg.UploadChunkBytes+1))
+	if err != nil {
+		s.err(w, r, http.StatusBadRequest, "BadRequest", "cannot read chunk")
+		return
+	}
+	sess, err := s.uploadSvc.PutChunk(r.Context(), userIDFrom(r), id, offset, data, r.Header.Get("X-Chunk-SHA256"))
+	if err != nil {
+		s.uploadErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, s.uploadSessionView(sess))
+}
+
+func (s *Server) handleCompleteUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess, err := s.uploadSvc.Complete(r.Context(), userIDFrom(r), id)
+	if err != nil {
+		s.uploadErr(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, map[string]any{
+		"objectKey": sess.ObjectKey,
+		"width":     sess.Width,
+		"height":    sess.Height,
+	})
+}
+
+func (s *Server) uploadSessionView(sess *domain.UploadSession) map[string]any {
+	v := map[string]any{
+		"id":        sess.ID,
+		"status":    sess.Status,
+		"size":      sess.Size,
+		"offset":    sess.Received,
+		"chunkSize": s.cfg.UploadChunkBytes,
+		"expiresAt": sess.ExpiresAt,
+	}
+	if sess.Status == domain.UploadCompleted {
+		v["objectKey"] = sess.ObjectKey
+	}
+	return v
+}
+
+// uploadErr maps upload session errors. An offset mismatch carries the
+// offset to resume from.
+func (s *Server) uploadErr(w http.ResponseWriter, r *http.Request, err error) {
+	var rej *photo.Rejection
+	if errors.As(err, &rej) {
+		s.rejectImage(w, r, rej)
+		return
+	}
+	switch e := err.(type) {
+	case usecase.ErrOffsetMismatch:
+		s.errDetail(w, r, http.StatusConflict, "OffsetMismatch", e.Error(), map[string]any{"offset": e.Offset})
+	case usecase.ErrChecksum:
+		s.err(w, r, http.StatusBadRequest, "ChecksumMismatch", e.Error())
+	case usecase.ErrBadRequest:
+		s.err(w, r, http.StatusBadRequest, "BadRequest", e.Error())
+	case usecase.ErrNotFound:
+		s.err(w, r, http.StatusNotFound, "NotFound", e.Error())
+	case usecase.ErrConflict:
+		s.err(w, r, http.StatusConflict, "Conflict", e.Error())
+	default:
+		log.Printf("upload session: %v", err)
+		s.err(w, r, http.StatusInternalServerError, "ServerError", "upload failed")
+	}
+}
+
+// sweepUploads removes expired upload sessions every interval until
+// Shutdown.
+func (s *Server) sweepUploads(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			if n, err := s.uploadSvc.Expire(context.Background(), now); err != nil {
+				log.Printf("expire upload sessions: %v", err)
+			} else if n > 0 {
+				log.Printf("expired %d upload sessions", n)
+			}
+		}
+	}
+}
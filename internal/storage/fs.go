@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS stores objects as files under Root.
+type FS struct {
+	Root string
+}
+
+func NewFS(root string) *FS {
+	return &FS{Root: root}
+}
+
+func (f *FS) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get returns an *os.File, so callers may type-assert io.Seeker.
+func (f *FS) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	file, err := os.Open(f.path(key))
+	if err != nil {
+		return nil, ObjectInfo{}, mapErr(err)
+	}
+	st, err := file.Stat()
+	if err != nil || st.IsDir() {
+		file.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return file, infoOf(key, st), nil
+}
+
+func (f *FS) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	st, err := os.Stat(f.path(key))
+	if err != nil {
+		return ObjectInfo{}, mapErr(err)
+	}
+	if st.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return infoOf(key, st), nil
+}
+
+func (f *FS) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(f.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FS) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
+
+// path maps key under Root; cleaning against "/" keeps ".." from escaping.
+func (f *FS) path(key string) string {
+	return filepath.Join(f.Root, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func infoOf(key string, st os.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        st.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		ETag:        fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size()),
+		ModTime:     st.ModTime(),
+	}
+}
+
+func mapErr(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
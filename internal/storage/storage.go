@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("object not found")
+	ErrUnsupported = errors.New("operation not supported by backend")
+)
+
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ETag        string
+	ModTime     time.Time
+}
+
+// Storage is a flat object store addressed by slash-separated keys.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// PresignGet returns a URL that fetches key directly from the backend
+	// without further authentication. Backends that cannot do this return
+	// ErrUnsupported.
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// ReadAll fetches key and returns its content.
+func ReadAll(ctx context.Context, s Storage, key string) ([]byte, error) {
+	rc, _, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// WithPrefix scopes s to keys under prefix, so several logical stores can
+// share one bucket.
+func WithPrefix(s Storage, prefix string) Storage {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefixed{s: s, prefix: prefix}
+}
+
+type prefixed struct {
+	s      Storage
+	prefix string
+}
+
+func (p prefixed) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return p.s.Put(ctx, p.prefix+key, r, size, contentType)
+}
+
+func (p prefixed) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	rc, info, err := p.s.Get(ctx, p.prefix+key)
+	info.Key = key
+	return rc, info, err
+}
+
+func (p prefixed) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := p.s.Stat(ctx, p.prefix+key)
+	info.Key = key
+	return info, err
+}
+
+func (p prefixed) Delete(ctx context.Context, key string) error {
+	return p.s.Delete(ctx, p.prefix+key)
+}
+
+func (p prefixed) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return p.s.PresignGet(ctx, p.prefix+key, ttl)
+}
@@ -0,0 +1,141 @@
+package usecase
+
+import (
+	"strings"
+	"sync"
+
+	"permit-backend/internal/domain"
+)
+
+type ColorRepo interface {
+	UpsertColors([]domain.Color) error
+	ListColors() ([]domain.Color, error)
+	DeleteColor(name string) error
+}
+
+// ColorService is the background colour registry.
+type ColorService struct {
+	mu   sync.Mutex
+	Repo ColorRepo
+}
+
+// Seed stores defs when the registry is empty.
+func (s *ColorService) Seed(defs []domain.Color) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items, err := s.Repo.ListColors()
+	if err != nil || len(items) > 0 {
+		return err
+	}
+	return s.Repo.UpsertColors(defs)
+}
+
+func (s *ColorService) List() ([]domain.Color, error) {
+	return s.Repo.ListColors()
+}
+
+// Resolve maps a request colour to a registry entry. "#rrggbb" is accepted
+// only when allowCustom is set.
+func (s *ColorService) Resolve(name string, allowCustom bool) (domain.Color, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if strings.HasPrefix(name, "#") {
+		if !allowCustom {
+			return domain.Color{}, ErrBadRequest("custom colors not allowed for this spec")
+		}
+		hex, ok := domain.ParseHex(name)
+		if !ok {
+			return domain.Color{}, ErrBadRequest("invalid color " + name)
+		}
+		return domain.Color{Name: "#" + hex, DisplayName: "#" + hex, Hex: hex}, nil
+	}
+	c, err := s.get(name)
+	if err != nil {
+		return domain.Color{}, err
+	}
+	if c == nil {
+		return domain.Color{}, ErrBadRequest("unknown color " + name)
+	}
+	return *c, nil
+}
+
+func (s *ColorService) Save(c domain.Color) (domain.Color, error) {
+	c.Name = strings.ToLower(strings.TrimSpace(c.Name))
+	if c.Name == "" || strings.HasPrefix(c.Name, "#") || strings.ContainsAny(c.Name, "/\\ ") {
+		return c, ErrBadRequest("invalid color name")
+	}
+	if c.Gradient != nil {
+		if c.Gradient.Mode == "" {
+			c.Gradient.Mode = domain.GradientLinear
+		}
+		if c.Gradient.Mode != domain.GradientLinear && c.Gradient.Mode != domain.GradientRadial {
+			return c, ErrBadRequest("gradient mode must be linear or radial")
+		}
+		// The algorithm only takes the start colour and always fades to
+		// white, so any other stops would be dropped without notice.
+		if len(c.Gradient.Stops) != 2 {
+			return c, ErrBadRequest("gradient must have exactly two stops: a color and ffffff")
+		}
+		for i, st := range c.Gradient.Stops {
+			hex, ok := domain.ParseHex(st)
+			if !ok {
+				return c, ErrBadRequest("invalid gradient stop " + st)
+			}
+			c.Gradient.Stops[i] = hex
+		}
+		if c.Gradient.Stops[1] != "ffffff" {
+			return c, ErrBadRequest("gradient must end in ffffff")
+		}
+		c.Hex = c.Gradient.Stops[0]
+	}
+	hex, ok := domain.ParseHex(c.Hex)
+	if !ok {
+		return c, ErrBadRequest("invalid hex " + c.Hex)
+	}
+	c.Hex = hex
+	if c.DisplayName == "" {
+		c.DisplayName = c.Name
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return c, s.Repo.UpsertColors([]domain.Color{c})
+}
+
+func (s *ColorService) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.get(strings.ToLower(strings.TrimSpace(name)))
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return ErrNotFound("color")
+	}
+	return s.Repo.DeleteColor(c.Name)
+}
+
+func (s *ColorService) get(name string) (*domain.Color, error) {
+	items, err := s.Repo.ListColors()
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		if it.Name == name {
+			return &it, nil
+		}
+	}
+	return nil, nil
+}
+
+// DefaultColors covers every colour name used by DefaultSpecs.
+func DefaultColors() []domain.Color {
+	return []domain.Color{
+		{Name: "white", DisplayName: "白色", Hex: "ffffff"},
+		{Name: "blue", DisplayName: "蓝色", Hex: "638cce"},
+		{Name: "red", DisplayName: "红色", Hex: "ff0000"},
+		{Name: "tint", DisplayName: "浅灰", Hex: "f2f0f0"},
+		{Name: "grey", DisplayName: "灰色", Hex: "a0a0a0"},
+		{Name: "dark_blue", DisplayName: "深蓝", Hex: "4b6190"},
+		{Name: "sky_blue", DisplayName: "天蓝", Hex: "8ec5e9"},
+		{Name: "gradient", DisplayName: "渐变蓝", Hex: "638cce", Gradient: &domain.Gradient{Mode: domain.GradientLinear, Stops: []string{"638cce", "ffffff"}}},
+	}
+}
@@ -3,6 +3,7 @@ package usecase
 import (
 	"encoding/json"
 	"permit-backend/internal/domain"
+	"permit-backend/internal/infrastructure/wechat"
 	"strconv"
 	"time"
 )
@@ -10,16 +11,95 @@ import (
 type OrderRepo interface {
 	Put(*domain.Order) error
 	Get(id string) (*domain.Order, bool)
-	List(page, pageSize int) ([]domain.Order, int)
+	List(userID string, page, pageSize int) ([]domain.Order, int)
+	ListByTask(taskID string) ([]domain.Order, error)
+	// PutWithTransition stores o and, when t is not nil, records t
+	// atomically with it.
+	PutWithTransition(o *domain.Order, t *domain.OrderTransition) error
+	// UpdateOrder stores o only if the stored order's status is still from,
+	// recording t (when not nil) in the same write, and reports whether it
+	// did. RefundedCents is left as stored; FinishRefund owns it.
+	UpdateOrder(o *domain.Order, from domain.OrderStatus, t *domain.OrderTransition) (bool, error)
+	ListTransitions(orderID string) ([]domain.OrderTransition, error)
+	PutRefund(*domain.Refund) error
+	// ReserveRefund atomically stores rf as processing when its order is
+	// paid and rf.AmountCents (0 meaning all of it) is within the amount
+	// neither refunded nor being refunded. It returns that amount and
+	// whether rf was stored.
+	ReserveRefund(rf *domain.Refund) (refundable int, ok bool, err error)
+	// FinishRefund atomically moves a processing refund to st, adding its
+	// amount to the order's refunded cents on success, and returns the
+	// order. changed is false when the refund was not processing.
+	FinishRefund(refundID string, st domain.RefundStatus, providerRefundID string, at time.Time) (o *domain.Order, changed bool, err error)
+	GetRefund(id string) (*domain.Refund, bool)
+	ListRefunds(orderID string) ([]domain.Refund, error)
+}
+
+type WechatPayClient interface {
+	Prepay(outTradeNo, description, openID string, amountCents int) (string, error)
+	PayParams(prepayID string) (map[string]any, error)
+	Refund(outTradeNo, outRefundNo, reason string, refundCents, totalCents int) (string, string, error)
 }
 
 type OrderService struct {
 	Repo        OrderRepo
 	PayMock     bool
 	WechatAppID string
+	WechatMchID string
+	WechatPay   WechatPayClient
+	Catalog     domain.PriceCatalog
+}
+
+type RefundNotification struct {
+	OutRefundNo string
+	RefundID    string
+	MchID       string
+	Status      string
+	AmountCents int
+}
+
+type PayNotification struct {
+	OutTradeNo    string
+	TransactionID string
+	MchID         string
+	TradeState    string
+	AmountCents   int
+}
+
+func (s *OrderService) GetForUser(userID, orderID string) (*domain.Order, error) {
+	o, ok := s.Repo.Get(orderID)
+	if !ok || userID == "" || o.UserID != userID {
+		return nil, ErrNotFound("order")
+	}
+	return o, nil
+}
+
+func (s *OrderService) PaidForTask(userID, taskID string) bool {
+	orders, err := s.Repo.ListByTask(taskID)
+	if err != nil {
+		return false
+	}
+	for _, o := range orders {
+		if o.UserID == userID && o.Status == domain.OrderPaid {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *OrderService) Quote(items []domain.OrderItem, city string) (int, error) {
+	return Quote(s.Catalog, items, city)
 }
 
 func (s *OrderService) Create(req *domain.Order) (string, error) {
+	amount, err := s.Quote(req.Items, req.City)
+	if err != nil {
+		return "", err
+	}
+	if req.AmountCents != 0 && req.AmountCents != amount {
+		return "", ErrBadRequest("amount mismatch, expected " + strconv.Itoa(amount))
+	}
+	req.AmountCents = amount
 	id := randomID()
 	now := time.Now().UTC()
 	req.OrderID = id
@@ -28,11 +108,13 @@ func (s *OrderService) Create(req *domain.Order) (string, error) {
 	req.PayParams = ""
 	req.CreatedAt = now
 	req.UpdatedAt = now
-	_ = s.Repo.Put(req)
+	if err := s.Repo.PutWithTransition(req, &domain.OrderTransition{OrderID: id, To: domain.OrderCreated, Actor: "user", At: now}); err != nil {
+		return "", err
+	}
 	return id, nil
 }
 
-func (s *OrderService) Pay(orderID, channel, idempotencyKey string) (map[string]any, error) {
+func (s *OrderService) Pay(orderID, channel, idempotencyKey, openID string) (map[string]any, error) {
 	o, ok := s.Repo.Get(orderID)
 	if !ok {
 		return nil, ErrNotFound("order")
@@ -40,6 +122,9 @@ func (s *OrderService) Pay(orderID, channel, idempotencyKey string) (map[string]
 	if o.Status == domain.OrderPaid {
 		return nil, ErrConflict("order already paid")
 	}
+	if o.Status != domain.OrderPending && !o.Status.CanTransitionTo(domain.OrderPending) {
+		return nil, ErrInvalidTransition{From: o.Status, To: domain.OrderPending}
+	}
 	if o.PayIdempotencyKey != "" && o.PayIdempotencyKey != idempotencyKey {
 		return nil, ErrConflict("idempotency key mismatch")
 	}
@@ -49,47 +134,244 @@ func (s *OrderService) Pay(orderID, channel, idempotencyKey string) (map[string]
 			return cached, nil
 		}
 	}
+	var p map[string]any
+	if s.PayMock {
+		prepayID := "mock-" + randomID()
+		p = map[string]any{
+			"appId":     s.WechatAppID,
+			"timeStamp": strconv.FormatInt(time.Now().Unix(), 10),
+			"nonceStr":  randomID(),
+			"package":   "prepay_id=" + prepayID,
+			"signType":  "RSA",
+			"paySign":   "MOCK_SIGN",
+		}
+	} else {
+		if channel != "wechat" || s.WechatPay == nil {
+			return nil, ErrNotImplemented("payment channel " + channel + " not configured")
+		}
+		if openID == "" {
+			return nil, ErrBadRequest("payer openid required")
+		}
+		prepayID, err := s.WechatPay.Prepay(o.OrderID, "证件照订单", openID, o.AmountCents)
+		if err != nil {
+			return nil, ErrUpstream(err.Error())
+		}
+		p, err = s.WechatPay.PayParams(prepayID)
+		if err != nil {
+			return nil, err
+		}
+	}
 	o.Channel = channel
-	o.Status = domain.OrderPending
 	o.PayIdempotencyKey = idempotencyKey
-	o.UpdatedAt = time.Now().UTC()
-	prepayID := "mock-" + randomID()
-	p := map[string]any{
-		"appId":     s.WechatAppID,
-		"timeStamp": strconv.FormatInt(time.Now().Unix(), 10),
-		"nonceStr":  randomID(),
-		"package":   "prepay_id=" + prepayID,
-		"signType":  "RSA",
-		"paySign":   "MOCK_SIGN",
-	}
 	raw, _ := json.Marshal(p)
 	o.PayParams = string(raw)
-	_ = s.Repo.Put(o)
+	if err := s.transition(o, domain.OrderPending, "user"); err != nil {
+		return nil, err
+	}
 	return p, nil
 }
 
+func (s *OrderService) ConfirmPayment(n PayNotification) error {
+	if n.MchID != s.WechatMchID {
+		return ErrBadRequest("mchid mismatch")
+	}
+	o, ok := s.Repo.Get(n.OutTradeNo)
+	if !ok {
+		return ErrNotFound("order")
+	}
+	if n.TradeState != "SUCCESS" {
+		return nil
+	}
+	if n.AmountCents != o.AmountCents {
+		return ErrBadRequest("amount mismatch")
+	}
+	// A Pay that lands first moves the order to pending under us; that
+	// still leads to paid, so read it again and retry.
+	for attempt := 0; ; attempt++ {
+		if o.Status == domain.OrderPaid {
+			return nil
+		}
+		o.TransactionID = n.TransactionID
+		err := s.transition(o, domain.OrderPaid, "wechat")
+		it, lost := err.(ErrInvalidTransition)
+		if !lost || attempt == 2 {
+			return err
+		}
+		if it.From != domain.OrderPaid && !it.From.CanTransitionTo(domain.OrderPaid) {
+			return err
+		}
+		if o, ok = s.Repo.Get(n.OutTradeNo); !ok {
+			return ErrNotFound("order")
+		}
+	}
+}
+
 func (s *OrderService) Callback(orderID, status string) error {
 	o, ok := s.Repo.Get(orderID)
 	if !ok {
 		return ErrNotFound("order")
 	}
-	switch status {
-	case "paid":
-		o.Status = domain.OrderPaid
-	case "pending":
-		o.Status = domain.OrderPending
-	case "canceled":
-		o.Status = domain.OrderCanceled
-	case "refunded":
-		o.Status = domain.OrderRefunded
-	default:
+	to := domain.OrderStatus(status)
+	if !to.Valid() {
 		return ErrBadRequest("invalid status")
 	}
-	o.UpdatedAt = time.Now().UTC()
-	_ = s.Repo.Put(o)
+	return s.transition(o, to, "callback")
+}
+
+// Refund starts a refund of amountCents (0 for everything still refundable)
+// of a paid order. The amount is reserved in the repo before the provider is
+// called, so concurrent refunds cannot exceed the order total.
+func (s *OrderService) Refund(orderID string, amountCents int, reason string) (*domain.Refund, error) {
+	o, ok := s.Repo.Get(orderID)
+	if !ok {
+		return nil, ErrNotFound("order")
+	}
+	if o.Status != domain.OrderPaid {
+		return nil, ErrInvalidTransition{From: o.Status, To: domain.OrderRefunded}
+	}
+	if amountCents < 0 {
+		return nil, ErrBadRequest("refund amount must not be negative")
+	}
+	if !s.PayMock && s.WechatPay == nil {
+		return nil, ErrNotImplemented("refund provider not configured")
+	}
+	now := time.Now().UTC()
+	rf := &domain.Refund{
+		RefundID:    randomID(),
+		OrderID:     orderID,
+		AmountCents: amountCents,
+		Reason:      reason,
+		Status:      domain.RefundProcessing,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if s.PayMock {
+		rf.ProviderRefundID = "mock-" + randomID()
+	}
+	refundable, ok, err := s.Repo.ReserveRefund(rf)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrBadRequest("refund amount exceeds refundable " + strconv.Itoa(refundable))
+	}
+	if s.PayMock {
+		return rf, s.finishRefund(rf, domain.RefundSuccess, "")
+	}
+	providerID, status, err := s.WechatPay.Refund(o.OrderID, rf.RefundID, reason, rf.AmountCents, o.AmountCents)
+	if err != nil {
+		// Only a definite rejection frees the reserved amount. Otherwise the
+		// provider may still have taken the refund; it stays processing until
+		// the refund notification settles it.
+		if wechat.IsRejected(err) {
+			if ferr := s.finishRefund(rf, domain.RefundAbnormal, ""); ferr != nil {
+				return nil, ferr
+			}
+		}
+		return nil, ErrUpstream(err.Error())
+	}
+	st, _ := refundStatusOf(status)
+	return rf, s.finishRefund(rf, st, providerID)
+}
+
+func (s *OrderService) ConfirmRefund(n RefundNotification) error {
+	if n.MchID != s.WechatMchID {
+		return ErrBadRequest("mchid mismatch")
+	}
+	rf, ok := s.Repo.GetRefund(n.OutRefundNo)
+	if !ok {
+		return ErrNotFound("refund")
+	}
+	if rf.Status != domain.RefundProcessing {
+		return nil
+	}
+	if n.AmountCents != rf.AmountCents {
+		return ErrBadRequest("refund amount mismatch")
+	}
+	st, done := refundStatusOf(n.Status)
+	if !done {
+		return nil
+	}
+	return s.finishRefund(rf, st, n.RefundID)
+}
+
+func (s *OrderService) Refunds(orderID string) ([]domain.Refund, error) {
+	if _, ok := s.Repo.Get(orderID); !ok {
+		return nil, ErrNotFound("order")
+	}
+	return s.Repo.ListRefunds(orderID)
+}
+
+// finishRefund records st for a processing refund; st may stay processing to
+// store only the provider's refund id. A refund that was already finished,
+// e.g. by a notification that beat the provider's response, is left alone.
+func (s *OrderService) finishRefund(rf *domain.Refund, st domain.RefundStatus, providerID string) error {
+	now := time.Now().UTC()
+	o, changed, err := s.Repo.FinishRefund(rf.RefundID, st, providerID, now)
+	if err != nil || !changed {
+		return err
+	}
+	rf.Status = st
+	rf.UpdatedAt = now
+	if providerID != "" {
+		rf.ProviderRefundID = providerID
+	}
+	if st == domain.RefundSuccess && o.RefundedCents >= o.AmountCents && o.Status != domain.OrderRefunded {
+		err := s.transition(o, domain.OrderRefunded, "refund")
+		// Another refund finishing at the same time got there first.
+		if it, ok := err.(ErrInvalidTransition); ok && it.From == domain.OrderRefunded {
+			return nil
+		}
+		return err
+	}
 	return nil
 }
 
+func refundStatusOf(providerStatus string) (domain.RefundStatus, bool) {
+	switch providerStatus {
+	case "SUCCESS":
+		return domain.RefundSuccess, true
+	case "CLOSED":
+		return domain.RefundClosed, true
+	case "ABNORMAL":
+		return domain.RefundAbnormal, true
+	default:
+		return domain.RefundProcessing, false
+	}
+}
+
+func (s *OrderService) Transitions(orderID string) ([]domain.OrderTransition, error) {
+	if _, ok := s.Repo.Get(orderID); !ok {
+		return nil, ErrNotFound("order")
+	}
+	return s.Repo.ListTransitions(orderID)
+}
+
+func (s *OrderService) transition(o *domain.Order, to domain.OrderStatus, actor string) error {
+	from := o.Status
+	now := time.Now().UTC()
+	if from != to && !from.CanTransitionTo(to) {
+		return ErrInvalidTransition{From: from, To: to}
+	}
+	o.Status = to
+	o.UpdatedAt = now
+	var tr *domain.OrderTransition
+	if from != to {
+		tr = &domain.OrderTransition{OrderID: o.OrderID, From: from, To: to, Actor: actor, At: now}
+	}
+	// o was read earlier; only write it if nobody moved the order since.
+	ok, err := s.Repo.UpdateOrder(o, from, tr)
+	if err != nil || ok {
+		return err
+	}
+	cur, found := s.Repo.Get(o.OrderID)
+	if !found {
+		return ErrNotFound("order")
+	}
+	o.Status = cur.Status
+	return ErrInvalidTransition{From: cur.Status, To: to}
+}
+
 type ErrNotFound string
 
 func (e ErrNotFound) Error() string { return string(e) + " not found" }
@@ -101,3 +383,24 @@ func (e ErrConflict) Error() string { return string(e) }
 type ErrBadRequest string
 
 func (e ErrBadRequest) Error() string { return string(e) }
+
+type ErrInvalidTransition struct {
+	From domain.OrderStatus
+	To   domain.OrderStatus
+}
+
+func (e ErrInvalidTransition) Error() string {
+	return "illegal order transition " + string(e.From) + " -> " + string(e.To)
+}
+
+type ErrNotImplemented string
+
+func (e ErrNotImplemented) Error() string { return string(e) }
+
+type ErrUpstream string
+
+func (e ErrUpstream) Error() string { return string(e) }
+
+type ErrUnavailable string
+
+func (e ErrUnavailable) Error() string { return string(e) }
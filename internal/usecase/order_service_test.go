@@ -0,0 +1,311 @@
+package usecase
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"permit-backend/internal/domain"
+	"permit-backend/internal/infrastructure/repo"
+	"permit-backend/internal/infrastructure/wechat"
+)
+
+func TestOrderService_Transitions(t *testing.T) {
+	svc := &OrderService{Repo: repo.NewMemoryOrderRepo(), PayMock: true, WechatMchID: "1900000001", Catalog: DefaultPriceCatalog()}
+	id, err := svc.Create(&domain.Order{TaskID: "task-1", Items: []domain.OrderItem{{Type: "electronic", Qty: 1}}})
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+
+	if err := svc.Callback(id, "refunded"); err == nil {
+		t.Fatalf("created -> refunded should be rejected")
+	} else if _, ok := err.(ErrInvalidTransition); !ok {
+		t.Fatalf("expected ErrInvalidTransition, got %T", err)
+	}
+	if _, err := svc.Pay(id, "wechat", "key-1", ""); err != nil {
+		t.Fatalf("Pay error: %v", err)
+	}
+	if err := svc.ConfirmPayment(PayNotification{OutTradeNo: id, MchID: "1900000001", TradeState: "SUCCESS", AmountCents: 1}); err == nil {
+		t.Fatalf("amount mismatch should be rejected")
+	}
+	if err := svc.ConfirmPayment(PayNotification{OutTradeNo: id, TransactionID: "tx-1", MchID: "1900000001", TradeState: "SUCCESS", AmountCents: 990}); err != nil {
+		t.Fatalf("ConfirmPayment error: %v", err)
+	}
+	if err := svc.Callback(id, "pending"); err == nil {
+		t.Fatalf("paid -> pending should be rejected")
+	}
+
+	hist, err := svc.Transitions(id)
+	if err != nil {
+		t.Fatalf("Transitions error: %v", err)
+	}
+	want := []domain.OrderStatus{domain.OrderCreated, domain.OrderPending, domain.OrderPaid}
+	if len(hist) != len(want) {
+		t.Fatalf("unexpected history: %+v", hist)
+	}
+	for i, h := range hist {
+		if h.To != want[i] {
+			t.Fatalf("history[%d] = %s, want %s", i, h.To, want[i])
+		}
+	}
+	if hist[2].Actor != "wechat" || hist[2].From != domain.OrderPending {
+		t.Fatalf("unexpected paid transition: %+v", hist[2])
+	}
+}
+
+// slowReads widens the gap between reading an order and writing it back,
+// where concurrent updates used to overwrite each other.
+type slowReads struct{ OrderRepo }
+
+func (r slowReads) Get(id string) (*domain.Order, bool) {
+	o, ok := r.OrderRepo.Get(id)
+	time.Sleep(time.Millisecond)
+	return o, ok
+}
+
+func TestOrderService_PayRacesNotify(t *testing.T) {
+	svc := &OrderService{Repo: slowReads{repo.NewMemoryOrderRepo()}, PayMock: true, WechatMchID: "1900000001", Catalog: DefaultPriceCatalog()}
+	for i := 0; i < 50; i++ {
+		id, err := svc.Create(&domain.Order{TaskID: "task-1", Items: []domain.OrderItem{{Type: "electronic", Qty: 1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var notifyErr [2]error
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, _ = svc.Pay(id, "wechat", "key-1", "")
+		}()
+		for n := 0; n < 2; n++ {
+			go func() {
+				defer wg.Done()
+				notifyErr[n] = svc.ConfirmPayment(PayNotification{OutTradeNo: id, TransactionID: "tx-1", MchID: "1900000001", TradeState: "SUCCESS", AmountCents: 990})
+			}()
+		}
+		wg.Wait()
+		for _, err := range notifyErr {
+			if err != nil {
+				t.Fatalf("notify: %v", err)
+			}
+		}
+		o, _ := svc.Repo.Get(id)
+		hist, _ := svc.Transitions(id)
+		if o.Status != domain.OrderPaid {
+			t.Fatalf("order %s after pay and notify", o.Status)
+		}
+		// The history is one unbroken chain that reaches paid exactly once.
+		paid := 0
+		for j, h := range hist {
+			if j > 0 && h.From != hist[j-1].To {
+				t.Fatalf("broken history: %+v", hist)
+			}
+			if h.To == domain.OrderPaid {
+				paid++
+			}
+		}
+		if paid != 1 || hist[len(hist)-1].To != domain.OrderPaid {
+			t.Fatalf("history: %+v", hist)
+		}
+	}
+}
+
+type fakeWechatPay struct {
+	mu      sync.Mutex
+	refunds []int
+	delay   time.Duration
+	err     error
+}
+
+func (f *fakeWechatPay) Prepay(outTradeNo, description, openID string, amountCents int) (string, error) {
+	return "wx-prepay", nil
+}
+func (f *fakeWechatPay) PayParams(prepayID string) (map[string]any, error) {
+	return map[string]any{"package": "prepay_id=" + prepayID}, nil
+}
+func (f *fakeWechatPay) Refund(outTradeNo, outRefundNo, reason string, refundCents, totalCents int) (string, string, error) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return "", "", f.err
+	}
+	f.refunds = append(f.refunds, refundCents)
+	return "wx-refund-" + outRefundNo, "PROCESSING", nil
+}
+
+func TestOrderService_RefundProviderErrors(t *testing.T) {
+	wp := &fakeWechatPay{}
+	svc := &OrderService{Repo: repo.NewMemoryOrderRepo(), WechatMchID: "mch", WechatPay: wp, Catalog: DefaultPriceCatalog()}
+	id, err := svc.Create(&domain.Order{TaskID: "task-1", Items: []domain.OrderItem{{Type: "print", Qty: 2}}, City: "上海"})
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	if _, err := svc.Pay(id, "wechat", "key-1", "openid-1"); err != nil {
+		t.Fatalf("Pay error: %v", err)
+	}
+	if err := svc.ConfirmPayment(PayNotification{OutTradeNo: id, MchID: "mch", TradeState: "SUCCESS", AmountCents: 4980}); err != nil {
+		t.Fatalf("ConfirmPayment error: %v", err)
+	}
+
+	// A rejection means nothing was refunded, so the amount is free again.
+	wp.err = &wechat.PayError{StatusCode: 400, Code: "PARAM_ERROR", Message: "bad"}
+	if _, err := svc.Refund(id, 4980, ""); err == nil {
+		t.Fatal("rejected refund returned no error")
+	} else if _, ok := err.(ErrUpstream); !ok {
+		t.Fatalf("rejected refund error = %T %v", err, err)
+	}
+	refunds, _ := svc.Refunds(id)
+	if len(refunds) != 1 || refunds[0].Status != domain.RefundAbnormal {
+		t.Fatalf("refunds after rejection = %+v", refunds)
+	}
+
+	// Without an answer the refund may have gone through: keep it reserved.
+	for _, perr := range []error{&wechat.PayError{StatusCode: 503, Code: "SYSTEM_ERROR"}, errors.New("connection reset")} {
+		wp.err = perr
+		if _, err := svc.Refund(id, 4980, ""); err == nil {
+			t.Fatalf("refund with %v returned no error", perr)
+		}
+	}
+	refunds, _ = svc.Refunds(id)
+	if len(refunds) != 2 || refunds[1].Status != domain.RefundProcessing {
+		t.Fatalf("refunds after unknown outcomes = %+v", refunds)
+	}
+	wp.err = nil
+	if _, err := svc.Refund(id, 1, ""); err == nil {
+		t.Fatal("refund beyond the outstanding reservation accepted")
+	}
+
+	// The notification settles the refund left processing.
+	if err := svc.ConfirmRefund(RefundNotification{MchID: "mch", OutRefundNo: refunds[1].RefundID, RefundID: "wx-1", Status: "SUCCESS", AmountCents: 4980}); err != nil {
+		t.Fatalf("ConfirmRefund error: %v", err)
+	}
+	if o, _ := svc.Repo.Get(id); o.Status != domain.OrderRefunded {
+		t.Fatalf("status = %s after the refund notification", o.Status)
+	}
+}
+
+func TestOrderService_PartialRefunds(t *testing.T) {
+	wp := &fakeWechatPay{}
+	svc := &OrderService{Repo: repo.NewMemoryOrderRepo(), WechatMchID: "mch", WechatPay: wp, Catalog: DefaultPriceCatalog()}
+	id, err := svc.Create(&domain.Order{TaskID: "task-1", Items: []domain.OrderItem{{Type: "print", Qty: 2}}, City: "上海"})
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	if _, err := svc.Refund(id, 100, ""); err == nil {
+		t.Fatalf("refund before payment should be rejected")
+	}
+	if _, err := svc.Pay(id, "wechat", "key-1", "openid-1"); err != nil {
+		t.Fatalf("Pay error: %v", err)
+	}
+	if err := svc.ConfirmPayment(PayNotification{OutTradeNo: id, MchID: "mch", TradeState: "SUCCESS", AmountCents: 4980}); err != nil {
+		t.Fatalf("ConfirmPayment error: %v", err)
+	}
+
+	first, err := svc.Refund(id, 300, "partial")
+	if err != nil {
+		t.Fatalf("Refund error: %v", err)
+	}
+	if first.Status != domain.RefundProcessing {
+		t.Fatalf("expected processing refund, got %s", first.Status)
+	}
+	if _, err := svc.Refund(id, 4800, ""); err == nil {
+		t.Fatalf("refund exceeding remaining amount should be rejected")
+	}
+	if err := svc.ConfirmRefund(RefundNotification{OutRefundNo: first.RefundID, MchID: "mch", Status: "SUCCESS", AmountCents: 300}); err != nil {
+		t.Fatalf("ConfirmRefund error: %v", err)
+	}
+	o, _ := svc.Repo.Get(id)
+	if o.Status != domain.OrderPaid || o.RefundedCents != 300 {
+		t.Fatalf("after partial refund: status=%s refunded=%d", o.Status, o.RefundedCents)
+	}
+
+	rest, err := svc.Refund(id, 0, "rest")
+	if err != nil {
+		t.Fatalf("Refund remaining error: %v", err)
+	}
+	if rest.AmountCents != 4680 {
+		t.Fatalf("expected remaining 4680, got %d", rest.AmountCents)
+	}
+	if err := svc.ConfirmRefund(RefundNotification{OutRefundNo: rest.RefundID, MchID: "mch", Status: "SUCCESS", AmountCents: 4680}); err != nil {
+		t.Fatalf("ConfirmRefund error: %v", err)
+	}
+	o, _ = svc.Repo.Get(id)
+	if o.Status != domain.OrderRefunded || o.RefundedCents != 4980 {
+		t.Fatalf("after full refund: status=%s refunded=%d", o.Status, o.RefundedCents)
+	}
+	if len(wp.refunds) != 2 {
+		t.Fatalf("expected 2 provider refund calls, got %v", wp.refunds)
+	}
+}
+
+func TestOrderService_ConcurrentRefunds(t *testing.T) {
+	wp := &fakeWechatPay{delay: 20 * time.Millisecond}
+	svc := &OrderService{Repo: repo.NewMemoryOrderRepo(), WechatMchID: "mch", WechatPay: wp, Catalog: DefaultPriceCatalog()}
+	id, _ := svc.Create(&domain.Order{TaskID: "task-1", Items: []domain.OrderItem{{Type: "electronic", Qty: 1}}})
+	for _, st := range []string{"pending", "paid"} {
+		if err := svc.Callback(id, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 990 cents in 400-cent refunds: only two fit, however they interleave.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var ok []*domain.Refund
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rf, err := svc.Refund(id, 400, ""); err == nil {
+				mu.Lock()
+				ok = append(ok, rf)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(ok) != 2 || len(wp.refunds) != 2 {
+		t.Fatalf("accepted %d refunds, provider called %d times", len(ok), len(wp.refunds))
+	}
+	for _, rf := range ok {
+		n := RefundNotification{OutRefundNo: rf.RefundID, MchID: "mch", Status: "SUCCESS", AmountCents: 400}
+		// The second notification is a provider retry and must not count twice.
+		for range 2 {
+			if err := svc.ConfirmRefund(n); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if o, _ := svc.Repo.Get(id); o.RefundedCents != 800 || o.Status != domain.OrderPaid {
+		t.Fatalf("order after refunds: status=%s refunded=%d", o.Status, o.RefundedCents)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	c := DefaultPriceCatalog()
+	c.CityShippingCents["上海"] = 600
+	cases := []struct {
+		name  string
+		items []domain.OrderItem
+		city  string
+		want  int
+		ok    bool
+	}{
+		{"electronic", []domain.OrderItem{{Type: "electronic", Qty: 1}}, "", 990, true},
+		{"print city surcharge", []domain.OrderItem{{Type: "print", Qty: 2}}, "上海", 2*1990 + 600, true},
+		{"print default shipping", []domain.OrderItem{{Type: "print", Qty: 1}, {Type: "receipt", Qty: 1}}, "成都", 1990 + 990 + 1000, true},
+		{"print without city", []domain.OrderItem{{Type: "print", Qty: 1}}, "", 0, false},
+		{"qty over max", []domain.OrderItem{{Type: "electronic", Qty: 2}}, "", 0, false},
+		{"unknown type", []domain.OrderItem{{Type: "poster", Qty: 1}}, "", 0, false},
+	}
+	for _, tc := range cases {
+		got, err := Quote(c, tc.items, tc.city)
+		if tc.ok && (err != nil || got != tc.want) {
+			t.Errorf("%s: got %d, %v; want %d", tc.name, got, err, tc.want)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected error, got %d", tc.name, got)
+		}
+	}
+}
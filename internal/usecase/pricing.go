@@ -0,0 +1,70 @@
+package usecase
+
+import (
+	"strconv"
+	"strings"
+
+	"permit-backend/internal/domain"
+)
+
+func DefaultPriceCatalog() domain.PriceCatalog {
+	return domain.PriceCatalog{
+		Items: []domain.PriceItem{
+			{Type: "electronic", Name: "电子版", UnitCents: 990, MinQty: 1, MaxQty: 1},
+			{Type: "layout", Name: "排版照", UnitCents: 500, MinQty: 1, MaxQty: 1},
+			{Type: "receipt", Name: "回执", UnitCents: 990, MinQty: 1, MaxQty: 1},
+			{Type: "print", Name: "冲印版", UnitCents: 1990, MinQty: 1, MaxQty: 10, Shipping: true},
+		},
+		DefaultShippingCents: 1000,
+		CityShippingCents:    map[string]int{},
+	}
+}
+
+func Quote(c domain.PriceCatalog, items []domain.OrderItem, city string) (int, error) {
+	if len(items) == 0 {
+		return 0, ErrBadRequest("items required")
+	}
+	byType := make(map[string]domain.PriceItem, len(c.Items))
+	for _, it := range c.Items {
+		byType[strings.ToLower(it.Type)] = it
+	}
+	qty := map[string]int{}
+	total := 0
+	shipping := false
+	for _, it := range items {
+		p, ok := byType[strings.ToLower(strings.TrimSpace(it.Type))]
+		if !ok {
+			return 0, ErrBadRequest("unknown item type " + it.Type)
+		}
+		if it.Qty <= 0 {
+			return 0, ErrBadRequest("invalid qty for " + it.Type)
+		}
+		qty[p.Type] += it.Qty
+		total += p.UnitCents * it.Qty
+		shipping = shipping || p.Shipping
+	}
+	for _, p := range c.Items {
+		n, ok := qty[p.Type]
+		if !ok {
+			continue
+		}
+		if p.MinQty > 0 && n < p.MinQty {
+			return 0, ErrBadRequest(p.Type + " qty must be at least " + strconv.Itoa(p.MinQty))
+		}
+		if p.MaxQty > 0 && n > p.MaxQty {
+			return 0, ErrBadRequest(p.Type + " qty must be at most " + strconv.Itoa(p.MaxQty))
+		}
+	}
+	if shipping {
+		city = strings.TrimSpace(city)
+		if city == "" {
+			return 0, ErrBadRequest("city required for shipped items")
+		}
+		if fee, ok := c.CityShippingCents[city]; ok {
+			total += fee
+		} else {
+			total += c.DefaultShippingCents
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,291 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"permit-backend/internal/algo"
+	"permit-backend/internal/domain"
+	"permit-backend/internal/photo"
+	"permit-backend/internal/storage"
+)
+
+// FaceDetector finds faces for the quality check. *algo.Client implements
+// it; *algo.Local returns algo.ErrNoFaceDetection.
+type FaceDetector interface {
+	DetectFaces(ctx context.Context, image []byte) (algo.FacesResp, error)
+}
+
+// Rule outcomes. Skip means the rule could not be evaluated, e.g. because
+// face detection is unavailable.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// Quality thresholds. Blur and exposure are measured on the face when one
+// is found, otherwise on the whole image, after scaling it to
+// qualityMaxDimension.
+const (
+	qualityMaxDimension = 1024
+
+	blurFail = 15.0
+	blurWarn = 50.0
+
+	brightnessFailLow  = 50.0
+	brightnessWarnLow  = 80.0
+	brightnessWarnHigh = 190.0
+	brightnessFailHigh = 220.0
+
+	clippedWarn = 0.05
+	clippedFail = 0.15
+
+	tiltWarn = 5.0
+	tiltFail = 10.0
+
+	// defaultHeadHeightRatio stands in for specs that do not set one.
+	defaultHeadHeightRatio = 0.6
+)
+
+type QualityRule struct {
+	Rule    string  `json:"rule"`
+	Status  string  `json:"status"`
+	Value   float64 `json:"value"`
+	Message string  `json:"message,omitempty"`
+}
+
+// QualityReport is the result of a pre-check. Face fields are nil when
+// face detection was unavailable. Result is the worst rule status, with
+// skipped rules ignored.
+type QualityReport struct {
+	ObjectKey       string        `json:"objectKey"`
+	SpecCode        string        `json:"specCode"`
+	Result          string        `json:"result"`
+	Width           int           `json:"width"`
+	Height          int           `json:"height"`
+	BlurScore       float64       `json:"blurScore"`
+	Brightness      float64       `json:"brightness"`
+	Overexposed     float64       `json:"overexposed"`
+	Underexposed    float64       `json:"underexposed"`
+	FaceCount       *int          `json:"faceCount"`
+	FaceHeightRatio *float64      `json:"faceHeightRatio"`
+	TiltDeg         *float64      `json:"tiltDeg"`
+	Rules           []QualityRule `json:"rules"`
+}
+
+type QualityService struct {
+	Uploads storage.Storage
+	Faces   FaceDetector
+}
+
+// Check measures the upload at objectKey against spec so the client can
+// ask for a re-shoot before creating a task.
+func (s *QualityService) Check(ctx context.Context, objectKey string, spec domain.SpecDef) (*QualityReport, error) {
+	data, err := storage.ReadAll(ctx, s.Uploads, uploadKey(objectKey))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNotFound("upload")
+	}
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadRequest("upload is not a readable image")
+	}
+	rep := &QualityReport{ObjectKey: objectKey, SpecCode: spec.Code, Width: src.Bounds().Dx(), Height: src.Bounds().Dy()}
+
+	img := src
+	scale := 1.0
+	if m := max(rep.Width, rep.Height); m > qualityMaxDimension {
+		scale = float64(m) / qualityMaxDimension
+		img = algo.Resize(src, int(float64(rep.Width)/scale), int(float64(rep.Height)/scale))
+	}
+
+	var face *algo.Face
+	faces, ferr := s.detect(ctx, img)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if ferr == nil {
+		n := len(faces)
+		rep.FaceCount = &n
+		for i := range faces {
+			if face == nil || faces[i].Width*faces[i].Height > face.Width*face.Height {
+				face = &faces[i]
+			}
+		}
+	}
+
+	region := image.Rectangle{}
+	if face != nil {
+		region = image.Rect(face.X, face.Y, face.X+face.Width, face.Y+face.Height).Add(img.Bounds().Min)
+	}
+	m := photo.Measure(img, region)
+	rep.BlurScore, rep.Brightness = round2(m.BlurScore), round2(m.Brightness)
+	rep.Overexposed, rep.Underexposed = round2(m.Overexposed), round2(m.Underexposed)
+
+	rep.Rules = append(rep.Rules,
+		blurRule(m.BlurScore),
+		brightnessRule(m.Brightness),
+		exposureRule(m.Overexposed, m.Underexposed),
+		resolutionRule(rep.Width, rep.Height, spec),
+	)
+	if ferr != nil {
+		for _, r := range []string{"face_count", "face_size", "tilt"} {
+			rep.Rules = append(rep.Rules, QualityRule{Rule: r, Status: CheckSkip, Message: "face detection unavailable"})
+		}
+	} else {
+		rep.Rules = append(rep.Rules, faceCountRule(len(faces)))
+		if face != nil {
+			ratio := round2(float64(face.Height) / float64(img.Bounds().Dy()))
+			tilt := round2(face.Roll)
+			rep.FaceHeightRatio, rep.TiltDeg = &ratio, &tilt
+			rep.Rules = append(rep.Rules,
+				faceSizeRule(float64(face.Height)*scale, rep.Height, spec),
+				tiltRule(face.Roll),
+			)
+		}
+	}
+
+	rep.Result = CheckPass
+	for _, r := range rep.Rules {
+		switch {
+		case r.Status == CheckFail:
+			rep.Result = CheckFail
+		case r.Status == CheckWarn && rep.Result == CheckPass:
+			rep.Result = CheckWarn
+		}
+	}
+	return rep, nil
+}
+
+// detect sends img to the face detector as JPEG. Box coordinates are in
+// pixels of img.
+func (s *QualityService) detect(ctx context.Context, img image.Image) ([]algo.Face, error) {
+	if s.Faces == nil {
+		return nil, algo.ErrNoFaceDetection
+	}
+	jpg, err := algo.EncodeJPEG(img, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Faces.DetectFaces(ctx, jpg)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.OK {
+		return nil, ErrUpstream("algo detect_faces resp not ok")
+	}
+	return resp.Faces, nil
+}
+
+func blurRule(score float64) QualityRule {
+	r := QualityRule{Rule: "blur", Status: CheckPass, Value: round2(score)}
+	switch {
+	case score < blurFail:
+		r.Status, r.Message = CheckFail, "photo is blurry, hold the camera still and refocus"
+	case score < blurWarn:
+		r.Status, r.Message = CheckWarn, "photo may be slightly out of focus"
+	}
+	return r
+}
+
+func brightnessRule(b float64) QualityRule {
+	r := QualityRule{Rule: "brightness", Status: CheckPass, Value: round2(b)}
+	switch {
+	case b < brightnessFailLow:
+		r.Status, r.Message = CheckFail, "photo is too dark"
+	case b > brightnessFailHigh:
+		r.Status, r.Message = CheckFail, "photo is too bright"
+	case b < brightnessWarnLow:
+		r.Status, r.Message = CheckWarn, "photo is a little dark"
+	case b > brightnessWarnHigh:
+		r.Status, r.Message = CheckWarn, "photo is a little bright"
+	}
+	return r
+}
+
+func exposureRule(over, under float64) QualityRule {
+	clipped := math.Max(over, under)
+	r := QualityRule{Rule: "exposure", Status: CheckPass, Value: round2(clipped)}
+	what := "highlights are blown out"
+	if under > over {
+		what = "shadows are crushed"
+	}
+	switch {
+	case clipped >= clippedFail:
+		r.Status, r.Message = CheckFail, what
+	case clipped >= clippedWarn:
+		r.Status, r.Message = CheckWarn, what
+	}
+	return r
+}
+
+// resolutionRule warns when the upload is smaller than the spec output and
+// would have to be upscaled.
+func resolutionRule(w, h int, spec domain.SpecDef) QualityRule {
+	r := QualityRule{Rule: "resolution", Status: CheckPass}
+	if spec.WidthPx <= 0 || spec.HeightPx <= 0 {
+		r.Status = CheckSkip
+		return r
+	}
+	r.Value = round2(math.Min(float64(w)/float64(spec.WidthPx), float64(h)/float64(spec.HeightPx)))
+	if r.Value < 1 {
+		r.Status, r.Message = CheckWarn, fmt.Sprintf("photo is smaller than %dx%d and will be upscaled", spec.WidthPx, spec.HeightPx)
+	}
+	return r
+}
+
+func faceCountRule(n int) QualityRule {
+	r := QualityRule{Rule: "face_count", Status: CheckPass, Value: float64(n)}
+	switch {
+	case n == 0:
+		r.Status, r.Message = CheckFail, "no face found"
+	case n > 1:
+		r.Status, r.Message = CheckFail, fmt.Sprintf("%d faces found, only one person may be in the photo", n)
+	}
+	return r
+}
+
+// faceSizeRule compares the crop the spec needs around the face with the
+// photo. The spec puts the head at HeadHeightRatio of the output height, so
+// the crop is faceH/ratio source pixels tall: more than the photo means the
+// face is too close; less than the spec height means upscaling.
+func faceSizeRule(faceH float64, imgH int, spec domain.SpecDef) QualityRule {
+	ratio := spec.HeadHeightRatio
+	if ratio <= 0 {
+		ratio = defaultHeadHeightRatio
+	}
+	crop := faceH / ratio
+	r := QualityRule{Rule: "face_size", Status: CheckPass, Value: round2(faceH / float64(imgH))}
+	switch {
+	case crop > float64(imgH)*1.2:
+		r.Status, r.Message = CheckFail, "face is too close, move the camera back"
+	case crop > float64(imgH):
+		r.Status, r.Message = CheckWarn, "little room around the head, move the camera back a bit"
+	case spec.HeightPx > 0 && crop < float64(spec.HeightPx)/2:
+		r.Status, r.Message = CheckFail, "face is too small, move closer"
+	case spec.HeightPx > 0 && crop < float64(spec.HeightPx):
+		r.Status, r.Message = CheckWarn, "face is small and will be upscaled"
+	}
+	return r
+}
+
+func tiltRule(roll float64) QualityRule {
+	r := QualityRule{Rule: "tilt", Status: CheckPass, Value: round2(roll)}
+	switch a := math.Abs(roll); {
+	case a > tiltFail:
+		r.Status, r.Message = CheckFail, "head is tilted, keep it level"
+	case a > tiltWarn:
+		r.Status, r.Message = CheckWarn, "head is slightly tilted"
+	}
+	return r
+}
+
+func round2(f float64) float64 { return math.Round(f*100) / 100 }
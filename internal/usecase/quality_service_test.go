@@ -0,0 +1,170 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"permit-backend/internal/algo"
+	"permit-backend/internal/domain"
+	"permit-backend/internal/storage"
+)
+
+// fakeFaces reports faces and records the size of the image it was sent.
+type fakeFaces struct {
+	faces []algo.Face
+	err   error
+	size  image.Point
+}
+
+func (f *fakeFaces) DetectFaces(ctx context.Context, data []byte) (algo.FacesResp, error) {
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(data)); err == nil {
+		f.size = image.Pt(cfg.Width, cfg.Height)
+	}
+	if f.err != nil {
+		return algo.FacesResp{}, f.err
+	}
+	return algo.FacesResp{OK: true, Faces: f.faces}, nil
+}
+
+// noiseJPEG is a w x h photo of grey noise around mean, sharp by the blur
+// rule; spread 0 makes it flat and therefore blurry.
+func noiseJPEG(w, h int, mean, spread int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		v := mean
+		if spread > 0 {
+			v += rng.Intn(2*spread+1) - spread
+		}
+		img.Pix[i] = uint8(v)
+	}
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	return buf.Bytes()
+}
+
+func ruleStatus(rep *QualityReport, rule string) string {
+	for _, r := range rep.Rules {
+		if r.Rule == rule {
+			return r.Status
+		}
+	}
+	return ""
+}
+
+func TestQualityService_Check(t *testing.T) {
+	dir := t.TempDir()
+	put := func(name string, data []byte) string {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return "uploads/" + name
+	}
+	good := put("good.jpg", noiseJPEG(600, 800, 130, 40))
+	spec := domain.SpecDef{Code: "cn_1inch", WidthPx: 295, HeightPx: 413, DPI: 300, HeadHeightRatio: 0.6}
+	upright := algo.Face{X: 200, Y: 150, Width: 200, Height: 260, Score: 0.99}
+	ctx := context.Background()
+
+	cases := []struct {
+		name   string
+		key    string
+		faces  []algo.Face
+		err    error
+		result string
+		rules  map[string]string
+	}{
+		{"good", good, []algo.Face{upright}, nil, CheckPass,
+			map[string]string{"blur": CheckPass, "brightness": CheckPass, "exposure": CheckPass, "resolution": CheckPass, "face_count": CheckPass, "face_size": CheckPass, "tilt": CheckPass}},
+		{"two faces", good, []algo.Face{upright, {X: 10, Y: 10, Width: 80, Height: 100}}, nil, CheckFail,
+			map[string]string{"face_count": CheckFail, "face_size": CheckPass}},
+		{"no face", good, nil, nil, CheckFail,
+			map[string]string{"face_count": CheckFail, "face_size": ""}},
+		{"tilted", good, []algo.Face{{X: 200, Y: 150, Width: 200, Height: 260, Roll: -7}}, nil, CheckWarn,
+			map[string]string{"tilt": CheckWarn}},
+		{"too close", good, []algo.Face{{X: 50, Y: 50, Width: 500, Height: 650}}, nil, CheckFail,
+			map[string]string{"face_size": CheckFail}},
+		{"too far", good, []algo.Face{{X: 280, Y: 300, Width: 40, Height: 52}}, nil, CheckFail,
+			map[string]string{"face_size": CheckFail}},
+		{"no detector", good, nil, algo.ErrNoFaceDetection, CheckPass,
+			map[string]string{"blur": CheckPass, "face_count": CheckSkip, "face_size": CheckSkip, "tilt": CheckSkip}},
+		{"blurry", put("flat.jpg", noiseJPEG(600, 800, 130, 0)), []algo.Face{upright}, nil, CheckFail,
+			map[string]string{"blur": CheckFail}},
+		{"dark", put("dark.jpg", noiseJPEG(600, 800, 35, 30)), []algo.Face{upright}, nil, CheckFail,
+			map[string]string{"brightness": CheckFail}},
+		{"small", put("small.jpg", noiseJPEG(250, 350, 130, 40)), []algo.Face{{X: 60, Y: 60, Width: 120, Height: 160}}, nil, CheckWarn,
+			map[string]string{"resolution": CheckWarn}},
+	}
+	for _, c := range cases {
+		det := &fakeFaces{faces: c.faces, err: c.err}
+		svc := &QualityService{Uploads: storage.NewFS(dir), Faces: det}
+		rep, err := svc.Check(ctx, c.key, spec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if rep.Result != c.result {
+			t.Errorf("%s: result = %s, want %s (%+v)", c.name, rep.Result, c.result, rep.Rules)
+		}
+		for rule, want := range c.rules {
+			if got := ruleStatus(rep, rule); got != want {
+				t.Errorf("%s: %s = %q, want %q", c.name, rule, got, want)
+			}
+		}
+		if (c.err == nil) != (rep.FaceCount != nil) {
+			t.Errorf("%s: faceCount = %v", c.name, rep.FaceCount)
+		}
+	}
+
+	// Without a detector configured only the face rules are skipped.
+	svc := &QualityService{Uploads: storage.NewFS(dir)}
+	if rep, err := svc.Check(ctx, good, spec); err != nil || ruleStatus(rep, "face_count") != CheckSkip || ruleStatus(rep, "blur") != CheckPass {
+		t.Fatalf("check without detector = %+v, %v", rep, err)
+	}
+
+	svc = &QualityService{Uploads: storage.NewFS(dir), Faces: &fakeFaces{}}
+	var nf ErrNotFound
+	if _, err := svc.Check(ctx, "uploads/missing.jpg", spec); !errors.As(err, &nf) {
+		t.Fatalf("missing upload: %v", err)
+	}
+	var br ErrBadRequest
+	if _, err := svc.Check(ctx, put("text.jpg", []byte("not an image")), spec); !errors.As(err, &br) {
+		t.Fatalf("unreadable upload: %v", err)
+	}
+}
+
+func TestQualityService_ScalesLargePhotos(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 2048, 1536))
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			v := uint8(90 + (x*7+y*13)%80)
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	if err := os.WriteFile(filepath.Join(dir, "big.jpg"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The face box is in pixels of the 1024x768 image sent for detection:
+	// 300px there is 600px of the original, so the spec crop needs 1000px.
+	det := &fakeFaces{faces: []algo.Face{{X: 400, Y: 200, Width: 230, Height: 300}}}
+	svc := &QualityService{Uploads: storage.NewFS(dir), Faces: det}
+	rep, err := svc.Check(context.Background(), "uploads/big.jpg", domain.SpecDef{Code: "x", WidthPx: 413, HeightPx: 579, HeadHeightRatio: 0.6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if det.size != image.Pt(1024, 768) {
+		t.Fatalf("detector got %v, want 1024x768", det.size)
+	}
+	if rep.Width != 2048 || rep.Height != 1536 || *rep.FaceHeightRatio != 0.39 || ruleStatus(rep, "face_size") != CheckPass {
+		t.Fatalf("report = %+v", rep)
+	}
+}
@@ -0,0 +1,174 @@
+package usecase
+
+import (
+	"strings"
+	"sync"
+
+	"permit-backend/internal/domain"
+)
+
+type SpecRepo interface {
+	UpsertSpecs([]domain.SpecDef) error
+	ListSpecs() ([]domain.SpecDef, error)
+	DeleteSpec(code string) error
+}
+
+// SpecService is the single source of truth for photo specs; both the
+// public catalog and task creation read through it.
+type SpecService struct {
+	mu   sync.Mutex
+	Repo SpecRepo
+}
+
+// Seed stores defs when the catalog is empty.
+func (s *SpecService) Seed(defs []domain.SpecDef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items, err := s.Repo.ListSpecs()
+	if err != nil || len(items) > 0 {
+		return err
+	}
+	return s.Repo.UpsertSpecs(defs)
+}
+
+func (s *SpecService) List(includeDisabled bool) ([]domain.SpecDef, error) {
+	items, err := s.Repo.ListSpecs()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]domain.SpecDef, 0, len(items))
+	for _, it := range items {
+		if it.Disabled && !includeDisabled {
+			continue
+		}
+		out = append(out, it)
+	}
+	return out, nil
+}
+
+// Find returns the enabled spec with code, or ErrBadRequest.
+func (s *SpecService) Find(code string) (domain.SpecDef, error) {
+	sp, err := s.get(code)
+	if err != nil {
+		return domain.SpecDef{}, err
+	}
+	if sp == nil || sp.Disabled {
+		return domain.SpecDef{}, ErrBadRequest("unknown spec " + code)
+	}
+	return *sp, nil
+}
+
+func (s *SpecService) Create(sp domain.SpecDef) (domain.SpecDef, error) {
+	return s.save(sp, false)
+}
+
+// Update replaces the spec stored under code; the code itself is immutable.
+func (s *SpecService) Update(code string, sp domain.SpecDef) (domain.SpecDef, error) {
+	sp.Code = code
+	return s.save(sp, true)
+}
+
+func (s *SpecService) save(sp domain.SpecDef, update bool) (domain.SpecDef, error) {
+	sp.Code = normalizeSpecCode(sp.Code)
+	sp.Name = strings.TrimSpace(sp.Name)
+	if sp.Code == "" || sp.Name == "" {
+		return sp, ErrBadRequest("code and name required")
+	}
+	if sp.WidthPx <= 0 || sp.HeightPx <= 0 || sp.DPI <= 0 {
+		return sp, ErrBadRequest("widthPx, heightPx and dpi must be positive")
+	}
+	if sp.WidthMM < 0 || sp.HeightMM < 0 || sp.MinKB < 0 || sp.MaxKB < 0 {
+		return sp, ErrBadRequest("size and kb limits must not be negative")
+	}
+	if sp.MaxKB > 0 && sp.MinKB > sp.MaxKB {
+		return sp, ErrBadRequest("minKb exceeds maxKb")
+	}
+	if sp.HeadHeightRatio < 0 || sp.HeadHeightRatio >= 1 || sp.TopMarginRatio < 0 || sp.TopMarginRatio >= 1 {
+		return sp, ErrBadRequest("headHeightRatio and topMarginRatio must be in [0, 1)")
+	}
+	for i, f := range sp.Formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "jpeg" {
+			f = "jpg"
+		}
+		if f != "jpg" && f != "png" {
+			return sp, ErrBadRequest("unsupported format " + f)
+		}
+		sp.Formats[i] = f
+	}
+	if len(sp.BgColors) == 0 {
+		sp.BgColors = []string{"white"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.get(sp.Code)
+	if err != nil {
+		return sp, err
+	}
+	if update && cur == nil {
+		return sp, ErrNotFound("spec")
+	}
+	if !update && cur != nil {
+		return sp, ErrConflict("spec " + sp.Code + " already exists")
+	}
+	return sp, s.Repo.UpsertSpecs([]domain.SpecDef{sp})
+}
+
+func (s *SpecService) SetDisabled(code string, disabled bool) (domain.SpecDef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, err := s.get(code)
+	if err != nil {
+		return domain.SpecDef{}, err
+	}
+	if sp == nil {
+		return domain.SpecDef{}, ErrNotFound("spec")
+	}
+	sp.Disabled = disabled
+	return *sp, s.Repo.UpsertSpecs([]domain.SpecDef{*sp})
+}
+
+func (s *SpecService) Delete(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, err := s.get(code)
+	if err != nil {
+		return err
+	}
+	if sp == nil {
+		return ErrNotFound("spec")
+	}
+	return s.Repo.DeleteSpec(sp.Code)
+}
+
+func (s *SpecService) get(code string) (*domain.SpecDef, error) {
+	code = normalizeSpecCode(code)
+	items, err := s.Repo.ListSpecs()
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		if strings.ToLower(it.Code) == code {
+			return &it, nil
+		}
+	}
+	return nil, nil
+}
+
+func normalizeSpecCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// DefaultSpecs is the catalog seeded into an empty specs table.
+func DefaultSpecs() []domain.SpecDef {
+	siteBg := []string{"white", "blue", "red", "tint", "grey", "gradient", "dark_blue", "sky_blue"}
+	formats := []string{"jpg"}
+	return []domain.SpecDef{
+		{Code: "passport", Name: "护照", WidthPx: 354, HeightPx: 472, DPI: 300, WidthMM: 30, HeightMM: 40, Formats: formats, BgColors: []string{"white", "blue", "red"}},
+		{Code: "cn_1inch", Name: "一寸", WidthPx: 295, HeightPx: 413, DPI: 300, WidthMM: 25, HeightMM: 35, Formats: formats, BgColors: siteBg},
+		{Code: "cn_2inch", Name: "二寸", WidthPx: 413, HeightPx: 579, DPI: 300, WidthMM: 35, HeightMM: 49, Formats: formats, BgColors: siteBg},
+		{Code: "cn_2inch_small", Name: "小二寸", WidthPx: 413, HeightPx: 531, DPI: 300, WidthMM: 35, HeightMM: 45, Formats: formats, BgColors: siteBg},
+		{Code: "cn_1inch_large", Name: "大一寸", WidthPx: 390, HeightPx: 567, DPI: 300, WidthMM: 33, HeightMM: 48, Formats: formats, BgColors: siteBg},
+		{Code: "cn_social_security", Name: "社保证（300dpi，无回执）", WidthPx: 358, HeightPx: 441, DPI: 300, Formats: formats, BgColors: []string{"white"}},
+	}
+}
@@ -1,14 +1,17 @@
 package usecase
 
 import (
-	"os"
-	"path/filepath"
+	"context"
+	"fmt"
+	"math"
+	"path"
 	"time"
 	"crypto/rand"
 	"encoding/hex"
 	"strings"
 	"permit-backend/internal/domain"
 	"permit-backend/internal/algo"
+	"permit-backend/internal/storage"
 )
 
 type TaskRepo interface {
@@ -19,53 +22,94 @@ type TaskRepo interface {
 type AssetWriter interface {
 	Write(taskID, color string, data []byte) (string, error)
 	WriteFile(taskID, filename string, data []byte) (string, error)
+	WritePrivate(taskID, filename string, data []byte) (string, error)
+	Read(taskID, filename string) ([]byte, error)
 }
 
+// AlgoClient is the algo service. *algo.Client implements it; failures are
+// reported as *algo.Error.
 type AlgoClient interface {
-	IDPhoto(baseURL, imagePath string, height, width, dpi int) (algo.IDPhotoResp, error)
-	AddBackgroundBase64(baseURL, rgbaBase64, colorHex string, dpi int) (algo.AddBackgroundResp, error)
-	AddBackgroundFile(baseURL string, rgbaPNG []byte, colorHex string, dpi int) (algo.AddBackgroundResp, error)
-	GenerateLayoutPhotosFile(baseURL string, rgbImage []byte, height, width, dpi, kb int) (algo.LayoutResp, error)
+	IDPhotoFile(ctx context.Context, image []byte, filename string, height, width, dpi int, opts algo.IDPhotoOptions) (algo.IDPhotoResp, error)
+	AddBackgroundBase64(ctx context.Context, rgbaBase64, colorHex string, render, dpi, kb int) (algo.AddBackgroundResp, error)
+	AddBackgroundFile(ctx context.Context, rgbaPNG []byte, colorHex string, render, dpi, kb int) (algo.AddBackgroundResp, error)
+	GenerateLayoutPhotosFile(ctx context.Context, rgbImage []byte, height, width, dpi, kb int) (algo.LayoutResp, error)
+}
+
+type TaskQueue interface {
+	Submit(taskID string) error
 }
 
 type TaskService struct {
 	Repo       TaskRepo
 	Assets     AssetWriter
 	Algo       AlgoClient
-	AlgoURL    string
-	UploadsDir string
-	AssetsDir  string
+	Queue      TaskQueue
+	Uploads    storage.Storage
 }
 
-func (s *TaskService) CreateTask(userID, specCode, sourceObjectKey string, defaultBackground string, width, height, dpi int, availableColors []string, colorHexOf func(string) string) (*domain.Task, error) {
+func (s *TaskService) CreateTask(ctx context.Context, userID string, spec domain.TaskSpec, sourceObjectKey string, defaultBackground string, availableColors []string, colorOf func(string) domain.Color) (*domain.Task, error) {
 	taskID := randomID()
 	now := time.Now().UTC()
 	t := &domain.Task{
-		ID:              taskID,
-		UserID:          userID,
-		SpecCode:        specCode,
-		Spec:            domain.TaskSpec{Code: specCode, WidthPx: width, HeightPx: height, DPI: dpi},
-		SourceObjectKey: sourceObjectKey,
-		Status:          domain.StatusProcessing,
-		ProcessedUrls:   map[string]string{},
-		LayoutUrls:      map[string]string{},
-		AvailableColors: availableColors,
-		CreatedAt:       now,
-		UpdatedAt:       now,
+		ID:                taskID,
+		UserID:            userID,
+		SpecCode:          spec.Code,
+		Spec:              spec,
+		SourceObjectKey:   sourceObjectKey,
+		Status:            domain.StatusQueued,
+		DefaultBackground: defaultBackground,
+		ProcessedUrls:     map[string]string{},
+		LayoutUrls:        map[string]string{},
+		AvailableColors:   availableColors,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	_ = s.Repo.Put(t)
+	if s.Queue == nil {
+		s.ProcessTask(ctx, taskID, colorOf)
+		if cur, ok := s.Repo.Get(taskID); ok {
+			return cur, nil
+		}
+		return t, nil
+	}
+	if err := s.Queue.Submit(taskID); err != nil {
+		s.fail(t, "task queue unavailable: "+err.Error())
+		return t, ErrUnavailable("task queue full")
+	}
+	return t, nil
+}
+
+func (s *TaskService) GetForUser(userID, taskID string) (*domain.Task, error) {
+	t, ok := s.Repo.Get(taskID)
+	if !ok || userID == "" || t.UserID != userID {
+		return nil, ErrNotFound("task")
+	}
+	return t, nil
+}
+
+func (s *TaskService) ProcessTask(ctx context.Context, taskID string, colorOf func(string) domain.Color) {
+	t, ok := s.Repo.Get(taskID)
+	if !ok || t.Status != domain.StatusQueued {
+		return
 	}
+	t.Status = domain.StatusProcessing
+	t.UpdatedAt = time.Now().UTC()
 	_ = s.Repo.Put(t)
-	srcPath := s.objectKeyToPath(sourceObjectKey)
-	idp, err := s.Algo.IDPhoto(s.AlgoURL, srcPath, height, width, dpi)
+	srcKey := uploadKey(t.SourceObjectKey)
+	src, err := storage.ReadAll(ctx, s.Uploads, srcKey)
+	if err != nil {
+		s.fail(t, "read source error: "+err.Error())
+		return
+	}
+	dpi := t.Spec.DPI
+	idp, err := s.Algo.IDPhotoFile(ctx, src, path.Base(srcKey), t.Spec.HeightPx, t.Spec.WidthPx, dpi, idPhotoOptions(t.Spec))
 	if err != nil || !idp.OK {
-		t.Status = domain.StatusFailed
 		if err != nil {
-			t.ErrorMsg = "algo idphoto error: " + err.Error()
+			s.fail(t, "algo idphoto error: "+err.Error())
 		} else {
-			t.ErrorMsg = "algo idphoto resp not ok"
+			s.fail(t, "algo idphoto resp not ok")
 		}
-		t.UpdatedAt = time.Now().UTC()
-		_ = s.Repo.Put(t)
-		return t, nil
+		return
 	}
 	rgbaB64 := idp.ImageBase64Standard
 	if rgbaB64 == "" {
@@ -73,72 +117,96 @@ func (s *TaskService) CreateTask(userID, specCode, sourceObjectKey string, defau
 	}
 	rgbaData, err := algo.DecodeBase64(rgbaB64)
 	if err != nil {
-		t.Status = domain.StatusFailed
-		prefix := rgbaB64
-		if len(prefix) > 32 {
-			prefix = prefix[:32]
-		}
-		t.ErrorMsg = "decode baseline error: " + prefix
-		t.UpdatedAt = time.Now().UTC()
-		_ = s.Repo.Put(t)
-		return t, nil
+		s.fail(t, "decode baseline error: "+truncate(rgbaB64, 32))
+		return
 	}
-	baseURL, err := s.Assets.WriteFile(taskID, "baseline.png", rgbaData)
+	baseURL, err := s.Assets.WritePrivate(taskID, "baseline.png", rgbaData)
 	if err != nil {
-		t.Status = domain.StatusFailed
-		t.ErrorMsg = "write baseline error"
-		t.UpdatedAt = time.Now().UTC()
-		_ = s.Repo.Put(t)
-		return t, nil
+		s.fail(t, "write baseline error")
+		return
 	}
 	t.BaselineUrl = baseURL
 
-	bgColor := defaultBackground
+	bgColor := t.DefaultBackground
 	if bgColor == "" {
 		bgColor = "white"
 	}
-	colorHex := colorHexOf(bgColor)
-	bg, err := s.Algo.AddBackgroundBase64(s.AlgoURL, rgbaB64, colorHex, dpi)
+	color := colorOf(bgColor)
+	bg, err := s.Algo.AddBackgroundBase64(ctx, rgbaB64, color.Hex, color.Render(), dpi, t.Spec.MaxKB)
 	if err != nil || !bg.OK {
-		t.Status = domain.StatusFailed
 		if err != nil {
-			t.ErrorMsg = "algo add_background error: " + err.Error()
+			s.fail(t, "algo add_background error: "+err.Error())
 		} else {
-			t.ErrorMsg = "algo add_background resp not ok"
+			s.fail(t, "algo add_background resp not ok")
 		}
-		t.UpdatedAt = time.Now().UTC()
-		_ = s.Repo.Put(t)
-		return t, nil
+		return
 	}
 	data, err := algo.DecodeBase64(bg.ImageBase64)
 	if err != nil {
-		t.Status = domain.StatusFailed
-		prefix := bg.ImageBase64
-		if len(prefix) > 32 {
-			prefix = prefix[:32]
-		}
-		t.ErrorMsg = "decode image error: " + prefix
-		t.UpdatedAt = time.Now().UTC()
-		_ = s.Repo.Put(t)
-		return t, nil
+		s.fail(t, "decode image error: "+truncate(bg.ImageBase64, 32))
+		return
 	}
-	url, err := s.Assets.Write(taskID, bgColor, data)
+	data = algo.PadJPEG(data, t.Spec.MinKB*1024)
+	url, err := s.Assets.Write(taskID, color.FileKey(), data)
 	if err != nil {
-		t.Status = domain.StatusFailed
-		t.ErrorMsg = "write image error"
-		t.UpdatedAt = time.Now().UTC()
-		_ = s.Repo.Put(t)
-		return t, nil
+		s.fail(t, "write image error")
+		return
 	}
 	t.ProcessedUrls[bgColor] = url
 
 	t.Status = domain.StatusDone
 	t.UpdatedAt = time.Now().UTC()
 	_ = s.Repo.Put(t)
-	return t, nil
 }
 
-func (s *TaskService) GenerateBackground(taskID string, colorName string, dpi int, colorHexOf func(string) string) (string, error) {
+// idPhotoOptions translates spec rules into /idphoto parameters. The spec
+// gives head height ÷ photo height, while the service sizes its crop by face
+// area ÷ photo area; the face box is taken as a square as tall as the head.
+// The top margin becomes a band of ±0.01 around the spec value.
+func idPhotoOptions(spec domain.TaskSpec) algo.IDPhotoOptions {
+	var o algo.IDPhotoOptions
+	if r := spec.HeadHeightRatio; r > 0 && spec.WidthPx > 0 && spec.HeightPx > 0 {
+		o.HeadMeasureRatio = math.Round(r*r*float64(spec.HeightPx)/float64(spec.WidthPx)*1000) / 1000
+	}
+	if m := spec.TopMarginRatio; m > 0 {
+		o.TopDistanceMin = math.Round(math.Max(m-0.01, 0)*1000) / 1000
+		o.TopDistanceMax = math.Round((m+0.01)*1000) / 1000
+	}
+	return o
+}
+
+// Resume puts tasks a previous run left queued or processing back on Queue.
+// A task that was processing starts over. Tasks the queue cannot take are
+// failed, so none stays unfinished forever. It returns how many were queued.
+func (s *TaskService) Resume(ids []string) int {
+	n := 0
+	for _, id := range ids {
+		t, ok := s.Repo.Get(id)
+		if !ok || (t.Status != domain.StatusQueued && t.Status != domain.StatusProcessing) {
+			continue
+		}
+		if t.Status == domain.StatusProcessing {
+			t.Status = domain.StatusQueued
+			t.UpdatedAt = time.Now().UTC()
+			_ = s.Repo.Put(t)
+		}
+		if err := s.Queue.Submit(id); err != nil {
+			s.fail(t, "interrupted by a server restart, task queue unavailable: "+err.Error())
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+func (s *TaskService) fail(t *domain.Task, msg string) {
+	t.Status = domain.StatusFailed
+	t.ErrorMsg = msg
+	t.UpdatedAt = time.Now().UTC()
+	_ = s.Repo.Put(t)
+}
+
+func (s *TaskService) GenerateBackground(ctx context.Context, taskID string, colorName string, dpi int, colorOf func(string) domain.Color) (string, error) {
 	t, ok := s.Repo.Get(taskID)
 	if !ok {
 		return "", ErrNotFound("task")
@@ -146,24 +214,24 @@ func (s *TaskService) GenerateBackground(taskID string, colorName string, dpi in
 	if u, ok2 := t.ProcessedUrls[colorName]; ok2 && u != "" {
 		return u, nil
 	}
-	p := filepath.Join(s.AssetsDir, taskID, "baseline.png")
-	data, err := os.ReadFile(p)
+	data, err := s.Assets.Read(taskID, "baseline.png")
 	if err != nil {
 		return "", err
 	}
-	colorHex := colorHexOf(colorName)
-	bg, err := s.Algo.AddBackgroundFile(s.AlgoURL, data, colorHex, dpi)
+	color := colorOf(colorName)
+	bg, err := s.Algo.AddBackgroundFile(ctx, data, color.Hex, color.Render(), dpi, t.Spec.MaxKB)
 	if err != nil || !bg.OK {
 		if err != nil {
 			return "", err
 		}
-		return "", ErrNotFound("add_background")
+		return "", ErrUpstream("algo add_background resp not ok")
 	}
 	jpg, err := algo.DecodeBase64(bg.ImageBase64)
 	if err != nil {
-		return "", err
+		return "", ErrUpstream("algo add_background returned invalid base64")
 	}
-	url, err := s.Assets.Write(taskID, colorName, jpg)
+	jpg = algo.PadJPEG(jpg, t.Spec.MinKB*1024)
+	url, err := s.Assets.Write(taskID, color.FileKey(), jpg)
 	if err != nil {
 		return "", err
 	}
@@ -173,63 +241,141 @@ func (s *TaskService) GenerateBackground(taskID string, colorName string, dpi in
 	return url, nil
 }
 
-func (s *TaskService) GenerateLayout(taskID string, colorName string, width, height, dpi, kb int, colorHexOf func(string) string) (string, error) {
+// LayoutOptions describes a print sheet. Zero photo size, DPI and KB fall
+// back to the task spec; a zero Paper means 6inch; Copies <= 0 fills the
+// sheet.
+type LayoutOptions struct {
+	WidthPx  int
+	HeightPx int
+	DPI      int
+	KB       int
+	Paper    domain.Paper
+	Copies   int
+}
+
+const (
+	maxLayoutCopies = 64
+	minLayoutDPI    = 72
+	maxLayoutDPI    = 1200
+	// maxLayoutPixels caps the sheet, which is rendered in memory at 4 bytes
+	// a pixel: A4 fits up to about 800 dpi.
+	maxLayoutPixels = 64 << 20
+)
+
+// GenerateLayout renders (or returns the cached) sheet for colorName and
+// opts. It returns the LayoutUrls key and the preview URL. Plain 6-inch
+// sheets use the algorithm service's own layout; other papers or explicit
+// copy counts are tiled locally.
+func (s *TaskService) GenerateLayout(ctx context.Context, taskID string, colorName string, opts LayoutOptions, colorOf func(string) domain.Color) (string, string, error) {
 	t, ok := s.Repo.Get(taskID)
 	if !ok {
-		return "", ErrNotFound("task")
+		return "", "", ErrNotFound("task")
 	}
-	if t.LayoutUrls != nil {
-		if u, ok2 := t.LayoutUrls["6inch"]; ok2 && u != "" {
-			return u, nil
-		}
+	if opts.Copies < 0 || opts.Copies > maxLayoutCopies {
+		return "", "", ErrBadRequest("copies out of range")
 	}
-	if _, ok2 := t.ProcessedUrls[colorName]; !ok2 {
-		bgURL, err := s.GenerateBackground(taskID, colorName, dpi, colorHexOf)
-		if err != nil || bgURL == "" {
-			return "", err
-		}
+	if opts.Paper.Name == "" {
+		opts.Paper, _ = domain.LookupPaper("", 0, 0)
 	}
-	p := filepath.Join(s.AssetsDir, taskID, strings.ToLower(colorName)+".jpg")
-	data, err := os.ReadFile(p)
-	if err != nil {
-		return "", err
+	if opts.WidthPx == 0 {
+		opts.WidthPx = t.Spec.WidthPx
 	}
-	if width == 0 {
-		width = t.Spec.WidthPx
+	if opts.HeightPx == 0 {
+		opts.HeightPx = t.Spec.HeightPx
 	}
-	if height == 0 {
-		height = t.Spec.HeightPx
+	if opts.DPI == 0 {
+		opts.DPI = t.Spec.DPI
 	}
-	if dpi == 0 {
-		dpi = t.Spec.DPI
+	if opts.KB == 0 {
+		opts.KB = t.Spec.MaxKB
 	}
-	println("GenerateLayout size:", width, height, dpi, "kb", kb, "color", colorName)
-	resp, err := s.Algo.GenerateLayoutPhotosFile(s.AlgoURL, data, height, width, dpi, kb)
-	if err != nil || !resp.OK {
-		return "", err
+	if err := checkLayout(opts); err != nil {
+		return "", "", err
+	}
+	color := colorOf(colorName)
+	key := fmt.Sprintf("%s_%s_%dx%d_%ddpi_%dkb_%d", opts.Paper.Key(), color.FileKey(), opts.WidthPx, opts.HeightPx, opts.DPI, opts.KB, opts.Copies)
+	if u, ok2 := t.LayoutUrls[key]; ok2 && u != "" {
+		return key, u, nil
+	}
+	if _, ok2 := t.ProcessedUrls[colorName]; !ok2 {
+		bgURL, err := s.GenerateBackground(ctx, taskID, colorName, opts.DPI, colorOf)
+		if err != nil || bgURL == "" {
+			return "", "", err
+		}
+		t, _ = s.Repo.Get(taskID)
 	}
-	jpg, err := algo.DecodeBase64(resp.ImageBase64)
+	data, err := s.Assets.Read(taskID, color.FileKey()+".jpg")
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	var jpg []byte
+	if opts.Paper.Name == "6inch" && opts.Copies == 0 {
+		resp, err := s.Algo.GenerateLayoutPhotosFile(ctx, data, opts.HeightPx, opts.WidthPx, opts.DPI, opts.KB)
+		if err != nil || !resp.OK {
+			if err == nil {
+				err = ErrUpstream("algo generate_layout_photos resp not ok")
+			}
+			return "", "", err
+		}
+		if jpg, err = algo.DecodeBase64(resp.ImageBase64); err != nil {
+			return "", "", ErrUpstream("algo generate_layout_photos returned invalid base64")
+		}
+	} else {
+		pw, ph := opts.Paper.Pixels(opts.DPI)
+		jpg, _, err = algo.TileLayout(data, opts.WidthPx, opts.HeightPx, pw, ph, opts.Copies, opts.KB)
+		if err == algo.ErrPhotoTooLarge {
+			return "", "", ErrBadRequest(err.Error())
+		}
+		if err != nil {
+			return "", "", err
+		}
 	}
-	url, err := s.Assets.WriteFile(taskID, "layout_6inch.jpg", jpg)
+	url, err := s.Assets.WriteFile(taskID, "layout_"+key+".jpg", jpg)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	if t.LayoutUrls == nil {
 		t.LayoutUrls = map[string]string{}
 	}
-	t.LayoutUrls["6inch"] = url
+	t.LayoutUrls[key] = url
 	t.UpdatedAt = time.Now().UTC()
 	_ = s.Repo.Put(t)
-	return url, nil
+	return key, url, nil
+}
+
+// checkLayout rejects options that cannot produce a sheet or would need an
+// unreasonable amount of memory to render.
+func checkLayout(opts LayoutOptions) error {
+	if opts.DPI < minLayoutDPI || opts.DPI > maxLayoutDPI {
+		return ErrBadRequest(fmt.Sprintf("dpi must be between %d and %d", minLayoutDPI, maxLayoutDPI))
+	}
+	if opts.WidthPx <= 0 || opts.HeightPx <= 0 {
+		return ErrBadRequest("photo size must be positive")
+	}
+	if opts.KB < 0 {
+		return ErrBadRequest("kb must not be negative")
+	}
+	pw, ph := opts.Paper.Pixels(opts.DPI)
+	if pw*ph > maxLayoutPixels {
+		return ErrBadRequest(fmt.Sprintf("paper %s is too large at %d dpi", opts.Paper.Key(), opts.DPI))
+	}
+	if (opts.WidthPx > pw || opts.HeightPx > ph) && (opts.WidthPx > ph || opts.HeightPx > pw) {
+		return ErrBadRequest(algo.ErrPhotoTooLarge.Error())
+	}
+	return nil
+}
+
+// uploadKey maps a client-facing object key ("uploads/<name>") to its key
+// in the uploads store.
+func uploadKey(objectKey string) string {
+	return strings.TrimPrefix(objectKey, "uploads/")
 }
 
-func (s *TaskService) objectKeyToPath(objectKey string) string {
-	if len(objectKey) >= 8 && objectKey[:8] == "uploads/" {
-		return filepath.Join(s.UploadsDir, objectKey[8:])
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
 	}
-	return filepath.Join(s.UploadsDir, objectKey)
+	return s
 }
 
 func randomID() string {
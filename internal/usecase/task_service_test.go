@@ -2,6 +2,8 @@ package usecase
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"encoding/base64"
 	"image"
 	"image/color"
@@ -16,6 +18,7 @@ import (
 	"permit-backend/internal/domain"
 	"permit-backend/internal/infrastructure/asset"
 	"permit-backend/internal/algo"
+	"permit-backend/internal/storage"
 )
 
 type fakeRepo struct {
@@ -38,9 +41,11 @@ func (r *fakeRepo) Get(id string) (*domain.Task, bool) {
 	return t, ok
 }
 
+var oneInch = domain.TaskSpec{Code: "cn_1inch", WidthPx: 295, HeightPx: 413, DPI: 300}
+
 type testAlgo struct{}
 
-func (testAlgo) IDPhoto(baseURL, imagePath string, height, width, dpi int) (algo.IDPhotoResp, error) {
+func (testAlgo) IDPhotoFile(ctx context.Context, src []byte, filename string, height, width, dpi int, opts algo.IDPhotoOptions) (algo.IDPhotoResp, error) {
 	img := image.NewRGBA(image.Rect(0, 0, max(width, 100), max(height, 100)))
 	for y := 0; y < img.Rect.Dy(); y++ {
 		for x := 0; x < img.Rect.Dx(); x++ {
@@ -52,7 +57,7 @@ func (testAlgo) IDPhoto(baseURL, imagePath string, height, width, dpi int) (algo
 	b64 := base64.StdEncoding.EncodeToString(buf.Bytes())
 	return algo.IDPhotoResp{OK: true, ImageBase64Standard: "data:image/png;base64," + b64}, nil
 }
-func (testAlgo) AddBackgroundBase64(baseURL, rgbaBase64, colorHex string, dpi int) (algo.AddBackgroundResp, error) {
+func (testAlgo) AddBackgroundBase64(ctx context.Context, rgbaBase64, colorHex string, render, dpi, kb int) (algo.AddBackgroundResp, error) {
 	data, err := algo.DecodeBase64(rgbaBase64)
 	if err != nil {
 		return algo.AddBackgroundResp{}, err
@@ -66,7 +71,7 @@ func (testAlgo) AddBackgroundBase64(baseURL, rgbaBase64, colorHex string, dpi in
 	b64 := base64.StdEncoding.EncodeToString(out.Bytes())
 	return algo.AddBackgroundResp{OK: true, ImageBase64: b64}, nil
 }
-func (testAlgo) AddBackgroundFile(baseURL string, rgbaPNG []byte, colorHex string, dpi int) (algo.AddBackgroundResp, error) {
+func (testAlgo) AddBackgroundFile(ctx context.Context, rgbaPNG []byte, colorHex string, render, dpi, kb int) (algo.AddBackgroundResp, error) {
 	im, err := png.Decode(bytes.NewReader(rgbaPNG))
 	if err != nil {
 		return algo.AddBackgroundResp{}, err
@@ -76,23 +81,19 @@ func (testAlgo) AddBackgroundFile(baseURL string, rgbaPNG []byte, colorHex strin
 	b64 := base64.StdEncoding.EncodeToString(out.Bytes())
 	return algo.AddBackgroundResp{OK: true, ImageBase64: b64}, nil
 }
-func (testAlgo) GenerateLayoutPhotosFile(baseURL string, rgbImage []byte, height, width, dpi, kb int) (algo.LayoutResp, error) {
+func (testAlgo) GenerateLayoutPhotosFile(ctx context.Context, rgbImage []byte, height, width, dpi, kb int) (algo.LayoutResp, error) {
 	// Pass-through: return the given RGB image as the layout
 	b64 := base64.StdEncoding.EncodeToString(rgbImage)
 	return algo.LayoutResp{OK: true, ImageBase64: b64}, nil
 }
 
-func colorHexOf(name string) string {
-	switch strings.ToLower(strings.TrimSpace(name)) {
-	case "white":
-		return "ffffff"
-	case "blue":
-		return "638cce"
-	case "red":
-		return "ff0000"
-	default:
-		return "ffffff"
+func colorOf(name string) domain.Color {
+	for _, c := range DefaultColors() {
+		if c.Name == strings.ToLower(strings.TrimSpace(name)) {
+			return c
+		}
 	}
+	return domain.Color{Name: "white", Hex: "ffffff"}
 }
 
 func max(a, b int) int {
@@ -127,19 +128,18 @@ func TestTaskService_EndToEnd(t *testing.T) {
 	}
 
 	repo := &fakeRepo{}
-	fs := asset.NewFSWriter(assetsDir)
+	privateDir := t.TempDir()
+	assets := asset.NewStore(storage.NewFS(assetsDir), storage.NewFS(privateDir))
 	al := testAlgo{}
 	svc := &TaskService{
-		Repo:       repo,
-		Assets:     fs,
-		Algo:       al,
-		AlgoURL:    "http://127.0.0.1:8080",
-		UploadsDir: uploadsDir,
-		AssetsDir:  assetsDir,
+		Repo:    repo,
+		Assets:  assets,
+		Algo:    al,
+		Uploads: storage.NewFS(uploadsDir),
 	}
 
 	available := []string{"white", "blue"}
-	tk, err := svc.CreateTask("user-1", "cn_1inch", "uploads/"+srcName, "white", 295, 413, 300, available, colorHexOf)
+	tk, err := svc.CreateTask(context.Background(), "user-1", oneInch, "uploads/"+srcName, "white", available, colorOf)
 	if err != nil {
 		t.Fatalf("CreateTask error: %v", err)
 	}
@@ -154,7 +154,7 @@ func TestTaskService_EndToEnd(t *testing.T) {
 	}
 
 	// Generate another background color
-	urlBlue, err := svc.GenerateBackground(tk.ID, "blue", tk.Spec.DPI, colorHexOf)
+	urlBlue, err := svc.GenerateBackground(context.Background(), tk.ID, "blue", tk.Spec.DPI, colorOf)
 	if err != nil {
 		t.Fatalf("GenerateBackground blue failed: %v", err)
 	}
@@ -163,19 +163,50 @@ func TestTaskService_EndToEnd(t *testing.T) {
 	}
 
 	// Generate 6-inch layout
-	urlLayout, err := svc.GenerateLayout(tk.ID, "white", tk.Spec.WidthPx, tk.Spec.HeightPx, tk.Spec.DPI, 200, colorHexOf)
+	layoutOpts := LayoutOptions{WidthPx: tk.Spec.WidthPx, HeightPx: tk.Spec.HeightPx, DPI: tk.Spec.DPI, KB: 200}
+	layoutKey, urlLayout, err := svc.GenerateLayout(context.Background(), tk.ID, "white", layoutOpts, colorOf)
 	if err != nil {
 		t.Fatalf("GenerateLayout error: %v", err)
 	}
 	if urlLayout == "" {
 		t.Fatalf("layout url empty")
 	}
-	if tk.LayoutUrls["6inch"] == "" {
-		t.Fatalf("layoutUrls missing 6inch")
+	if layoutKey != "6inch_white_295x413_300dpi_200kb_0" || tk.LayoutUrls[layoutKey] == "" {
+		t.Fatalf("layoutUrls missing %s: %v", layoutKey, tk.LayoutUrls)
+	}
+
+	// Every parameter is part of the cache key
+	blueKey, _, err := svc.GenerateLayout(context.Background(), tk.ID, "blue", layoutOpts, colorOf)
+	if err != nil || blueKey == layoutKey {
+		t.Fatalf("blue layout should not reuse the white sheet: %s %v", blueKey, err)
+	}
+	a4 := layoutOpts
+	a4.Paper, _ = domain.LookupPaper("a4", 0, 0)
+	a4.Copies = 4
+	a4Key, _, err := svc.GenerateLayout(context.Background(), tk.ID, "white", a4, colorOf)
+	if err != nil || a4Key != "a4_white_295x413_300dpi_200kb_4" {
+		t.Fatalf("a4 layout: %s %v", a4Key, err)
+	}
+
+	// Sizes that cannot be rendered, or only with a huge sheet, are rejected
+	// before anything is drawn.
+	var br ErrBadRequest
+	for name, o := range map[string]LayoutOptions{
+		"dpi too high":    {DPI: 100000, Paper: a4.Paper},
+		"dpi too low":     {DPI: 10},
+		"negative width":  {WidthPx: -1},
+		"negative height": {HeightPx: -413},
+		"negative kb":     {KB: -1},
+		"photo too large": {WidthPx: 5000, HeightPx: 7000},
+		"sheet too large": {DPI: 1200, Paper: a4.Paper},
+	} {
+		if _, _, err := svc.GenerateLayout(context.Background(), tk.ID, "white", o, colorOf); !errors.As(err, &br) {
+			t.Errorf("%s: want ErrBadRequest, got %v", name, err)
+		}
 	}
 
 	// Verify asset files exist
-	layoutPath := filepath.Join(assetsDir, tk.ID, "layout_6inch.jpg")
+	layoutPath := filepath.Join(assetsDir, tk.ID, "layout_"+layoutKey+".jpg")
 	if _, err := os.Stat(layoutPath); err != nil {
 		t.Fatalf("layout file not found: %v", err)
 	}
@@ -184,9 +215,252 @@ func TestTaskService_EndToEnd(t *testing.T) {
 		t.Fatalf("white background file not found: %v", err)
 	}
 
+	// Originals stay private; the public tree only holds watermarked previews
+	if _, err := os.Stat(filepath.Join(assetsDir, tk.ID, "baseline.png")); !os.IsNotExist(err) {
+		t.Fatalf("baseline must not be public: %v", err)
+	}
+	original, err := os.ReadFile(filepath.Join(privateDir, tk.ID, "white.jpg"))
+	if err != nil {
+		t.Fatalf("private original not found: %v", err)
+	}
+	preview, _ := os.ReadFile(whitePath)
+	if bytes.Equal(original, preview) {
+		t.Fatalf("public preview is not watermarked")
+	}
+
 	// Ensure updated timestamp moved forward
 	if time.Since(tk.UpdatedAt) > time.Minute {
 		t.Fatalf("updatedAt not recent: %v", tk.UpdatedAt)
 	}
 }
 
+
+type stubQueue struct {
+	ids []string
+	err error
+}
+
+func (q *stubQueue) Submit(taskID string) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.ids = append(q.ids, taskID)
+	return nil
+}
+
+func TestTaskService_CreateTaskQueued(t *testing.T) {
+	uploadsDir := t.TempDir()
+	assetsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(uploadsDir, "source.jpg"), makeSampleJPEG(120, 160), 0o644); err != nil {
+		t.Fatalf("write source failed: %v", err)
+	}
+	q := &stubQueue{}
+	svc := &TaskService{
+		Repo:    &fakeRepo{},
+		Assets:  asset.NewStore(storage.NewFS(assetsDir), storage.NewFS(t.TempDir())),
+		Algo:    testAlgo{},
+		Queue:   q,
+		Uploads: storage.NewFS(uploadsDir),
+	}
+	tk, err := svc.CreateTask(context.Background(), "user-1", oneInch, "uploads/source.jpg", "blue", nil, colorOf)
+	if err != nil {
+		t.Fatalf("CreateTask error: %v", err)
+	}
+	if tk.Status != domain.StatusQueued {
+		t.Fatalf("expected queued, got %s", tk.Status)
+	}
+	if len(q.ids) != 1 || q.ids[0] != tk.ID {
+		t.Fatalf("task not submitted: %v", q.ids)
+	}
+
+	svc.ProcessTask(context.Background(), tk.ID, colorOf)
+	got, _ := svc.Repo.Get(tk.ID)
+	if got.Status != domain.StatusDone {
+		t.Fatalf("task status not done: %s (error=%s)", got.Status, got.ErrorMsg)
+	}
+	if got.ProcessedUrls["blue"] == "" {
+		t.Fatalf("processed blue url empty")
+	}
+
+	q.err = errors.New("full")
+	tk2, err := svc.CreateTask(context.Background(), "user-1", oneInch, "uploads/source.jpg", "", nil, colorOf)
+	if _, ok := err.(ErrUnavailable); !ok {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if got, _ := svc.Repo.Get(tk2.ID); got.Status != domain.StatusFailed {
+		t.Fatalf("rejected task should be failed, got %s", got.Status)
+	}
+}
+
+func TestTaskService_Resume(t *testing.T) {
+	repo := &fakeRepo{}
+	for id, st := range map[string]domain.Status{"queued": domain.StatusQueued, "processing": domain.StatusProcessing, "done": domain.StatusDone} {
+		_ = repo.Put(&domain.Task{ID: id, Status: st})
+	}
+	q := &stubQueue{}
+	svc := &TaskService{Repo: repo, Queue: q}
+	if n := svc.Resume([]string{"queued", "processing", "done", "missing"}); n != 2 || len(q.ids) != 2 {
+		t.Fatalf("resumed %d, queued %v", n, q.ids)
+	}
+	if got, _ := repo.Get("processing"); got.Status != domain.StatusQueued {
+		t.Fatalf("interrupted task = %s, want queued", got.Status)
+	}
+
+	_ = repo.Put(&domain.Task{ID: "stuck", Status: domain.StatusProcessing})
+	q.err = errors.New("full")
+	if n := svc.Resume([]string{"stuck"}); n != 0 {
+		t.Fatalf("resumed %d with a full queue", n)
+	}
+	if got, _ := repo.Get("stuck"); got.Status != domain.StatusFailed || got.ErrorMsg == "" {
+		t.Fatalf("task the queue refused = %+v", got)
+	}
+}
+
+type recordingAlgo struct {
+	testAlgo
+	opts     algo.IDPhotoOptions
+	layoutKB int
+	bgHex    string
+	bgRender int
+	bgKB     int
+}
+
+func (a *recordingAlgo) AddBackgroundFile(ctx context.Context, rgbaPNG []byte, colorHex string, render, dpi, kb int) (algo.AddBackgroundResp, error) {
+	a.bgHex, a.bgRender, a.bgKB = colorHex, render, kb
+	return a.testAlgo.AddBackgroundFile(ctx, rgbaPNG, colorHex, render, dpi, kb)
+}
+
+func (a *recordingAlgo) AddBackgroundBase64(ctx context.Context, rgbaBase64, colorHex string, render, dpi, kb int) (algo.AddBackgroundResp, error) {
+	a.bgHex, a.bgRender, a.bgKB = colorHex, render, kb
+	return a.testAlgo.AddBackgroundBase64(ctx, rgbaBase64, colorHex, render, dpi, kb)
+}
+
+func (a *recordingAlgo) IDPhotoFile(ctx context.Context, src []byte, filename string, height, width, dpi int, opts algo.IDPhotoOptions) (algo.IDPhotoResp, error) {
+	a.opts = opts
+	return a.testAlgo.IDPhotoFile(ctx, src, filename, height, width, dpi, opts)
+}
+
+func (a *recordingAlgo) GenerateLayoutPhotosFile(ctx context.Context, rgbImage []byte, height, width, dpi, kb int) (algo.LayoutResp, error) {
+	a.layoutKB = kb
+	return a.testAlgo.GenerateLayoutPhotosFile(ctx, rgbImage, height, width, dpi, kb)
+}
+
+func TestTaskService_SpecRulesReachAlgo(t *testing.T) {
+	uploadsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(uploadsDir, "source.jpg"), makeSampleJPEG(120, 160), 0o644); err != nil {
+		t.Fatalf("write source failed: %v", err)
+	}
+	al := &recordingAlgo{}
+	svc := &TaskService{
+		Repo:    &fakeRepo{},
+		Assets:  asset.NewStore(storage.NewFS(t.TempDir()), storage.NewFS(t.TempDir())),
+		Algo:    al,
+		Uploads: storage.NewFS(uploadsDir),
+	}
+	spec := domain.SpecDef{Code: "exam", WidthPx: 295, HeightPx: 413, DPI: 300, MinKB: 30, MaxKB: 40, HeadHeightRatio: 0.5, TopMarginRatio: 0.1}.TaskSpec()
+	tk, err := svc.CreateTask(context.Background(), "user-1", spec, "uploads/source.jpg", "white", nil, colorOf)
+	if err != nil || tk.Status != domain.StatusDone {
+		t.Fatalf("CreateTask: %v %+v", err, tk)
+	}
+	// Head height 0.5 of a 295x413 photo is 0.5²·413/295 = 0.35 of its area.
+	if al.opts != (algo.IDPhotoOptions{HeadMeasureRatio: 0.35, TopDistanceMin: 0.09, TopDistanceMax: 0.11}) {
+		t.Fatalf("idphoto options not derived from spec: %+v", al.opts)
+	}
+	if al.bgKB != 40 {
+		t.Fatalf("add_background kb should be spec maxKb, got %d", al.bgKB)
+	}
+	// The flat test photo compresses far below minKb and is padded up to it.
+	if jpg, err := svc.Assets.Read(tk.ID, "white.jpg"); err != nil || len(jpg) < 30*1024 {
+		t.Fatalf("single photo is %d bytes, want at least minKb: %v", len(jpg), err)
+	}
+	if _, err := svc.GenerateBackground(context.Background(), tk.ID, "blue", 300, colorOf); err != nil || al.bgKB != 40 {
+		t.Fatalf("GenerateBackground kb = %d: %v", al.bgKB, err)
+	}
+	if _, _, err := svc.GenerateLayout(context.Background(), tk.ID, "white", LayoutOptions{}, colorOf); err != nil {
+		t.Fatalf("GenerateLayout: %v", err)
+	}
+	if al.layoutKB != 40 {
+		t.Fatalf("layout kb should default to spec maxKb, got %d", al.layoutKB)
+	}
+}
+
+func TestTaskService_GradientAndCustomColors(t *testing.T) {
+	uploadsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(uploadsDir, "source.jpg"), makeSampleJPEG(120, 160), 0o644); err != nil {
+		t.Fatalf("write source failed: %v", err)
+	}
+	al := &recordingAlgo{}
+	colors := &ColorService{Repo: &memColors{}}
+	if err := colors.Seed(DefaultColors()); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(name string) domain.Color {
+		c, _ := colors.Resolve(name, true)
+		return c
+	}
+	svc := &TaskService{
+		Repo:    &fakeRepo{},
+		Assets:  asset.NewStore(storage.NewFS(t.TempDir()), storage.NewFS(t.TempDir())),
+		Algo:    al,
+		Uploads: storage.NewFS(uploadsDir),
+	}
+	tk, err := svc.CreateTask(context.Background(), "user-1", oneInch, "uploads/source.jpg", "white", nil, resolve)
+	if err != nil || tk.Status != domain.StatusDone {
+		t.Fatalf("CreateTask: %v %+v", err, tk)
+	}
+
+	if _, err := svc.GenerateBackground(context.Background(), tk.ID, "gradient", 300, resolve); err != nil {
+		t.Fatalf("gradient: %v", err)
+	}
+	if al.bgHex != "638cce" || al.bgRender != 1 {
+		t.Fatalf("gradient should render top-down from first stop, got %s/%d", al.bgHex, al.bgRender)
+	}
+
+	if _, err := colors.Resolve("#1A2b3C", false); err == nil {
+		t.Fatalf("custom color must be rejected when the spec does not allow it")
+	}
+	c, err := colors.Resolve("#1A2b3C", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := svc.GenerateBackground(context.Background(), tk.ID, c.Name, 300, resolve)
+	if err != nil {
+		t.Fatalf("custom: %v", err)
+	}
+	if al.bgHex != "1a2b3c" || al.bgRender != 0 || !strings.HasSuffix(url, "/hex_1a2b3c.jpg") {
+		t.Fatalf("custom color: %s/%d %s", al.bgHex, al.bgRender, url)
+	}
+	if _, _, err := svc.GenerateLayout(context.Background(), tk.ID, c.Name, LayoutOptions{Copies: 2}, resolve); err != nil {
+		t.Fatalf("layout from custom color: %v", err)
+	}
+}
+
+func TestColorService_SaveGradient(t *testing.T) {
+	svc := &ColorService{Repo: &memColors{}}
+	c, err := svc.Save(domain.Color{Name: "Sky", Gradient: &domain.Gradient{Stops: []string{"#638CCE", "#FFFFFF"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Hex != "638cce" || c.Gradient.Mode != domain.GradientLinear || c.Gradient.Stops[1] != "ffffff" || c.Render() != 1 {
+		t.Fatalf("saved = %+v", c)
+	}
+	var br ErrBadRequest
+	for name, stops := range map[string][]string{
+		"one stop":    {"638cce"},
+		"three stops": {"638cce", "ff0000", "ffffff"},
+		"not white":   {"638cce", "000000"},
+	} {
+		if _, err := svc.Save(domain.Color{Name: "g", Gradient: &domain.Gradient{Stops: stops}}); !errors.As(err, &br) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+type memColors struct{ m []domain.Color }
+
+func (r *memColors) UpsertColors(cs []domain.Color) error {
+	r.m = append(r.m, cs...)
+	return nil
+}
+func (r *memColors) ListColors() ([]domain.Color, error) { return r.m, nil }
+func (r *memColors) DeleteColor(string) error           { return nil }
@@ -0,0 +1,318 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"permit-backend/internal/domain"
+	"permit-backend/internal/photo"
+	"permit-backend/internal/storage"
+)
+
+type UploadRepo interface {
+	PutUploadSession(*domain.UploadSession) error
+	GetUploadSession(id string) (*domain.UploadSession, bool)
+	DeleteUploadSession(id string) error
+	// AppendUploadPart adds part to open session id only if the session has
+	// received exactly part.Offset bytes, and reports whether it did.
+	AppendUploadPart(id string, part domain.UploadPart, updatedAt, expiresAt time.Time) (bool, error)
+	// CompleteUploadSession stores u only if the session is still open, and
+	// reports whether it did.
+	CompleteUploadSession(u *domain.UploadSession) (bool, error)
+	// ListExpiredUploadSessions returns up to limit open sessions whose
+	// ExpiresAt is before now.
+	ListExpiredUploadSessions(now time.Time, limit int) ([]domain.UploadSession, error)
+}
+
+// ErrOffsetMismatch rejects a chunk that does not start where the session
+// left off; Offset is where the next chunk must start.
+type ErrOffsetMismatch struct {
+	Offset int64
+}
+
+func (e ErrOffsetMismatch) Error() string {
+	return fmt.Sprintf("chunk must start at offset %d", e.Offset)
+}
+
+type ErrChecksum string
+
+func (e ErrChecksum) Error() string { return string(e) }
+
+// UploadService takes uploads in chunks so a dropped connection only costs
+// the chunk in flight. Chunks must arrive in order; each is stored as its
+// own object in Uploads under parts/ until Complete joins them, checks the
+// SHA-256 given at Init and normalizes the image like a single-shot upload.
+// Single-shot uploads are recorded by Store as completed sessions, so Owned
+// can tell who uploaded an object either way. Open sessions not touched for
+// TTL are removed by Expire; completed ones are kept along with their object
+// as the record of who uploaded it.
+type UploadService struct {
+	Repo       UploadRepo
+	Uploads    storage.Storage
+	Photo      photo.Options
+	MaxBytes   int64
+	ChunkBytes int64
+	TTL        time.Duration
+}
+
+// Init opens a session for a file of size bytes whose SHA-256 is sum (hex).
+func (s *UploadService) Init(userID, filename string, size int64, sum string) (*domain.UploadSession, error) {
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	if size <= 0 {
+		return nil, ErrBadRequest("size must be positive")
+	}
+	if s.MaxBytes > 0 && size > s.MaxBytes {
+		return nil, ErrBadRequest(fmt.Sprintf("file is larger than %d bytes", s.MaxBytes))
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return nil, ErrBadRequest("sha256 must be 64 hex characters")
+	}
+	now := time.Now().UTC()
+	sess := &domain.UploadSession{
+		ID:        randomID(),
+		UserID:    userID,
+		Filename:  filename,
+		Size:      size,
+		SHA256:    sum,
+		Status:    domain.UploadOpen,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(s.TTL),
+	}
+	if err := s.Repo.PutUploadSession(sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Get returns the caller's session. Other users' and expired sessions are
+// not found.
+func (s *UploadService) Get(userID, id string) (*domain.UploadSession, error) {
+	sess, ok := s.Repo.GetUploadSession(id)
+	if !ok || sess.UserID != userID || !time.Now().Before(sess.ExpiresAt) {
+		return nil, ErrNotFound("upload session")
+	}
+	return sess, nil
+}
+
+// PutChunk appends data at offset, which must equal the bytes received so
+// far. A non-empty sum is checked against the chunk's SHA-256 before it is
+// stored.
+func (s *UploadService) PutChunk(ctx context.Context, userID, id string, offset int64, data []byte, sum string) (*domain.UploadSession, error) {
+	sess, err := s.Get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if sess.Status != domain.UploadOpen {
+		return nil, ErrConflict("upload already completed")
+	}
+	if offset != sess.Received {
+		return nil, ErrOffsetMismatch{Offset: sess.Received}
+	}
+	n := int64(len(data))
+	if n == 0 {
+		return nil, ErrBadRequest("empty chunk")
+	}
+	if s.ChunkBytes > 0 && n > s.ChunkBytes {
+		return nil, ErrBadRequest(fmt.Sprintf("chunk is larger than %d bytes", s.ChunkBytes))
+	}
+	if offset+n > sess.Size {
+		return nil, ErrBadRequest(fmt.Sprintf("chunk ends at %d, past the declared size %d", offset+n, sess.Size))
+	}
+	digest := sha256.Sum256(data)
+	got := hex.EncodeToString(digest[:])
+	if sum != "" && !strings.EqualFold(sum, got) {
+		return nil, ErrChecksum("chunk checksum does not match")
+	}
+	// The key is unique per attempt, so a racing request for the same
+	// offset cannot overwrite the part that wins below.
+	part := domain.UploadPart{Offset: offset, Size: n, SHA256: got, Key: fmt.Sprintf("parts/%s/%012d_%s", id, offset, randomID()[:8])}
+	if err := s.Uploads.Put(ctx, part.Key, bytes.NewReader(data), n, "application/octet-stream"); err != nil {
+		return nil, err
+	}
+
+	// The append only applies at the offset checked above, so of two
+	// requests racing for it, in this process or another, one wins.
+	now := time.Now().UTC()
+	ok, err := s.Repo.AppendUploadPart(id, part, now, now.Add(s.TTL))
+	if err == nil && !ok {
+		err = s.moved(userID, id)
+	}
+	if err != nil {
+		_ = s.Uploads.Delete(ctx, part.Key)
+		return nil, err
+	}
+	sess.Parts = append(sess.Parts, part)
+	sess.Received += n
+	sess.UpdatedAt, sess.ExpiresAt = now, now.Add(s.TTL)
+	return sess, nil
+}
+
+// moved explains why a conditional update of session id did not apply.
+func (s *UploadService) moved(userID, id string) error {
+	cur, err := s.Get(userID, id)
+	if err != nil {
+		return err
+	}
+	if cur.Status != domain.UploadOpen {
+		return ErrConflict("upload already completed")
+	}
+	return ErrOffsetMismatch{Offset: cur.Received}
+}
+
+// Complete joins the parts, verifies the file checksum and stores the
+// normalized image under the same kind of objectKey as a single-shot
+// upload. A checksum mismatch or unusable image (*photo.Rejection) discards
+// the session. Completing a completed session returns it unchanged, so a
+// client that lost the response can simply retry.
+func (s *UploadService) Complete(ctx context.Context, userID, id string) (*domain.UploadSession, error) {
+	sess, err := s.Get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if sess.Status == domain.UploadCompleted {
+		return sess, nil
+	}
+	if sess.Received != sess.Size {
+		return nil, ErrConflict(fmt.Sprintf("upload incomplete: %d of %d bytes received", sess.Received, sess.Size))
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(sess.Size))
+	for _, p := range sess.Parts {
+		b, err := storage.ReadAll(ctx, s.Uploads, p.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read part %d: %w", p.Offset, err)
+		}
+		buf.Write(b)
+	}
+	data := buf.Bytes()
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != sess.SHA256 {
+		_ = s.discard(ctx, sess)
+		return nil, ErrChecksum("file checksum does not match, start a new upload")
+	}
+	img, err := photo.Normalize(ctx, data, s.Photo)
+	var rej *photo.Rejection
+	if errors.As(err, &rej) {
+		_ = s.discard(ctx, sess)
+		return nil, rej
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Named after the session, so a retried Complete writes the same object.
+	name := objectName(sess, img)
+	if err := s.Uploads.Put(ctx, name, bytes.NewReader(img.Data), int64(len(img.Data)), img.ContentType); err != nil {
+		return nil, err
+	}
+
+	parts := sess.Parts
+	now := time.Now().UTC()
+	sess.Status, sess.Parts = domain.UploadCompleted, nil
+	sess.ObjectKey, sess.Width, sess.Height = "uploads/"+name, img.Width, img.Height
+	sess.UpdatedAt, sess.ExpiresAt = now, now.Add(s.TTL)
+	ok, err := s.Repo.CompleteUploadSession(sess)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// A concurrent Complete got there first.
+		cur, err := s.Get(userID, id)
+		if err != nil {
+			return nil, err
+		}
+		if cur.Status != domain.UploadCompleted {
+			return nil, ErrConflict("upload changed while completing")
+		}
+		return cur, nil
+	}
+	for _, p := range parts {
+		_ = s.Uploads.Delete(ctx, p.Key)
+	}
+	return sess, nil
+}
+
+// Store saves an image uploaded in one request, already normalized, and
+// records it as a completed session of userID.
+func (s *UploadService) Store(ctx context.Context, userID, filename string, img *photo.Result) (*domain.UploadSession, error) {
+	now := time.Now().UTC()
+	digest := sha256.Sum256(img.Data)
+	n := int64(len(img.Data))
+	sess := &domain.UploadSession{
+		ID:        randomID(),
+		UserID:    userID,
+		Filename:  filename,
+		Size:      n,
+		SHA256:    hex.EncodeToString(digest[:]),
+		Received:  n,
+		Status:    domain.UploadCompleted,
+		Width:     img.Width,
+		Height:    img.Height,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(s.TTL),
+	}
+	name := objectName(sess, img)
+	if err := s.Uploads.Put(ctx, name, bytes.NewReader(img.Data), n, img.ContentType); err != nil {
+		return nil, err
+	}
+	sess.ObjectKey = "uploads/" + name
+	if err := s.Repo.PutUploadSession(sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Owned returns the completed upload stored as objectKey if userID uploaded
+// it, however long ago that was.
+func (s *UploadService) Owned(userID, objectKey string) (*domain.UploadSession, error) {
+	id, _, ok := strings.Cut(uploadKey(objectKey), "_")
+	if !ok {
+		return nil, ErrNotFound("upload")
+	}
+	sess, ok := s.Repo.GetUploadSession(id)
+	if !ok || sess.UserID != userID || sess.Status != domain.UploadCompleted || sess.ObjectKey != objectKey {
+		return nil, ErrNotFound("upload")
+	}
+	return sess, nil
+}
+
+// objectName names the stored image after its session, keeping the
+// client's stem; the extension follows the normalized format.
+func objectName(sess *domain.UploadSession, img *photo.Result) string {
+	return sess.ID + "_" + strings.TrimSuffix(sess.Filename, filepath.Ext(sess.Filename)) + img.Ext()
+}
+
+// Expire removes open sessions that expired before now together with their
+// parts, and returns how many it removed. Completed sessions are kept.
+func (s *UploadService) Expire(ctx context.Context, now time.Time) (int, error) {
+	n := 0
+	for {
+		list, err := s.Repo.ListExpiredUploadSessions(now, 100)
+		if err != nil || len(list) == 0 {
+			return n, err
+		}
+		for i := range list {
+			if err := s.discard(ctx, &list[i]); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+func (s *UploadService) discard(ctx context.Context, sess *domain.UploadSession) error {
+	for _, p := range sess.Parts {
+		if err := s.Uploads.Delete(ctx, p.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return s.Repo.DeleteUploadSession(sess.ID)
+}
@@ -0,0 +1,280 @@
+package usecase
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"permit-backend/internal/domain"
+	"permit-backend/internal/infrastructure/repo"
+	"permit-backend/internal/photo"
+	"permit-backend/internal/storage"
+)
+
+func sha256Hex(b []byte) string {
+	d := sha256.Sum256(b)
+	return hex.EncodeToString(d[:])
+}
+
+func newUploadService(t *testing.T) (*UploadService, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return &UploadService{
+		Repo:       repo.NewMemoryUploadRepo(),
+		Uploads:    storage.NewFS(dir),
+		MaxBytes:   1 << 20,
+		ChunkBytes: 4096,
+		TTL:        time.Hour,
+	}, dir
+}
+
+// countParts returns how many chunk objects are stored for session id.
+func countParts(t *testing.T, dir, id string) int {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dir, "parts", id))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestUploadService_ResumableUpload(t *testing.T) {
+	svc, dir := newUploadService(t)
+	ctx := context.Background()
+	file := makeSampleJPEG(600, 800)
+	sess, err := svc.Init("u1", "me.jpeg", int64(len(file)), sha256Hex(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var off int64
+	for n := 0; off < int64(len(file)); n++ {
+		end := min(off+svc.ChunkBytes, int64(len(file)))
+		chunk := file[off:end]
+		if n == 1 {
+			// The response to this chunk is "lost": the client resends it
+			// and is told where to continue instead.
+			if _, err := svc.PutChunk(ctx, "u1", sess.ID, off, chunk, sha256Hex(chunk)); err != nil {
+				t.Fatal(err)
+			}
+			var om ErrOffsetMismatch
+			if _, err := svc.PutChunk(ctx, "u1", sess.ID, off, chunk, ""); !errors.As(err, &om) || om.Offset != end {
+				t.Fatalf("resent chunk: %v", err)
+			}
+			cur, _ := svc.Get("u1", sess.ID)
+			off = cur.Received
+			continue
+		}
+		if n == 2 {
+			var ce ErrChecksum
+			if _, err := svc.PutChunk(ctx, "u1", sess.ID, off, chunk, sha256Hex([]byte("other"))); !errors.As(err, &ce) {
+				t.Fatalf("bad chunk checksum: %v", err)
+			}
+		}
+		if _, err := svc.PutChunk(ctx, "u1", sess.ID, off, chunk, ""); err != nil {
+			t.Fatal(err)
+		}
+		off = end
+	}
+	if n := countParts(t, dir, sess.ID); n != len(file)/4096+1 {
+		t.Fatalf("stored parts = %d", n)
+	}
+
+	var nf ErrNotFound
+	if _, err := svc.Complete(ctx, "u2", sess.ID); !errors.As(err, &nf) {
+		t.Fatalf("other user's session: %v", err)
+	}
+	done, err := svc.Complete(ctx, "u1", sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != domain.UploadCompleted || done.Width != 600 || done.Height != 800 || done.ObjectKey != "uploads/"+sess.ID+"_me.jpg" {
+		t.Fatalf("completed = %+v", done)
+	}
+	if got, err := storage.ReadAll(ctx, svc.Uploads, uploadKey(done.ObjectKey)); err != nil || photo.Sniff(got) != "jpeg" {
+		t.Fatalf("stored object: %v", err)
+	}
+	if n := countParts(t, dir, sess.ID); n != 0 {
+		t.Fatalf("%d parts left after complete", n)
+	}
+	if again, err := svc.Complete(ctx, "u1", sess.ID); err != nil || again.ObjectKey != done.ObjectKey {
+		t.Fatalf("repeated complete = %+v, %v", again, err)
+	}
+	var ce ErrConflict
+	if _, err := svc.PutChunk(ctx, "u1", sess.ID, done.Size, []byte{1}, ""); !errors.As(err, &ce) {
+		t.Fatalf("chunk after complete: %v", err)
+	}
+}
+
+func TestUploadService_RacingChunks(t *testing.T) {
+	// Two services over one repo stand in for two server processes.
+	a, _ := newUploadService(t)
+	b := &UploadService{Repo: a.Repo, Uploads: a.Uploads, MaxBytes: a.MaxBytes, ChunkBytes: a.ChunkBytes, TTL: a.TTL}
+	ctx := context.Background()
+	file := makeSampleJPEG(600, 800)
+	sess, _ := a.Init("u1", "me.jpg", int64(len(file)), sha256Hex(file))
+
+	chunk := file[:a.ChunkBytes]
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	for _, svc := range []*UploadService{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.PutChunk(ctx, "u1", sess.ID, 0, chunk, "")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	won := 0
+	for err := range errs {
+		var om ErrOffsetMismatch
+		switch {
+		case err == nil:
+			won++
+		case !errors.As(err, &om) || om.Offset != a.ChunkBytes:
+			t.Fatalf("losing chunk: %v", err)
+		}
+	}
+	cur, _ := a.Get("u1", sess.ID)
+	if won != 1 || cur.Received != a.ChunkBytes || len(cur.Parts) != 1 {
+		t.Fatalf("%d chunks won, session = %+v", won, cur)
+	}
+}
+
+func TestUploadService_Rejections(t *testing.T) {
+	svc, dir := newUploadService(t)
+	ctx := context.Background()
+	var br ErrBadRequest
+	for name, c := range map[string]struct {
+		size int64
+		sum  string
+	}{
+		"zero size": {0, sha256Hex(nil)},
+		"too large": {2 << 20, sha256Hex(nil)},
+		"bad sum":   {10, "abc"},
+	} {
+		if _, err := svc.Init("u1", "me.jpg", c.size, c.sum); !errors.As(err, &br) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	file := makeSampleJPEG(300, 300)
+	sess, _ := svc.Init("u1", "me.jpg", int64(len(file)), sha256Hex(file))
+	if _, err := svc.PutChunk(ctx, "u1", sess.ID, 0, make([]byte, 5000), ""); !errors.As(err, &br) {
+		t.Fatalf("oversized chunk: %v", err)
+	}
+	var ce ErrConflict
+	if _, err := svc.Complete(ctx, "u1", sess.ID); !errors.As(err, &ce) {
+		t.Fatalf("complete before all bytes: %v", err)
+	}
+	// Corrupt the first byte: every chunk is accepted, the file sum is not.
+	bad := append([]byte{0}, file[1:]...)
+	for off := int64(0); off < int64(len(bad)); off += svc.ChunkBytes {
+		if _, err := svc.PutChunk(ctx, "u1", sess.ID, off, bad[off:min(off+svc.ChunkBytes, int64(len(bad)))], ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sum ErrChecksum
+	if _, err := svc.Complete(ctx, "u1", sess.ID); !errors.As(err, &sum) {
+		t.Fatalf("complete with wrong sum: %v", err)
+	}
+	var nf ErrNotFound
+	if _, err := svc.Get("u1", sess.ID); !errors.As(err, &nf) || countParts(t, dir, sess.ID) != 0 {
+		t.Fatalf("session not discarded: %v", err)
+	}
+
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n")
+	sess, _ = svc.Init("u1", "scan.jpg", int64(len(pdf)), sha256Hex(pdf))
+	_, _ = svc.PutChunk(ctx, "u1", sess.ID, 0, pdf, "")
+	var rej *photo.Rejection
+	if _, err := svc.Complete(ctx, "u1", sess.ID); !errors.As(err, &rej) || rej.Reason != photo.ReasonUnsupported {
+		t.Fatalf("complete with pdf: %v", err)
+	}
+}
+
+func TestUploadService_StoreAndOwned(t *testing.T) {
+	svc, _ := newUploadService(t)
+	ctx := context.Background()
+	img, err := photo.Normalize(ctx, makeSampleJPEG(300, 400), photo.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := svc.Store(ctx, "u1", "me.jpeg", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.ObjectKey != "uploads/"+up.ID+"_me.jpg" || up.Width != 300 || up.Height != 400 {
+		t.Fatalf("stored = %+v", up)
+	}
+	if got, err := svc.Owned("u1", up.ObjectKey); err != nil || got.ID != up.ID {
+		t.Fatalf("Owned = %+v, %v", got, err)
+	}
+	var nf ErrNotFound
+	for name, c := range map[string]struct{ user, key string }{
+		"other user":    {"u2", up.ObjectKey},
+		"renamed":       {"u1", "uploads/" + up.ID + "_you.jpg"},
+		"no session id": {"u1", "uploads/me.jpg"},
+	} {
+		if _, err := svc.Owned(c.user, c.key); !errors.As(err, &nf) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// An open chunked session owns nothing yet.
+	file := makeSampleJPEG(300, 300)
+	open, _ := svc.Init("u1", "a.jpg", int64(len(file)), sha256Hex(file))
+	if _, err := svc.Owned("u1", "uploads/"+open.ID+"_a.jpg"); !errors.As(err, &nf) {
+		t.Fatalf("open session: %v", err)
+	}
+}
+
+func TestUploadService_Expire(t *testing.T) {
+	svc, dir := newUploadService(t)
+	ctx := context.Background()
+	file := makeSampleJPEG(300, 300)
+	abandoned, _ := svc.Init("u1", "a.jpg", int64(len(file)), sha256Hex(file))
+	if _, err := svc.PutChunk(ctx, "u1", abandoned.ID, 0, file[:100], ""); err != nil {
+		t.Fatal(err)
+	}
+	img, err := photo.Normalize(ctx, file, photo.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := svc.Store(ctx, "u1", "b.jpg", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := svc.Expire(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("expire before ttl = %d, %v", n, err)
+	}
+	n, err := svc.Expire(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expire after ttl = %d, %v", n, err)
+	}
+	if _, ok := svc.Repo.GetUploadSession(abandoned.ID); ok || countParts(t, dir, abandoned.ID) != 0 {
+		t.Fatal("abandoned session survived expiry")
+	}
+	// A completed upload stays its uploader's after the TTL.
+	if got, err := svc.Owned("u1", kept.ObjectKey); err != nil || got.ID != kept.ID {
+		t.Fatalf("Owned after expiry = %+v, %v", got, err)
+	}
+
+	// An expired session is gone for the client even before the sweep.
+	svc.TTL = -time.Second
+	stale, _ := svc.Init("u1", "b.jpg", int64(len(file)), sha256Hex(file))
+	var nf ErrNotFound
+	if _, err := svc.PutChunk(ctx, "u1", stale.ID, 0, file[:100], ""); !errors.As(err, &nf) {
+		t.Fatalf("chunk for expired session: %v", err)
+	}
+}